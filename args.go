@@ -8,13 +8,28 @@ import (
 
 var (
 	// Do not accept self logs
-	ignorePod        string
-	configPath       string
-	senderConfigPath string
-	namespace        string
-	getLogsMethod    string
+	ignorePod         string
+	includeContainers string
+	excludeContainers string
+	configPath        string
+	senderConfigPath  string
+	pipelineConfig    string
+	namespace         string
+	namespaces        string
+	namespaceSelector string
+	getLogsMethod     string
+
+	multiline         string
+	decode            string
+	enrich            string
+	enrichAnnotations string
+
+	checkpointStore     string
+	checkpointPath      string
+	checkpointConfigMap string
 
 	kubeSkipTLSVerify bool
+	allNamespaces     bool
 	tickTime          int
 )
 
@@ -22,14 +37,27 @@ type ignored []*regexp.Regexp
 
 func init() {
 	flag.StringVar(&ignorePod, "ignore-pod", "", "regexp for ignoring self logs")
+	flag.StringVar(&includeContainers, "include-containers", "", "comma separated regexps of the container names to collect logs from")
+	flag.StringVar(&excludeContainers, "exclude-containers", "", "comma separated regexps of the container names to ignore")
 	flag.StringVar(&configPath, "kube-config", "", "absolute path to the kubectl config")
 	flag.StringVar(&senderConfigPath, "sender-config", "", "absolute path to the sender.json")
+	flag.StringVar(&pipelineConfig, "pipeline-config", "", "absolute path to the processors JSON. Overrides the processors of the sender.json")
 	flag.StringVar(&namespace, "kube-namespace", "", "kubernetes namespace")
+	flag.StringVar(&namespaces, "kube-namespaces", "", "comma separated list of the kubernetes namespaces")
+	flag.StringVar(&namespaceSelector, "kube-namespace-selector", "", "label selector of the kubernetes namespaces")
 	flag.StringVar(&getLogsMethod, "get-logs-method", "tail", "Method to retrieve a logs from the pod. Can be `tail' or `follow'.")
+	flag.StringVar(&multiline, "multiline", "", "default multiline config in JSON. See the `kubeat-multiline' annotation.")
+	flag.StringVar(&decode, "decode", "none", "default decoder of the log lines. Can be `none', `json', `logfmt' or `auto'.")
+	flag.StringVar(&enrich, "enrich", "", "comma separated list of the metadata enrichers: `labels', `node', `ip', `owner', `image'")
+	flag.StringVar(&enrichAnnotations, "enrich-annotations", "", "comma separated list of the pod annotations to add into the metadata")
+	flag.StringVar(&checkpointStore, "checkpoint-store", "", "Store of the shipped logs positions. Can be `file' or `configmap'. Disabled if empty.")
+	flag.StringVar(&checkpointPath, "checkpoint-path", "/var/lib/kubeat/checkpoints.json", "absolute path to the checkpoints file")
+	flag.StringVar(&checkpointConfigMap, "checkpoint-configmap", "kubeat-checkpoints", "name of the checkpoints ConfigMap in the kubeat namespace")
 
 	flag.BoolVar(&kubeSkipTLSVerify, "kube-skip-tls-verify", false, "skip k8s TLS verification")
+	flag.BoolVar(&allNamespaces, "kube-all-namespaces", false, "collect logs from all the kubernetes namespaces")
 
-	flag.IntVar(&tickTime, "tick-time", 60, "Metrics tick")
+	flag.IntVar(&tickTime, "tick-time", 60, "Metrics, tail logs and pods informer resync tick")
 
 	flag.Parse()
 }
@@ -0,0 +1,276 @@
+package beater
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	DEFAULT_BATCH_LIMIT  = 1000
+	DEFAULT_BUFFER_BYTES = 64 << 20
+	DEFAULT_BATCH_BYTES  = 5 << 20
+
+	BLOCK_POLICY           = "block"
+	DROP_OLDEST_POLICY     = "drop_oldest"
+	DROP_NEWEST_POLICY     = "drop_newest"
+	DEFAULT_HIGH_WATERMARK = 0.8
+)
+
+// BackpressureConfig describes what happens when the buffer is full.
+// With the block policy readers are paused when the buffer reaches
+// the HighWatermark part of the limits, drop policies drop the messages
+// when the buffer is full.
+type BackpressureConfig struct {
+	Policy        string  `json:"policy"`
+	HighWatermark float64 `json:"high_watermark"`
+}
+
+func (c *BackpressureConfig) setDefaults() {
+	if c.Policy == "" {
+		c.Policy = BLOCK_POLICY
+	}
+	if c.HighWatermark <= 0 || c.HighWatermark > 1 {
+		c.HighWatermark = DEFAULT_HIGH_WATERMARK
+	}
+}
+
+// buffer is the bounded FIFO queue of the messages.
+// Add blocks or drops the messages by the policy while the buffer is full,
+// messages are removed from the head only after they were pushed.
+// If the spool is set, messages go into it instead of blocking
+// and until it is drained, so they are kept in order.
+type buffer struct {
+	items []bufferItem
+	bytes int
+	// seq is the next message sequence number
+	seq int64
+
+	maxCount  int
+	maxBytes  int
+	highCount int
+	highBytes int
+	policy    string
+	spool     *spool
+	// dropped is the number of the messages dropped by the policy
+	dropped uint64
+
+	mux  sync.Mutex
+	cond *sync.Cond
+}
+
+type bufferItem struct {
+	seq  int64
+	size int
+	msg  LogMessage
+}
+
+func newBuffer(conf *SenderConfig, spool *spool) *buffer {
+	b := &buffer{
+		maxCount:  conf.BufferSize,
+		maxBytes:  conf.BufferBytes,
+		highCount: int(float64(conf.BufferSize) * conf.Backpressure.HighWatermark),
+		highBytes: int(float64(conf.BufferBytes) * conf.Backpressure.HighWatermark),
+		policy:    conf.Backpressure.Policy,
+		spool:     spool,
+	}
+	if b.highCount < 1 {
+		b.highCount = 1
+	}
+	b.cond = sync.NewCond(&b.mux)
+	return b
+}
+
+// Add appends the message to the tail. If the buffer is full, it waits for the free space,
+// drops the oldest messages or the new one by the policy.
+// The single message larger than maxBytes is accepted into the empty buffer.
+func (b *buffer) Add(l LogMessage) {
+	size := messageSize(l)
+
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	if b.spool != nil && (!b.spool.Empty() || b.isFull(size)) {
+		err := b.spool.Write(l)
+		if err == nil {
+			return
+		}
+		log.Error("Can't write into the spool: ", err)
+	}
+
+	for b.isFull(size) {
+		switch b.policy {
+		case DROP_NEWEST_POLICY:
+			atomic.AddUint64(&b.dropped, 1)
+			return
+		case DROP_OLDEST_POLICY:
+			b.dropHead()
+		default:
+			b.cond.Wait()
+		}
+	}
+
+	b.items = append(b.items, bufferItem{seq: b.seq, size: size, msg: l})
+	b.bytes += size
+	b.seq++
+}
+
+// dropHead drops the oldest message. It is ignored by the Remove
+// if it is being pushed.
+func (b *buffer) dropHead() {
+	b.bytes -= b.items[0].size
+	b.items = b.items[1:]
+	atomic.AddUint64(&b.dropped, 1)
+}
+
+// Wait blocks while the buffer is above the high watermark with the block policy
+func (b *buffer) Wait() {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	for b.isPressured() {
+		b.cond.Wait()
+	}
+}
+
+// Pressured returns true if the readers must be paused
+func (b *buffer) Pressured() bool {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return b.isPressured()
+}
+
+// isPressured returns true if the buffer is above the high watermark with the block policy.
+// Spool takes the messages instead of pausing.
+func (b *buffer) isPressured() bool {
+	if b.policy != BLOCK_POLICY || b.spool != nil {
+		return false
+	}
+	return len(b.items) >= b.highCount || b.bytes >= b.highBytes
+}
+
+// Dropped returns the number of the messages dropped by the policy
+func (b *buffer) Dropped() uint64 {
+	return atomic.LoadUint64(&b.dropped)
+}
+
+func (b *buffer) isFull(size int) bool {
+	return len(b.items) > 0 && (len(b.items) >= b.maxCount || b.bytes+size > b.maxBytes)
+}
+
+// Spill moves all the messages into the spool head
+func (b *buffer) Spill() error {
+	if b.spool == nil {
+		return nil
+	}
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	if len(b.items) == 0 {
+		return nil
+	}
+	msgs := make([]LogMessage, 0, len(b.items))
+	for _, item := range b.items {
+		msgs = append(msgs, item.msg)
+	}
+	if err := b.spool.Prepend(msgs); err != nil {
+		return err
+	}
+
+	log.Warnf("Spilled %d messages into the spool", len(msgs))
+	b.items = nil
+	b.bytes = 0
+	b.cond.Broadcast()
+	return nil
+}
+
+// Peek returns up to count messages from the head, not more than bytes in total.
+// The messages are keyed by the sequence numbers.
+func (b *buffer) Peek(count, bytes int) map[int64]LogMessage {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	batch := make(map[int64]LogMessage)
+	var size int
+	for _, item := range b.items {
+		if len(batch) >= count || (len(batch) > 0 && size+item.size > bytes) {
+			break
+		}
+		batch[item.seq] = item.msg
+		size += item.size
+	}
+	return batch
+}
+
+// Remove removes the messages by the sequence numbers
+// and wakes up the waiting writers
+func (b *buffer) Remove(keys []int64) {
+	if len(keys) == 0 {
+		return
+	}
+	remove := make(map[int64]bool, len(keys))
+	for _, k := range keys {
+		remove[k] = true
+	}
+
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	// Copy the rest, so the removed messages are not kept by the array
+	items := make([]bufferItem, 0, len(b.items))
+	for _, item := range b.items {
+		if remove[item.seq] {
+			b.bytes -= item.size
+			continue
+		}
+		items = append(items, item)
+	}
+	b.items = items
+	b.cond.Broadcast()
+}
+
+// Len returns the number of the messages and their size
+func (b *buffer) Len() (int, int) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return len(b.items), b.bytes
+}
+
+// messageSize approximates the message size without the marshalling
+func messageSize(l LogMessage) int {
+	size := len(l.Message) + len(l.PodName) + len(l.Namespace) + len(l.Container) + len(l.ContainerID) + len(l.Level)
+	size += mapSize(l.Fields) + mapSize(l.Meta)
+	// Timestamps and keys
+	return size + 128
+}
+
+func mapSize(m map[string]interface{}) int {
+	var size int
+	for k, v := range m {
+		size += len(k)
+		switch t := v.(type) {
+		case string:
+			size += len(t)
+		case map[string]interface{}:
+			size += mapSize(t)
+		case map[string]string:
+			for k, v := range t {
+				size += len(k) + len(v)
+			}
+		default:
+			size += 16
+		}
+	}
+	return size
+}
+
+// sortedKeys returns the batch keys in the order the messages were sent
+func sortedKeys(l map[int64]LogMessage) []int64 {
+	keys := make([]int64, 0, len(l))
+	for k := range l {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
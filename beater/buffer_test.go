@@ -0,0 +1,196 @@
+package beater
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newTestBuffer(count int, policy string, spool *spool) *buffer {
+	conf := &SenderConfig{
+		BufferSize:   count,
+		BufferBytes:  DEFAULT_BUFFER_BYTES,
+		Backpressure: BackpressureConfig{Policy: policy},
+	}
+	conf.Backpressure.setDefaults()
+	return newBuffer(conf, spool)
+}
+
+// bufferMessages returns the messages of the batch in order
+func bufferMessages(batch map[int64]LogMessage) []string {
+	var messages []string
+	for _, k := range sortedKeys(batch) {
+		messages = append(messages, batch[k].Message)
+	}
+	return messages
+}
+
+func TestBufferPeekRemove(t *testing.T) {
+	b := newTestBuffer(10, BLOCK_POLICY, nil)
+	for _, m := range []string{"a", "b", "c"} {
+		b.Add(LogMessage{Message: m})
+	}
+
+	batch := b.Peek(2, DEFAULT_BATCH_BYTES)
+	if got := bufferMessages(batch); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Errorf("Peek() = %v", got)
+	}
+	// The first message is returned over the bytes limit
+	if got := bufferMessages(b.Peek(10, 1)); !reflect.DeepEqual(got, []string{"a"}) {
+		t.Errorf("Peek() = %v", got)
+	}
+
+	b.Remove(sortedKeys(batch)[:1])
+	if got := bufferMessages(b.Peek(10, DEFAULT_BATCH_BYTES)); !reflect.DeepEqual(got, []string{"b", "c"}) {
+		t.Errorf("Peek() after Remove = %v", got)
+	}
+	count, size := b.Len()
+	if count != 2 || size != messageSize(LogMessage{Message: "b"})*2 {
+		t.Errorf("Len() = %d, %d", count, size)
+	}
+}
+
+func TestBufferDropPolicies(t *testing.T) {
+	for policy, want := range map[string][]string{
+		DROP_NEWEST_POLICY: {"a", "b"},
+		DROP_OLDEST_POLICY: {"c", "d"},
+	} {
+		b := newTestBuffer(2, policy, nil)
+		for _, m := range []string{"a", "b", "c", "d"} {
+			b.Add(LogMessage{Message: m})
+		}
+		if got := bufferMessages(b.Peek(10, DEFAULT_BATCH_BYTES)); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: %v, want %v", policy, got, want)
+		}
+		if b.Dropped() != 2 {
+			t.Errorf("%s: dropped %d, want 2", policy, b.Dropped())
+		}
+		if b.Pressured() {
+			t.Errorf("%s must not pause the readers", policy)
+		}
+	}
+}
+
+func TestBufferBlock(t *testing.T) {
+	// The high watermark is 4 messages
+	b := newTestBuffer(5, BLOCK_POLICY, nil)
+	for _, m := range []string{"a", "b", "c"} {
+		b.Add(LogMessage{Message: m})
+	}
+	if b.Pressured() {
+		t.Error("Buffer is pressured below the high watermark")
+	}
+	b.Add(LogMessage{Message: "d"})
+	if !b.Pressured() {
+		t.Error("Buffer is not pressured at the high watermark")
+	}
+	b.Add(LogMessage{Message: "e"})
+
+	added := make(chan bool)
+	go func() {
+		b.Add(LogMessage{Message: "f"})
+		close(added)
+	}()
+	select {
+	case <-added:
+		t.Fatal("Add must block while the buffer is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	b.Remove(sortedKeys(b.Peek(1, DEFAULT_BATCH_BYTES)))
+	select {
+	case <-added:
+	case <-time.After(time.Second):
+		t.Fatal("Add is not woken up by the Remove")
+	}
+	if got := bufferMessages(b.Peek(10, DEFAULT_BATCH_BYTES)); !reflect.DeepEqual(got, []string{"b", "c", "d", "e", "f"}) {
+		t.Errorf("Peek() = %v", got)
+	}
+}
+
+func TestBufferWait(t *testing.T) {
+	// The high watermark is 4 messages
+	b := newTestBuffer(5, BLOCK_POLICY, nil)
+	for _, m := range []string{"a", "b", "c", "d"} {
+		b.Add(LogMessage{Message: m})
+	}
+
+	waited := make(chan bool)
+	go func() {
+		b.Wait()
+		close(waited)
+	}()
+	select {
+	case <-waited:
+		t.Fatal("Wait must block the reader at the high watermark")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	b.Remove(sortedKeys(b.Peek(1, DEFAULT_BATCH_BYTES)))
+	select {
+	case <-waited:
+	case <-time.After(time.Second):
+		t.Fatal("Wait is not woken up below the high watermark")
+	}
+	if b.Pressured() {
+		t.Error("Buffer is pressured below the high watermark")
+	}
+}
+
+func TestBufferBytesWatermark(t *testing.T) {
+	l := LogMessage{Message: "a"}
+	conf := &SenderConfig{
+		BufferSize:   100,
+		BufferBytes:  messageSize(l) * 10,
+		Backpressure: BackpressureConfig{Policy: BLOCK_POLICY, HighWatermark: 0.5},
+	}
+	b := newBuffer(conf, nil)
+	for i := 0; i < 4; i++ {
+		b.Add(l)
+	}
+	if b.Pressured() {
+		t.Error("Buffer is pressured below the bytes high watermark")
+	}
+	b.Add(l)
+	if !b.Pressured() {
+		t.Error("Buffer is not pressured at the bytes high watermark")
+	}
+}
+
+func TestBufferSpill(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kubeat-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := newSpool(SpoolConfig{Path: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// Messages go into the spool when the buffer is full and until it is drained
+	b := newTestBuffer(2, BLOCK_POLICY, s)
+	for _, m := range []string{"a", "b", "c", "d"} {
+		b.Add(LogMessage{Message: m})
+	}
+	if count, _ := b.Len(); count != 2 || s.Empty() {
+		t.Fatalf("buffer has %d messages, the spool is empty %v", count, s.Empty())
+	}
+	if b.Pressured() {
+		t.Error("Spool must take the messages instead of pausing")
+	}
+
+	// Spilled messages are read before the spooled ones
+	if err := b.Spill(); err != nil {
+		t.Fatal(err)
+	}
+	if count, _ := b.Len(); count != 0 {
+		t.Errorf("buffer has %d messages after the Spill", count)
+	}
+	if got := readSpool(t, s); !reflect.DeepEqual(got, []string{"a", "b", "c", "d"}) {
+		t.Errorf("spool read %v", got)
+	}
+}
@@ -0,0 +1,330 @@
+package beater
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	FILE_CHECKPOINT_STORE      string = "file"
+	CONFIGMAP_CHECKPOINT_STORE string = "configmap"
+	checkpointsConfigMapKey    string = "checkpoints.json"
+)
+
+// Checkpoint is the last shipped log position of the container in the output.
+// Time is the Kubernetes timestamp of the last shipped line.
+type Checkpoint struct {
+	Namespace   string    `json:"namespace"`
+	Pod         string    `json:"pod"`
+	Container   string    `json:"container"`
+	ContainerID string    `json:"container_id"`
+	Output      string    `json:"output,omitempty"`
+	Time        time.Time `json:"time"`
+}
+
+// Key returns the checkpoints map key
+func (c Checkpoint) Key() string {
+	return checkpointKey(c.Namespace, c.Pod, c.Container, c.ContainerID, c.Output)
+}
+
+func checkpointKey(ns, pod, con, id, output string) string {
+	return strings.Join([]string{ns, pod, con, id, output}, "/")
+}
+
+// CheckpointStore persists the checkpoints between the kubeat restarts
+type CheckpointStore interface {
+	Load() (map[string]Checkpoint, error)
+	Save(map[string]Checkpoint) error
+}
+
+// Checkpoints keeps the last shipped log positions in memory
+// and periodically flushes them into the store
+type Checkpoints struct {
+	store CheckpointStore
+	con   map[string]Checkpoint
+	dirty bool
+	mux   sync.Mutex
+}
+
+// NewCheckpoints loads the checkpoints from the store
+func NewCheckpoints(store CheckpointStore) (*Checkpoints, error) {
+	con, err := store.Load()
+	if err != nil {
+		return nil, err
+	}
+	if con == nil {
+		con = make(map[string]Checkpoint)
+	}
+	log.Infof("Loaded %d checkpoints", len(con))
+
+	return &Checkpoints{
+		store: store,
+		con:   con,
+	}, nil
+}
+
+// Get returns the last shipped log time of the container.
+// It is the earliest time of the outputs the container is routed to
+// which shipped its logs, checkpoints of the other outputs are ignored.
+func (c *Checkpoints) Get(ns, pod, con, id string, outputs []string) (time.Time, bool) {
+	if c == nil {
+		return time.Time{}, false
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	var since time.Time
+	var found bool
+	for _, output := range outputs {
+		cp, ok := c.con[checkpointKey(ns, pod, con, id, output)]
+		if !ok {
+			continue
+		}
+		if !found || cp.Time.Before(since) {
+			since = cp.Time
+		}
+		found = true
+	}
+	return since, found
+}
+
+// Shipped returns true if the message was already shipped to the output
+func (c *Checkpoints) Shipped(output string, l LogMessage) bool {
+	if c == nil || l.logTime.IsZero() {
+		return false
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	cp, ok := c.con[checkpointKey(l.Namespace, l.PodName, l.Container, l.ContainerID, output)]
+	return ok && !l.logTime.After(cp.Time)
+}
+
+// Update moves the output checkpoints forward to the shipped messages
+func (c *Checkpoints) Update(output string, l map[int64]LogMessage) {
+	if c == nil {
+		return
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	for _, m := range l {
+		cp := Checkpoint{
+			Namespace:   m.Namespace,
+			Pod:         m.PodName,
+			Container:   m.Container,
+			ContainerID: m.ContainerID,
+			Output:      output,
+			Time:        m.logTime,
+		}
+		if cp.Time.IsZero() {
+			cp.Time = m.Timestamp
+		}
+		if old, ok := c.con[cp.Key()]; ok && !old.Time.Before(cp.Time) {
+			continue
+		}
+		c.con[cp.Key()] = cp
+		c.dirty = true
+	}
+}
+
+// DelPod removes all the checkpoints of the pod
+func (c *Checkpoints) DelPod(ns, pod string) {
+	if c == nil {
+		return
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	for k, cp := range c.con {
+		if cp.Namespace == ns && cp.Pod == pod {
+			delete(c.con, k)
+			c.dirty = true
+		}
+	}
+}
+
+// Flush saves the checkpoints into the store if they were changed
+func (c *Checkpoints) Flush() error {
+	if c == nil {
+		return nil
+	}
+	c.mux.Lock()
+	if !c.dirty {
+		c.mux.Unlock()
+		return nil
+	}
+	con := make(map[string]Checkpoint, len(c.con))
+	for k, v := range c.con {
+		con[k] = v
+	}
+	c.dirty = false
+	c.mux.Unlock()
+
+	if err := c.store.Save(con); err != nil {
+		c.mux.Lock()
+		c.dirty = true
+		c.mux.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Ticker flushes the checkpoints every tick
+func (c *Checkpoints) Ticker(tick int) {
+	ticker := time.NewTicker(time.Second * time.Duration(tick))
+	for t := range ticker.C {
+		if err := c.Flush(); err != nil {
+			log.Error(err, " On checkpoints flush ", t.Unix())
+		}
+	}
+}
+
+// FileCheckpointStore keeps the checkpoints in the local JSON file
+type FileCheckpointStore struct {
+	Path string
+}
+
+func (f *FileCheckpointStore) Load() (map[string]Checkpoint, error) {
+	data, err := ioutil.ReadFile(f.Path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return unmarshalCheckpoints(data)
+}
+
+func (f *FileCheckpointStore) Save(con map[string]Checkpoint) error {
+	data, err := marshalCheckpoints(con)
+	if err != nil {
+		return err
+	}
+
+	// Write and rename, so the file is never left half-written
+	tmp, err := ioutil.TempFile(filepath.Dir(f.Path), ".checkpoints")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), f.Path)
+}
+
+// ConfigMapCheckpointStore keeps the checkpoints in the ConfigMap
+type ConfigMapCheckpointStore struct {
+	Client    kubernetes.Interface
+	Namespace string
+	Name      string
+}
+
+func (c *ConfigMapCheckpointStore) Load() (map[string]Checkpoint, error) {
+	cm, err := c.Client.CoreV1().ConfigMaps(c.Namespace).Get(c.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	data, ok := cm.Data[checkpointsConfigMapKey]
+	if !ok {
+		return nil, nil
+	}
+	return unmarshalCheckpoints([]byte(data))
+}
+
+func (c *ConfigMapCheckpointStore) Save(con map[string]Checkpoint) error {
+	data, err := marshalCheckpoints(con)
+	if err != nil {
+		return err
+	}
+
+	cm, err := c.Client.CoreV1().ConfigMaps(c.Namespace).Get(c.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		cm = &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      c.Name,
+				Namespace: c.Namespace,
+			},
+			Data: map[string]string{checkpointsConfigMapKey: string(data)},
+		}
+		_, err = c.Client.CoreV1().ConfigMaps(c.Namespace).Create(cm)
+		return err
+	} else if err != nil {
+		return err
+	}
+
+	if cm.Data == nil {
+		cm.Data = make(map[string]string)
+	}
+	cm.Data[checkpointsConfigMapKey] = string(data)
+	_, err = c.Client.CoreV1().ConfigMaps(c.Namespace).Update(cm)
+	return err
+}
+
+func marshalCheckpoints(con map[string]Checkpoint) ([]byte, error) {
+	var list []Checkpoint
+	for _, cp := range con {
+		list = append(list, cp)
+	}
+	return json.Marshal(list)
+}
+
+func unmarshalCheckpoints(data []byte) (map[string]Checkpoint, error) {
+	var list []Checkpoint
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+
+	con := make(map[string]Checkpoint, len(list))
+	for _, cp := range list {
+		con[cp.Key()] = cp
+	}
+	return con, nil
+}
+
+// getCheckpointsFromFlags creates the checkpoints from the checkpoint-* flags.
+// Returns nil if the checkpoints are disabled.
+func getCheckpointsFromFlags(client kubernetes.Interface, namespace string) (*Checkpoints, error) {
+	var store CheckpointStore
+	switch flag.Lookup("checkpoint-store").Value.String() {
+	case "":
+		return nil, nil
+	case FILE_CHECKPOINT_STORE:
+		store = &FileCheckpointStore{Path: flag.Lookup("checkpoint-path").Value.String()}
+	case CONFIGMAP_CHECKPOINT_STORE:
+		if namespace == "" {
+			return nil, errors.New("Wrong checkpoint configmap namespace, set the kube-namespace")
+		}
+		store = &ConfigMapCheckpointStore{
+			Client:    client,
+			Namespace: namespace,
+			Name:      flag.Lookup("checkpoint-configmap").Value.String(),
+		}
+	default:
+		return nil, errors.New("Wrong checkpoint store type")
+	}
+
+	return NewCheckpoints(store)
+}
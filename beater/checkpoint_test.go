@@ -0,0 +1,156 @@
+package beater
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// memoryCheckpointStore keeps the saved checkpoints
+type memoryCheckpointStore struct {
+	con   map[string]Checkpoint
+	saves int
+}
+
+func (m *memoryCheckpointStore) Load() (map[string]Checkpoint, error) { return m.con, nil }
+
+func (m *memoryCheckpointStore) Save(con map[string]Checkpoint) error {
+	m.con = con
+	m.saves++
+	return nil
+}
+
+func checkpointMessage(pod string, t time.Time) LogMessage {
+	return LogMessage{Namespace: "ns", PodName: pod, Container: "con", ContainerID: "id", logTime: t}
+}
+
+func TestCheckpointsUpdate(t *testing.T) {
+	store := &memoryCheckpointStore{}
+	c, err := NewCheckpoints(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t1, t2, t3 := time.Unix(1, 0), time.Unix(2, 0), time.Unix(3, 0)
+
+	if _, ok := c.Get("ns", "pod", "con", "id", []string{"es", "kafka"}); ok {
+		t.Error("Get() found the checkpoint before the update")
+	}
+	c.Update("es", map[int64]LogMessage{1: checkpointMessage("pod", t1), 2: checkpointMessage("pod", t3)})
+	// Checkpoints are never moved back
+	c.Update("es", map[int64]LogMessage{1: checkpointMessage("pod", t2)})
+	c.Update("kafka", map[int64]LogMessage{1: checkpointMessage("pod", t2)})
+
+	// The earliest time of the outputs
+	if since, ok := c.Get("ns", "pod", "con", "id", []string{"es", "kafka"}); !ok || !since.Equal(t2) {
+		t.Errorf("Get() = %v, %v, want %v", since, ok, t2)
+	}
+	if !c.Shipped("es", checkpointMessage("pod", t3)) || c.Shipped("kafka", checkpointMessage("pod", t3)) {
+		t.Error("Shipped() must compare with the checkpoint of the output")
+	}
+	if c.Shipped("es", checkpointMessage("pod", time.Time{})) {
+		t.Error("Message without the log time is never shipped")
+	}
+
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if store.saves != 1 || len(store.con) != 2 {
+		t.Errorf("saved %d times, %d checkpoints", store.saves, len(store.con))
+	}
+
+	c.DelPod("ns", "pod")
+	if _, ok := c.Get("ns", "pod", "con", "id", []string{"es", "kafka"}); ok {
+		t.Error("Get() found the checkpoint of the deleted pod")
+	}
+	c.Flush()
+	if store.saves != 2 || len(store.con) != 0 {
+		t.Errorf("saved %d times, %d checkpoints after the DelPod", store.saves, len(store.con))
+	}
+}
+
+func TestCheckpointsRoutedOutputs(t *testing.T) {
+	c, _ := NewCheckpoints(&memoryCheckpointStore{})
+	c.Update("archive", map[int64]LogMessage{1: checkpointMessage("pod", time.Unix(1, 0))})
+	c.Update("es", map[int64]LogMessage{1: checkpointMessage("pod", time.Unix(3, 0))})
+
+	// The checkpoint of the output the container is not routed to is ignored
+	if since, ok := c.Get("ns", "pod", "con", "id", []string{"es", "kafka"}); !ok || !since.Equal(time.Unix(3, 0)) {
+		t.Errorf("Get() = %v, %v", since, ok)
+	}
+	if _, ok := c.Get("ns", "pod", "con", "id", []string{"kafka"}); ok {
+		t.Error("Get() found the checkpoint of the other output")
+	}
+}
+
+func TestCheckpointsTimestamp(t *testing.T) {
+	c, _ := NewCheckpoints(&memoryCheckpointStore{})
+	// The message timestamp is used without the Kubernetes time
+	l := checkpointMessage("pod", time.Time{})
+	l.Timestamp = time.Unix(5, 0)
+	c.Update("es", map[int64]LogMessage{1: l})
+	if since, _ := c.Get("ns", "pod", "con", "id", []string{"es", "kafka"}); !since.Equal(l.Timestamp) {
+		t.Errorf("Get() = %v, want %v", since, l.Timestamp)
+	}
+}
+
+func TestFileCheckpointStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kubeat-checkpoints")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := &FileCheckpointStore{Path: filepath.Join(dir, "checkpoints.json")}
+	if con, err := store.Load(); err != nil || con != nil {
+		t.Errorf("Load() of the missing file = %v, %v", con, err)
+	}
+
+	cp := Checkpoint{Namespace: "ns", Pod: "pod", Container: "con", ContainerID: "id", Output: "es", Time: time.Unix(1, 0).UTC()}
+	want := map[string]Checkpoint{cp.Key(): cp}
+	if err := store.Save(want); err != nil {
+		t.Fatal(err)
+	}
+	got, err := store.Load()
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("Load() = %v, %v, want %v", got, err, want)
+	}
+
+	// Temporary files are renamed
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 {
+		t.Errorf("%d files in the checkpoints directory", len(files))
+	}
+
+	ioutil.WriteFile(store.Path, []byte("{"), 0644)
+	if _, err := store.Load(); err == nil {
+		t.Error("Load() of the broken file must fail")
+	}
+}
+
+func TestConfigMapCheckpointStore(t *testing.T) {
+	store := &ConfigMapCheckpointStore{Client: fake.NewSimpleClientset(), Namespace: "kube-system", Name: "kubeat"}
+	if con, err := store.Load(); err != nil || con != nil {
+		t.Errorf("Load() of the missing ConfigMap = %v, %v", con, err)
+	}
+
+	cp := Checkpoint{Namespace: "ns", Pod: "pod", Container: "con", ContainerID: "id", Time: time.Unix(1, 0).UTC()}
+	// Save creates the ConfigMap, then updates it
+	for _, output := range []string{"es", "kafka"} {
+		cp.Output = output
+		if err := store.Save(map[string]Checkpoint{cp.Key(): cp}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := store.Load()
+	if want := map[string]Checkpoint{cp.Key(): cp}; err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("Load() = %v, %v, want %v", got, err, want)
+	}
+}
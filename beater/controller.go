@@ -0,0 +1,322 @@
+package beater
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/informers"
+	listerscorev1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// podController drives the logwatchers lifecycle from the pods shared informers.
+// Informers keep the resourceVersion and reconnect the watch by itself,
+// so the controller only reacts to the pods state changes.
+type podController struct {
+	p *PodLogs
+	// ignored are the compiled regexps of the ignored pods
+	ignored ignored
+
+	resync     time.Duration
+	namespaces map[string]*namespaceInformer
+	// streamed holds containers IDs which logs were already collected
+	streamed map[types.UID]map[string]bool
+	// restarts holds the last seen containers restart counts
+	restarts map[types.UID]map[string]int32
+	mux      sync.Mutex
+}
+
+// namespaceInformer is a pods informer bound to the namespace
+type namespaceInformer struct {
+	lister listerscorev1.PodLister
+	synced cache.InformerSynced
+	stopCh chan struct{}
+}
+
+func newPodController(p *PodLogs) *podController {
+	return &podController{
+		p:          p,
+		ignored:    ignoredPods(p.Ignored),
+		resync:     time.Second * time.Duration(p.tick),
+		namespaces: make(map[string]*namespaceInformer),
+		streamed:   make(map[types.UID]map[string]bool),
+		restarts:   make(map[types.UID]map[string]int32),
+	}
+}
+
+// Start starts the informers, they are stopped when the stopCh is closed
+func (c *podController) Start(stopCh chan struct{}) {
+	switch {
+	case c.p.AllNamespaces:
+		c.startNamespace(metav1.NamespaceAll)
+	case c.p.NamespaceSelector != "":
+		c.watchNamespaces(stopCh)
+	default:
+		for _, ns := range c.p.namespaces() {
+			c.startNamespace(ns)
+		}
+	}
+
+	go func() {
+		<-stopCh
+		c.mux.Lock()
+		for ns := range c.namespaces {
+			c.stopNamespaceLocked(ns)
+		}
+		c.mux.Unlock()
+	}()
+}
+
+// watchNamespaces starts and stops pods informers following
+// the namespaces matched by the NamespaceSelector
+func (c *podController) watchNamespaces(stopCh chan struct{}) {
+	selector := c.p.NamespaceSelector
+	factory := informers.NewSharedInformerFactoryWithOptions(c.p.Client, c.resync,
+		informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+			opts.LabelSelector = selector
+		}))
+
+	informer := factory.Core().V1().Namespaces().Informer()
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if ns, ok := obj.(*corev1.Namespace); ok {
+				c.startNamespace(ns.Name)
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if ns, ok := obj.(*corev1.Namespace); ok {
+				c.stopNamespace(ns.Name)
+			}
+		},
+	})
+
+	factory.Start(stopCh)
+}
+
+// startNamespace starts the pods informer for the namespace
+func (c *podController) startNamespace(ns string) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if _, ok := c.namespaces[ns]; ok {
+		return
+	}
+
+	factory := informers.NewSharedInformerFactoryWithOptions(c.p.Client, c.resync, informers.WithNamespace(ns))
+	pods := factory.Core().V1().Pods()
+	pods.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if pod, ok := obj.(*corev1.Pod); ok {
+				c.p.enricher.Update(*pod)
+				c.syncPod(pod)
+			}
+		},
+		UpdateFunc: func(_, obj interface{}) {
+			if pod, ok := obj.(*corev1.Pod); ok {
+				c.p.enricher.Update(*pod)
+				c.syncPod(pod)
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if pod, ok := obj.(*corev1.Pod); ok {
+				c.deletePod(pod)
+			}
+		},
+	})
+
+	informer := &namespaceInformer{
+		lister: pods.Lister(),
+		synced: pods.Informer().HasSynced,
+		stopCh: make(chan struct{}),
+	}
+	c.namespaces[ns] = informer
+
+	log.Infof("Starting pods informer for the namespace `%s'", ns)
+	factory.Start(informer.stopCh)
+}
+
+// stopNamespace stops the pods informer and all the namespace logwatchers
+func (c *podController) stopNamespace(ns string) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.stopNamespaceLocked(ns)
+}
+
+func (c *podController) stopNamespaceLocked(ns string) {
+	informer, ok := c.namespaces[ns]
+	if !ok {
+		return
+	}
+
+	log.Infof("Stopping pods informer for the namespace `%s'", ns)
+	close(informer.stopCh)
+	delete(c.namespaces, ns)
+
+	pods, err := informer.lister.List(labels.Everything())
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	for _, pod := range pods {
+		c.stopPod(pod)
+	}
+}
+
+// WaitForCacheSync waits for all the started pods informers
+func (c *podController) WaitForCacheSync(stopCh chan struct{}) {
+	c.mux.Lock()
+	var synced []cache.InformerSynced
+	for _, informer := range c.namespaces {
+		synced = append(synced, informer.synced)
+	}
+	c.mux.Unlock()
+
+	cache.WaitForCacheSync(stopCh, synced...)
+}
+
+// List returns pods from all the started informers
+func (c *podController) List() []corev1.Pod {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	var items []corev1.Pod
+	for ns, informer := range c.namespaces {
+		pods, err := informer.lister.List(labels.Everything())
+		if err != nil {
+			log.Errorf("Can't list pods in the namespace %s: %s", ns, err.Error())
+			continue
+		}
+		for _, pod := range pods {
+			items = append(items, *pod)
+		}
+	}
+	return items
+}
+
+// syncPod starts the logwatchers for the running pod containers
+// and collects logs of the containers terminated before they were watched
+func (c *podController) syncPod(pod *corev1.Pod) {
+	if c.ignored.isIgnored(*pod) {
+		c.stopPod(pod)
+		return
+	}
+
+	for _, con := range podContainers(*pod) {
+		if !c.p.Containers.isAllowed(con.Name) {
+			c.p.Shutdown(pod.Namespace, pod.Name, con.Name)
+			continue
+		}
+
+		if c.isRestarted(pod, con) {
+			go c.p.getPreviousLogs(*pod, con)
+		}
+		if c.p.getLogsMethod == FOLLOW_LOGS_METHOD {
+			c.syncContainer(pod, con)
+		}
+	}
+}
+
+// isRestarted remembers the container restart count and returns true
+// if the previous instance logs were not collected yet
+func (c *podController) isRestarted(pod *corev1.Pod, con podContainer) bool {
+	if con.Status == nil {
+		return false
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if _, ok := c.restarts[pod.UID]; !ok {
+		c.restarts[pod.UID] = make(map[string]int32)
+	}
+	count, known := c.restarts[pod.UID][con.Name]
+	c.restarts[pod.UID][con.Name] = con.Status.RestartCount
+
+	terminated := con.Status.LastTerminationState.Terminated
+	switch {
+	case terminated == nil || con.Status.RestartCount == 0:
+		return false
+	case known && con.Status.RestartCount <= count:
+		return false
+	case !known && terminated.FinishedAt.Time.Before(c.p.initTime):
+		// Crashed before the kubeat start, collect the rest of logs
+		// only if they were partially shipped before
+		_, ok := c.p.checkpoint(*pod, con.Name, terminated.ContainerID)
+		return ok
+	}
+
+	// The crashed instance was followed till the end
+	return !c.streamed[pod.UID][terminated.ContainerID]
+}
+
+// syncContainer starts the logwatcher for the running container
+func (c *podController) syncContainer(pod *corev1.Pod, con podContainer) {
+	watched, _, err := c.p.IsWatcherInTheDB(pod.Namespace, pod.Name+"-"+con.Name)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	if watched {
+		return
+	}
+
+	switch {
+	case con.isRunning():
+		ch, err := c.p.AddWatcherToDb(pod.Namespace, pod.Name+"-"+con.Name)
+		if err != nil {
+			log.Error(err)
+			return
+		}
+		c.markStreamed(pod, con.Status.ContainerID)
+		go c.p.Run(*pod, ch, con.Name)
+	case con.isTerminated() && !c.isStreamed(pod, con.Status.ContainerID):
+		// Container completed between two events, collect its logs once
+		c.markStreamed(pod, con.Status.ContainerID)
+		go c.p.getContainerLogs(*pod, con)
+	}
+}
+
+// deletePod stops the pod logwatchers and forgets the pod
+func (c *podController) deletePod(pod *corev1.Pod) {
+	c.stopPod(pod)
+	c.p.checkpoints.DelPod(pod.Namespace, pod.Name)
+	c.p.enricher.Forget(*pod)
+
+	c.mux.Lock()
+	delete(c.streamed, pod.UID)
+	delete(c.restarts, pod.UID)
+	c.mux.Unlock()
+}
+
+// stopPod stops the pod containers logwatchers
+func (c *podController) stopPod(pod *corev1.Pod) {
+	for _, con := range podContainers(*pod) {
+		c.p.Shutdown(pod.Namespace, pod.Name, con.Name)
+	}
+}
+
+func (c *podController) markStreamed(pod *corev1.Pod, id string) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if _, ok := c.streamed[pod.UID]; !ok {
+		c.streamed[pod.UID] = make(map[string]bool)
+	}
+	c.streamed[pod.UID][id] = true
+}
+
+func (c *podController) isStreamed(pod *corev1.Pod, id string) bool {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.streamed[pod.UID][id]
+}
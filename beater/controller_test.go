@@ -0,0 +1,67 @@
+package beater
+
+import (
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// restartedContainer returns the container restarted the number of times,
+// the previous instance is finished at the time
+func restartedContainer(restarts int32, id string, finished time.Time) podContainer {
+	status := &corev1.ContainerStatus{Name: "app", RestartCount: restarts}
+	if id != "" {
+		status.LastTerminationState.Terminated = &corev1.ContainerStateTerminated{
+			ContainerID: id,
+			FinishedAt:  metav1.NewTime(finished),
+		}
+	}
+	return podContainer{Name: "app", Kind: CONTAINER, Status: status}
+}
+
+func TestIsRestarted(t *testing.T) {
+	initTime := time.Now()
+	before, after := initTime.Add(-time.Minute), initTime.Add(time.Minute)
+
+	checkpoints, err := NewCheckpoints(&memoryCheckpointStore{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The instance crashed before the start was partially shipped
+	checkpoints.Update("es", map[int64]LogMessage{1: {
+		Namespace: "ns", PodName: "shipped", Container: "app", ContainerID: "docker://old", logTime: before,
+	}})
+	route, _ := newRoute(nil)
+	c := newPodController(&PodLogs{
+		initTime:    initTime,
+		checkpoints: checkpoints,
+		router:      &Router{outputs: []*output{{sender: &Sender{name: "es"}, route: route}}},
+	})
+	c.markStreamed(&corev1.Pod{ObjectMeta: metav1.ObjectMeta{UID: "followed"}}, "docker://old")
+
+	// Steps of the same pod share the remembered restart counts
+	for _, step := range []struct {
+		name string
+		pod  string
+		con  podContainer
+		want bool
+	}{
+		{"no status", "new", podContainer{Name: "app"}, false},
+		{"not restarted", "new", restartedContainer(0, "", time.Time{}), false},
+		{"restarted after the start", "new", restartedContainer(1, "docker://old", after), true},
+		{"same restart count", "new", restartedContainer(1, "docker://old", after), false},
+		{"restarted again", "new", restartedContainer(2, "docker://older", after), true},
+		{"crashed before the start", "unknown", restartedContainer(3, "docker://old", before), false},
+		{"crashed before the start with the checkpoint", "shipped", restartedContainer(1, "docker://old", before), true},
+		{"crashed after the start", "crashed", restartedContainer(1, "docker://old", after), true},
+		{"followed till the end", "followed", restartedContainer(1, "docker://old", after), false},
+	} {
+		pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: step.pod, UID: types.UID(step.pod)}}
+		if got := c.isRestarted(pod, step.con); got != step.want {
+			t.Errorf("%s: isRestarted() = %v, want %v", step.name, got, step.want)
+		}
+	}
+}
@@ -8,8 +8,9 @@ import (
 )
 
 type LogWatcher struct {
-	Name string
-	Chan chan bool
+	Name      string
+	Namespace string
+	Chan      chan bool
 
 	updateTime time.Time
 }
@@ -26,6 +27,11 @@ func NewDB() (*memdb.MemDB, error) {
 						Unique:  true,
 						Indexer: &memdb.StringFieldIndex{Field: "Name"},
 					},
+					"namespace": &memdb.IndexSchema{
+						Name:    "namespace",
+						Unique:  false,
+						Indexer: &memdb.StringFieldIndex{Field: "Namespace"},
+					},
 				},
 			},
 			"logmessage": &memdb.TableSchema{
@@ -44,20 +50,26 @@ func NewDB() (*memdb.MemDB, error) {
 	return memdb.NewMemDB(schema)
 }
 
-// AddWatcherToDb adds a watcher record into DB
-func (p *PodLogs) AddWatcherToDb(pod string) (chan bool, error) {
-	txn := p.db.Txn(true)
+// watcherID returns the logwatchers table key of the pod watcher
+func watcherID(ns, pod string) string {
+	return ns + "/" + pod
+}
 
+// AddWatcherToDb adds a watcher record into DB
+func (p *PodLogs) AddWatcherToDb(ns, pod string) (chan bool, error) {
 	ch := make(chan bool, 1)
 	watcher := &LogWatcher{
-		Name:       pod,
+		Name:       watcherID(ns, pod),
+		Namespace:  ns,
 		Chan:       ch,
 		updateTime: time.Now(),
 	}
 
-	if err := p.DelWatcherFromDB(pod); err != nil {
+	if err := p.DelWatcherFromDB(ns, pod); err != nil {
 		return nil, err
 	}
+
+	txn := p.db.Txn(true)
 	err := txn.Insert("logwatchers", watcher)
 	txn.Commit()
 
@@ -65,11 +77,11 @@ func (p *PodLogs) AddWatcherToDb(pod string) (chan bool, error) {
 }
 
 // GetWatcherFromDB returns a watcher from the DB
-func (p *PodLogs) GetWatcherFromDB(pod string) (*LogWatcher, error) {
+func (p *PodLogs) GetWatcherFromDB(ns, pod string) (*LogWatcher, error) {
 	txn := p.db.Txn(false)
 	defer txn.Abort()
 
-	raw, err := txn.First("logwatchers", "id", pod)
+	raw, err := txn.First("logwatchers", "id", watcherID(ns, pod))
 	if err != nil {
 		return nil, err
 	}
@@ -82,9 +94,9 @@ func (p *PodLogs) GetWatcherFromDB(pod string) (*LogWatcher, error) {
 }
 
 // DelWatcherFromDB removes a watcher record from the DB
-func (p *PodLogs) DelWatcherFromDB(pod string) error {
-	log.Debugf("Trying delete pod %s from DB", pod)
-	watcher, err := p.GetWatcherFromDB(pod)
+func (p *PodLogs) DelWatcherFromDB(ns, pod string) error {
+	log.Debugf("Trying delete pod %s/%s from DB", ns, pod)
+	watcher, err := p.GetWatcherFromDB(ns, pod)
 	if err != nil {
 		return err
 	}
@@ -95,6 +107,7 @@ func (p *PodLogs) DelWatcherFromDB(pod string) error {
 
 	txn := p.db.Txn(true)
 	if err := txn.Delete("logwatchers", watcher); err != nil {
+		txn.Abort()
 		return err
 	}
 	txn.Commit()
@@ -103,8 +116,8 @@ func (p *PodLogs) DelWatcherFromDB(pod string) error {
 }
 
 // IsWatcherInTheDB checks the watcher already in the DB
-func (p *PodLogs) IsWatcherInTheDB(pod string) (bool, *LogWatcher, error) {
-	watcher, err := p.GetWatcherFromDB(pod)
+func (p *PodLogs) IsWatcherInTheDB(ns, pod string) (bool, *LogWatcher, error) {
+	watcher, err := p.GetWatcherFromDB(ns, pod)
 	if err != nil {
 		return false, nil, err
 	}
@@ -134,3 +147,22 @@ func (p *PodLogs) GetWatchersFromDBLen() int {
 
 	return c
 }
+
+// GetNamespaceWatchersFromDBLen returns the logwatchers count per namespace
+func (p *PodLogs) GetNamespaceWatchersFromDBLen() map[string]int {
+	txn := p.db.Txn(false)
+	defer txn.Abort()
+
+	counters := make(map[string]int)
+	i, err := txn.Get("logwatchers", "namespace")
+	if err != nil {
+		log.Error(err)
+		return counters
+	}
+
+	for item := i.Next(); item != nil; item = i.Next() {
+		counters[item.(*LogWatcher).Namespace]++
+	}
+
+	return counters
+}
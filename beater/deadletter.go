@@ -0,0 +1,62 @@
+package beater
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// deadLetterRecord is the line of the dead letter file
+type deadLetterRecord struct {
+	Output  string     `json:"output,omitempty"`
+	Error   string     `json:"error"`
+	Time    time.Time  `json:"time"`
+	Message LogMessage `json:"message"`
+}
+
+// deadLetter is the JSON lines file of the messages dropped by the output
+type deadLetter struct {
+	path string
+}
+
+func newDeadLetter(path string) (*deadLetter, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	return &deadLetter{path: path}, nil
+}
+
+// Write appends the messages in order with the reason of the drop
+func (d *deadLetter) Write(output string, reason error, l map[int64]LogMessage) error {
+	var buf bytes.Buffer
+	now := time.Now()
+	for _, k := range sortedKeys(l) {
+		data, err := json.Marshal(deadLetterRecord{
+			Output:  output,
+			Error:   reason.Error(),
+			Time:    now,
+			Message: l[k],
+		})
+		if err != nil {
+			return err
+		}
+		buf.Write(data)
+		buf.WriteByte('\n')
+	}
+
+	file, err := os.OpenFile(d.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(buf.Bytes()); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,174 @@
+package beater
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	decode_annotation_key = "kubeat-decode"
+	NONE_DECODER          = "none"
+	JSON_DECODER          = "json"
+	LOGFMT_DECODER        = "logfmt"
+	AUTO_DECODER          = "auto"
+)
+
+var (
+	levelKeys   = []string{"level", "lvl", "severity"}
+	messageKeys = []string{"msg", "message"}
+	timeKeys    = []string{"ts", "time", "timestamp"}
+)
+
+// decodeMessage parses the message with the decoder into the fields
+// and lifts the well-known keys into the message. The time key is normalized
+// to RFC 3339 in the fields, the Timestamp is kept from the Kubernetes.
+// The message is left as is if it can't be parsed.
+func decodeMessage(l *LogMessage, decoder string) {
+	var fields map[string]interface{}
+	var err error
+
+	line := strings.TrimSpace(l.Message)
+	switch decoder {
+	case JSON_DECODER:
+		fields, err = decodeJSON(line)
+	case LOGFMT_DECODER:
+		fields, err = decodeLogfmt(line)
+	case AUTO_DECODER:
+		if strings.HasPrefix(line, "{") {
+			fields, err = decodeJSON(line)
+		} else {
+			fields, err = decodeLogfmt(line)
+		}
+	default:
+		return
+	}
+	if err != nil || len(fields) == 0 {
+		return
+	}
+
+	if v, ok := popString(fields, levelKeys); ok {
+		l.Level = strings.ToLower(v)
+	}
+	if v, ok := popString(fields, messageKeys); ok {
+		l.Message = v
+	}
+	for _, key := range timeKeys {
+		if ts, ok := parseFieldTime(fields[key]); ok {
+			fields[key] = ts.UTC().Format(time.RFC3339Nano)
+			break
+		}
+	}
+
+	if len(fields) > 0 {
+		l.Fields = fields
+	}
+}
+
+// popString removes the first found string key from the fields
+func popString(fields map[string]interface{}, keys []string) (string, bool) {
+	for _, key := range keys {
+		if v, ok := fields[key].(string); ok {
+			delete(fields, key)
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// parseFieldTime parses RFC3339 strings and unix timestamps
+// in seconds or milliseconds
+func parseFieldTime(v interface{}) (time.Time, bool) {
+	switch t := v.(type) {
+	case string:
+		ts, err := time.Parse(time.RFC3339Nano, t)
+		return ts, err == nil
+	case float64:
+		if t > 1e12 {
+			return time.Unix(0, int64(t*float64(time.Millisecond))), true
+		}
+		return time.Unix(0, int64(t*float64(time.Second))), true
+	}
+	return time.Time{}, false
+}
+
+func decodeJSON(line string) (map[string]interface{}, error) {
+	if !strings.HasPrefix(line, "{") {
+		return nil, errors.New("Not a JSON object")
+	}
+
+	fields := make(map[string]interface{})
+	err := json.Unmarshal([]byte(line), &fields)
+	return fields, err
+}
+
+// decodeLogfmt parses the key=value pairs separated by spaces.
+// Values may be quoted. Lines with the words without `=' are not logfmt.
+func decodeLogfmt(line string) (map[string]interface{}, error) {
+	fields := make(map[string]interface{})
+	for len(line) > 0 {
+		line = strings.TrimLeft(line, " \t")
+		if line == "" {
+			break
+		}
+
+		eq := strings.IndexByte(line, '=')
+		sp := strings.IndexAny(line, " \t")
+		if eq <= 0 || (sp >= 0 && sp < eq) {
+			return nil, errors.New("Not a logfmt line")
+		}
+		key := line[:eq]
+		line = line[eq+1:]
+
+		var value string
+		if strings.HasPrefix(line, `"`) {
+			end := 1
+			for ; end < len(line); end++ {
+				if line[end] == '\\' {
+					end++
+					continue
+				}
+				if line[end] == '"' {
+					break
+				}
+			}
+			if end >= len(line) {
+				return nil, errors.New("Unterminated logfmt value")
+			}
+			v, err := strconv.Unquote(line[:end+1])
+			if err != nil {
+				return nil, err
+			}
+			value = v
+			line = line[end+1:]
+		} else {
+			end := strings.IndexAny(line, " \t")
+			if end < 0 {
+				end = len(line)
+			}
+			value = line[:end]
+			line = line[end:]
+		}
+		fields[key] = value
+	}
+
+	return fields, nil
+}
+
+// getDecoder returns the decoder of the pod container.
+// Annotations `kubeat-decode.<container>' and `kubeat-decode'
+// take precedence over the decode flag.
+func getDecoder(pod corev1.Pod, con string) string {
+	if d, ok := pod.Annotations[decode_annotation_key+"."+con]; ok {
+		return d
+	}
+	if d, ok := pod.Annotations[decode_annotation_key]; ok {
+		return d
+	}
+	return flag.Lookup("decode").Value.String()
+}
@@ -0,0 +1,71 @@
+package beater
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestDecodeMessage(t *testing.T) {
+	k8sTime := time.Date(2021, 3, 14, 9, 15, 3, 0, time.UTC)
+	ts := "2021-03-14T09:15:02Z"
+	for _, c := range []struct {
+		decoder string
+		line    string
+		want    LogMessage
+	}{
+		{JSON_DECODER, `{"level":"WARN","msg":"retrying","attempt":2,"ts":"2021-03-14T09:15:02Z"}`,
+			LogMessage{Level: "warn", Message: "retrying", Fields: map[string]interface{}{"attempt": float64(2), "ts": ts}}},
+		{JSON_DECODER, `{"message":"ms","time":1615713302000}`,
+			LogMessage{Message: "ms", Fields: map[string]interface{}{"time": ts}}},
+		{JSON_DECODER, `{"message":"s","timestamp":1615713302}`,
+			LogMessage{Message: "s", Fields: map[string]interface{}{"timestamp": ts}}},
+		{LOGFMT_DECODER, `lvl=info msg="request done" path=/healthz quote="a \"b\""`,
+			LogMessage{Level: "info", Message: "request done", Fields: map[string]interface{}{"path": "/healthz", "quote": `a "b"`}}},
+		{AUTO_DECODER, `  {"severity":"error","msg":"failed"}`,
+			LogMessage{Level: "error", Message: "failed"}},
+		{AUTO_DECODER, `level=debug msg=ok`,
+			LogMessage{Level: "debug", Message: "ok"}},
+		// Messages failed to decode are left as is
+		{JSON_DECODER, `plain text`, LogMessage{Message: `plain text`}},
+		{JSON_DECODER, `{"broken"`, LogMessage{Message: `{"broken"`}},
+		{LOGFMT_DECODER, `GET /path status=200`, LogMessage{Message: `GET /path status=200`}},
+		{LOGFMT_DECODER, `msg="unterminated`, LogMessage{Message: `msg="unterminated`}},
+		{NONE_DECODER, `level=info`, LogMessage{Message: `level=info`}},
+	} {
+		// The Kubernetes timestamp is kept
+		c.want.Timestamp = k8sTime
+		l := LogMessage{Message: c.line, Timestamp: k8sTime}
+		decodeMessage(&l, c.decoder)
+		if !reflect.DeepEqual(l, c.want) {
+			t.Errorf("%s %q: %+v, want %+v", c.decoder, c.line, l, c.want)
+		}
+	}
+}
+
+func TestDecodeLogfmt(t *testing.T) {
+	fields, err := decodeLogfmt("a=1 \tb= c=\"x y\"")
+	want := map[string]interface{}{"a": "1", "b": "", "c": "x y"}
+	if err != nil || !reflect.DeepEqual(fields, want) {
+		t.Errorf("decodeLogfmt() = %v, %v, want %v", fields, err, want)
+	}
+	if _, err := decodeLogfmt("=1"); err == nil {
+		t.Error("Empty key must be rejected")
+	}
+}
+
+func TestGetDecoder(t *testing.T) {
+	pod := corev1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{
+		decode_annotation_key:          JSON_DECODER,
+		decode_annotation_key + ".app": LOGFMT_DECODER,
+	}}}
+	if d := getDecoder(pod, "app"); d != LOGFMT_DECODER {
+		t.Errorf("app decoder %s", d)
+	}
+	if d := getDecoder(pod, "sidecar"); d != JSON_DECODER {
+		t.Errorf("sidecar decoder %s", d)
+	}
+}
@@ -3,6 +3,8 @@ package beater
 import (
 	"context"
 	"errors"
+	"fmt"
+	"strconv"
 	"time"
 
 	"github.com/google/uuid"
@@ -67,21 +69,69 @@ func (e *ElasticClient) Push(l map[int64]LogMessage) error {
 		}
 	}
 
+	keys := sortedKeys(l)
 	bulk := e.Client.Bulk()
-	for _, v := range l {
+	for _, k := range keys {
 		r := elastic.NewBulkIndexRequest().
 			Index(e.indexName()).
 			Type(e.docType).
 			Id(uuid.New().String()).
-			Doc(v)
+			Doc(l[k])
 		bulk = bulk.Add(r)
 	}
 	log.Infof("Sending %d messages to the ElasticSearch", len(l))
 	resp, err := bulk.Do(context.Background())
+	if elastic.IsStatusCode(err, 413) {
+		return &PermanentError{Err: err}
+	}
+	if err != nil {
+		return err
+	}
 	log.Infof("Indexed. Took %d", resp.Took)
 
 	// Refresh index
 	// e.Client.Index().Refresh(e.indexName())
 
-	return err
+	if !resp.Errors {
+		return nil
+	}
+	return bulkError(l, keys, resp)
+}
+
+// bulkError returns the rejected messages. Items are in the order of the requests.
+// Messages rejected with `429' or `5xx' are retried, the rest are dropped.
+func bulkError(l map[int64]LogMessage, keys []int64, resp *elastic.BulkResponse) error {
+	failed := make(map[int64]LogMessage)
+	rejected := make(map[int64]LogMessage)
+	var reason string
+	for i, item := range resp.Items {
+		if i >= len(keys) {
+			break
+		}
+		for _, r := range item {
+			if r.Status >= 200 && r.Status <= 299 {
+				continue
+			}
+
+			reason = strconv.Itoa(r.Status)
+			if r.Error != nil {
+				reason += " " + r.Error.Type + ": " + r.Error.Reason
+			}
+			if r.Status == 429 || r.Status >= 500 {
+				failed[keys[i]] = l[keys[i]]
+			} else {
+				rejected[keys[i]] = l[keys[i]]
+			}
+		}
+	}
+
+	if len(failed) == 0 && len(rejected) == 0 {
+		return nil
+	}
+	return &PushError{
+		Failed:   failed,
+		Rejected: rejected,
+		Err: fmt.Errorf("%d of %d messages rejected by the ElasticSearch: %s",
+			len(failed)+len(rejected), len(l), reason),
+	}
 }
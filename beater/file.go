@@ -0,0 +1,365 @@
+package beater
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	NDJSON_FILE_FORMAT = "ndjson"
+	TEXT_FILE_FORMAT   = "text"
+
+	DEFAULT_FILE_MAX_SIZE  = 100
+	DEFAULT_FILE_MAX_FILES = 7
+
+	// fileIdleTimeout closes the files not written for a while,
+	// e.g. the files of the previous day or of the deleted pod
+	fileIdleTimeout   = time.Minute * 5
+	rotatedTimeLayout = "20060102T150405"
+)
+
+// FileConfig is the stdout and file outputs settings
+type FileConfig struct {
+	// Format is `ndjson' or `text'
+	Format string `json:"format"`
+	// Path is the template of the file path, e.g.
+	// `/var/log/kubeat/{{ .Namespace }}/{{ .PodName }}-{{ date "YYYY-MM-dd" .Timestamp }}.log'
+	Path string `json:"path"`
+	// MaxSize of the file in MiB to rotate it, 100 by default
+	MaxSize int `json:"max_size"`
+	// RotateInterval in seconds, the file is rotated by the size only if it is zero
+	RotateInterval int `json:"rotate_interval"`
+	// Gzip compresses the rotated files
+	Gzip bool `json:"gzip"`
+	// MaxFiles is the count of the rotated files to keep, 7 by default
+	MaxFiles int `json:"max_files"`
+}
+
+// FileClient writes the messages to the stdout or to the files
+type FileClient struct {
+	Stdout bool
+	conf   *FileConfig
+	path   *messageTemplate
+	files  map[string]*rotatingFile
+}
+
+// rotatingFile is the opened file of the path
+type rotatingFile struct {
+	path      string
+	file      *os.File
+	size      int64
+	opened    time.Time
+	lastWrite time.Time
+}
+
+func (f *FileClient) Connect(conf *SenderConfig) error {
+	c := conf.File
+	if c.Format == "" {
+		c.Format = NDJSON_FILE_FORMAT
+	}
+	if c.MaxSize <= 0 {
+		c.MaxSize = DEFAULT_FILE_MAX_SIZE
+	}
+	if c.MaxFiles <= 0 {
+		c.MaxFiles = DEFAULT_FILE_MAX_FILES
+	}
+
+	switch c.Format {
+	case NDJSON_FILE_FORMAT, TEXT_FILE_FORMAT:
+	default:
+		return errors.New("Wrong file format")
+	}
+	f.conf = &c
+	if f.Stdout {
+		return nil
+	}
+
+	var err error
+	if f.path, err = newMessageTemplate(c.Path); err != nil {
+		return errors.New("Wrong file path: " + err.Error())
+	}
+	f.files = make(map[string]*rotatingFile)
+	return nil
+}
+
+// Push writes the messages in order. The unwritten messages are retried on the error,
+// the messages with the path failed to render are dropped.
+func (f *FileClient) Push(l map[int64]LogMessage) error {
+	keys := sortedKeys(l)
+	if f.Stdout {
+		var buf bytes.Buffer
+		for _, k := range keys {
+			line, err := f.line(l[k])
+			if err != nil {
+				return err
+			}
+			buf.Write(line)
+		}
+		_, err := os.Stdout.Write(buf.Bytes())
+		return err
+	}
+
+	rejected := make(map[int64]LogMessage)
+	var reason error
+	for i, k := range keys {
+		path, err := f.path.render(l[k])
+		if err == nil && path == "" {
+			err = errors.New("empty path")
+		}
+		if err != nil {
+			rejected[k] = l[k]
+			reason = fmt.Errorf("Can't render the path of the %s/%s-%s: %s",
+				l[k].Namespace, l[k].PodName, l[k].Container, err.Error())
+			continue
+		}
+
+		if err := f.write(path, l[k]); err != nil {
+			failed := make(map[int64]LogMessage, len(keys)-i)
+			for _, k := range keys[i:] {
+				if _, ok := rejected[k]; !ok {
+					failed[k] = l[k]
+				}
+			}
+			return &PushError{Failed: failed, Rejected: rejected, Err: err}
+		}
+	}
+	f.closeIdle()
+
+	if len(rejected) > 0 {
+		return &PushError{Rejected: rejected, Err: reason}
+	}
+	return nil
+}
+
+func (f *FileClient) write(path string, l LogMessage) error {
+	line, err := f.line(l)
+	if err != nil {
+		return err
+	}
+
+	file, ok := f.files[path]
+	if !ok {
+		file = &rotatingFile{path: path}
+		f.files[path] = file
+	}
+	if file.file != nil && f.needRotate(file, len(line)) {
+		if err := f.rotate(file); err != nil {
+			return err
+		}
+	}
+	if file.file == nil {
+		if err := file.open(); err != nil {
+			return err
+		}
+	}
+
+	n, err := file.file.Write(line)
+	file.size += int64(n)
+	file.lastWrite = time.Now()
+	return err
+}
+
+// line returns the message as the JSON or as the text line with the new line
+func (f *FileClient) line(l LogMessage) ([]byte, error) {
+	if f.conf.Format == TEXT_FILE_FORMAT {
+		return []byte(l.Timestamp.Format(time.RFC3339Nano) + " " +
+			l.Namespace + "/" + l.PodName + "/" + l.Container + " " + l.Message + "\n"), nil
+	}
+	data, err := json.Marshal(l)
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+func (f *FileClient) needRotate(file *rotatingFile, size int) bool {
+	if file.size == 0 {
+		return false
+	}
+	if file.size+int64(size) > int64(f.conf.MaxSize)<<20 {
+		return true
+	}
+	return f.conf.RotateInterval > 0 &&
+		time.Since(file.opened) >= time.Second*time.Duration(f.conf.RotateInterval)
+}
+
+// rotate renames the file with the time suffix, compresses it
+// and removes the oldest rotated files
+func (f *FileClient) rotate(file *rotatingFile) error {
+	file.close()
+
+	rotated := file.path + "." + time.Now().Format(rotatedTimeLayout)
+	for i := 1; fileExists(rotated) || fileExists(rotated+".gz"); i++ {
+		rotated = file.path + "." + time.Now().Format(rotatedTimeLayout) + "-" + strconv.Itoa(i)
+	}
+	if err := os.Rename(file.path, rotated); err != nil {
+		return err
+	}
+
+	if f.conf.Gzip {
+		if err := gzipFile(rotated); err != nil {
+			log.Error("Can't compress the rotated file: ", err)
+		}
+	}
+
+	files, err := rotatedFiles(file.path)
+	if err != nil {
+		return err
+	}
+	for len(files) > f.conf.MaxFiles {
+		if err := os.Remove(files[0].path); err != nil {
+			log.Error(err)
+		}
+		files = files[1:]
+	}
+	return nil
+}
+
+// rotatedFile is the rotated file with the parsed time and counter suffix
+type rotatedFile struct {
+	path    string
+	time    time.Time
+	counter int
+}
+
+// rotatedFiles returns the rotated files of the path from the oldest one
+func rotatedFiles(base string) ([]rotatedFile, error) {
+	matches, err := filepath.Glob(base + ".[0-9]*")
+	if err != nil {
+		return nil, err
+	}
+	var files []rotatedFile
+	for _, path := range matches {
+		if r, ok := parseRotated(base, path); ok {
+			files = append(files, r)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if !files[i].time.Equal(files[j].time) {
+			return files[i].time.Before(files[j].time)
+		}
+		return files[i].counter < files[j].counter
+	})
+	return files, nil
+}
+
+// parseRotated parses the `<base>.<time>[-<counter>][.gz]' file name
+func parseRotated(base, path string) (rotatedFile, bool) {
+	suffix := strings.TrimSuffix(strings.TrimPrefix(path, base+"."), ".gz")
+	r := rotatedFile{path: path}
+	if i := strings.IndexByte(suffix, '-'); i >= 0 {
+		counter, err := strconv.Atoi(suffix[i+1:])
+		if err != nil {
+			return r, false
+		}
+		r.counter = counter
+		suffix = suffix[:i]
+	}
+	t, err := time.ParseInLocation(rotatedTimeLayout, suffix, time.Local)
+	if err != nil {
+		return r, false
+	}
+	r.time = t
+	return r, true
+}
+
+// closeIdle closes and forgets the files not written for the fileIdleTimeout
+func (f *FileClient) closeIdle() {
+	for path, file := range f.files {
+		if time.Since(file.lastWrite) > fileIdleTimeout {
+			file.close()
+			delete(f.files, path)
+		}
+	}
+}
+
+func (r *rotatingFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(r.path), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	r.file = file
+	r.size = info.Size()
+	r.opened = time.Now()
+	if r.size > 0 {
+		r.opened = r.started(info.ModTime())
+	}
+	return nil
+}
+
+// started returns the time the existing file was started at: the last rotation
+// or the modification time if the file was not rotated yet
+func (r *rotatingFile) started(modTime time.Time) time.Time {
+	files, err := rotatedFiles(r.path)
+	if err != nil || len(files) == 0 {
+		return modTime
+	}
+	return files[len(files)-1].time
+}
+
+func (r *rotatingFile) close() {
+	if r.file == nil {
+		return
+	}
+	if err := r.file.Close(); err != nil {
+		log.Error(err)
+	}
+	r.file = nil
+	r.size = 0
+}
+
+// gzipFile replaces the file with the `.gz' one
+func gzipFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(dst)
+	if _, err := io.Copy(gz, src); err != nil {
+		dst.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		dst.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+	return os.Remove(path)
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
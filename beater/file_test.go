@@ -0,0 +1,120 @@
+package beater
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestParseRotated(t *testing.T) {
+	want := time.Date(2021, 3, 14, 9, 15, 2, 0, time.Local)
+	for path, counter := range map[string]int{
+		"app.log.20210314T091502":      0,
+		"app.log.20210314T091502.gz":   0,
+		"app.log.20210314T091502-10":   10,
+		"app.log.20210314T091502-2.gz": 2,
+	} {
+		r, ok := parseRotated("app.log", path)
+		if !ok || !r.time.Equal(want) || r.counter != counter {
+			t.Errorf("parseRotated(%s) = %+v, %v", path, r, ok)
+		}
+	}
+	for _, path := range []string{"app.log.1", "app.log.20210314T091502-x", "app.log.2021-03-14"} {
+		if _, ok := parseRotated("app.log", path); ok {
+			t.Errorf("%s must not be parsed", path)
+		}
+	}
+}
+
+func TestFileRotateRetention(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kubeat-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	base := filepath.Join(dir, "app.log")
+	// Counters are compared as the numbers, the unknown files are kept
+	for _, name := range []string{
+		"app.log.20210314T091502-10",
+		"app.log.20210314T091502-2.gz",
+		"app.log.20210314T091502",
+		"app.log.20210315T000000.gz",
+		"app.log.1",
+		"app.log",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f := &FileClient{}
+	if err := f.Connect(&SenderConfig{File: FileConfig{Path: base, MaxFiles: 3}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.rotate(&rotatingFile{path: base}); err != nil {
+		t.Fatal(err)
+	}
+
+	matches, _ := filepath.Glob(base + ".*")
+	var names []string
+	for _, path := range matches {
+		names = append(names, filepath.Base(path))
+	}
+	sort.Strings(names)
+	want := []string{"app.log.1", "app.log.20210314T091502-10", "app.log.20210315T000000.gz"}
+	if len(names) != 4 || !reflect.DeepEqual(names[:3], want) {
+		t.Errorf("files %v, want %v and the rotated one", names, want)
+	}
+}
+
+func TestFileReopenStarted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kubeat-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	base := filepath.Join(dir, "app.log")
+	modTime := time.Now().Add(-time.Hour * 2).Truncate(time.Second)
+	if err := ioutil.WriteFile(base, []byte("x\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(base, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+
+	// The file forgotten after the idle timeout keeps its age
+	f := &FileClient{}
+	if err := f.Connect(&SenderConfig{File: FileConfig{Path: base, RotateInterval: 3600}}); err != nil {
+		t.Fatal(err)
+	}
+	file := &rotatingFile{path: base}
+	if err := file.open(); err != nil {
+		t.Fatal(err)
+	}
+	file.close()
+	if !file.opened.Equal(modTime) {
+		t.Errorf("opened = %v, want the modification time %v", file.opened, modTime)
+	}
+
+	// The last rotation is the start of the current file
+	rotated := time.Now().Add(-time.Hour * 3).Truncate(time.Second)
+	if err := ioutil.WriteFile(base+"."+rotated.Format(rotatedTimeLayout), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := file.open(); err != nil {
+		t.Fatal(err)
+	}
+	defer file.close()
+	if !file.opened.Equal(rotated) {
+		t.Errorf("opened = %v, want the rotation time %v", file.opened, rotated)
+	}
+	if !f.needRotate(file, 1) {
+		t.Error("Reopened file older than the rotate interval must be rotated")
+	}
+}
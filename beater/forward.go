@@ -0,0 +1,347 @@
+package beater
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha512"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+const DEFAULT_FORWARD_TAG = "kubernetes.{{ .Namespace }}.{{ .PodName }}.{{ .Container }}"
+
+// ForwardConfig is the fluentd forward output settings. Hosts are the `host:port'
+// of the aggregators, the next one is dialed if the connection fails.
+type ForwardConfig struct {
+	// Tag is the template of the message tag like the kafka topic
+	Tag string `json:"tag"`
+	// RequireAck waits for the `ack' of the every chunk
+	RequireAck bool `json:"require_ack"`
+	// SharedKey enables the handshake, the username and password
+	// of the sender config are used for the user authentication
+	SharedKey    string    `json:"shared_key"`
+	SelfHostname string    `json:"self_hostname"`
+	Gzip         bool      `json:"gzip"`
+	Timeout      int       `json:"timeout"`
+	TLS          TLSConfig `json:"tls"`
+}
+
+type ForwardClient struct {
+	Client net.Conn
+	reader *bufio.Reader
+	conf   *SenderConfig
+	tag    *messageTemplate
+	tls    *tls.Config
+}
+
+// forwardChunk is the PackedForward message of the messages with the same tag
+type forwardChunk struct {
+	tag     string
+	keys    []int64
+	entries []byte
+}
+
+func (f *ForwardClient) Connect(conf *SenderConfig) error {
+	if len(conf.Hosts) == 0 {
+		return errors.New("Forward hosts are not set")
+	}
+	if conf.Forward.Tag == "" {
+		conf.Forward.Tag = DEFAULT_FORWARD_TAG
+	}
+	if conf.Forward.SharedKey == "" {
+		conf.Forward.SharedKey = getForwardSharedKeyFromEnv()
+	}
+	if conf.Forward.SelfHostname == "" {
+		conf.Forward.SelfHostname, _ = os.Hostname()
+	}
+	if conf.Forward.Timeout <= 0 {
+		conf.Forward.Timeout = 30
+	}
+
+	var err error
+	if f.tag, err = newMessageTemplate(conf.Forward.Tag); err != nil {
+		return err
+	}
+	if f.tls, err = conf.Forward.TLS.build(); err != nil {
+		return err
+	}
+	f.conf = conf
+
+	// The connection is dialed again on the push
+	if err := f.dial(); err != nil {
+		log.Error("Can't connect to the forward host: ", err)
+	}
+	return nil
+}
+
+// dial connects to the first available host and makes the handshake
+func (f *ForwardClient) dial() error {
+	dialer := &net.Dialer{Timeout: f.timeout()}
+
+	var err error
+	for _, host := range f.conf.Hosts {
+		var conn net.Conn
+		if f.tls != nil {
+			conn, err = tls.DialWithDialer(dialer, "tcp", host, f.tls)
+		} else {
+			conn, err = dialer.Dial("tcp", host)
+		}
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+
+		f.Client = conn
+		f.reader = bufio.NewReader(conn)
+		if f.conf.Forward.SharedKey == "" {
+			return nil
+		}
+		if err = f.handshake(); err == nil {
+			return nil
+		}
+		log.Error(err)
+		f.close()
+	}
+	return err
+}
+
+func (f *ForwardClient) close() {
+	if f.Client != nil {
+		f.Client.Close()
+	}
+	f.Client = nil
+	f.reader = nil
+}
+
+func (f *ForwardClient) timeout() time.Duration {
+	return time.Second * time.Duration(f.conf.Forward.Timeout)
+}
+
+// handshake answers the server HELO with the PING and checks the PONG
+func (f *ForwardClient) handshake() error {
+	f.Client.SetDeadline(time.Now().Add(f.timeout()))
+	defer f.Client.SetDeadline(time.Time{})
+
+	helo, err := f.readMessage("HELO", 2)
+	if err != nil {
+		return err
+	}
+	opts, _ := helo[1].(map[string]interface{})
+	nonce, _ := opts["nonce"].(string)
+	authSalt, _ := opts["auth"].(string)
+
+	salt := uuid.New().String()
+	hostname := f.conf.Forward.SelfHostname
+	username, passwordDigest := "", ""
+	if authSalt != "" {
+		username = f.conf.Username
+		passwordDigest = sha512Hex(authSalt, username, f.conf.Password)
+	}
+
+	var ping []byte
+	ping = appendMsgpackArrayHeader(ping, 6)
+	ping = appendMsgpackString(ping, "PING")
+	ping = appendMsgpackString(ping, hostname)
+	ping = appendMsgpackString(ping, salt)
+	ping = appendMsgpackString(ping, sha512Hex(salt, hostname, nonce, f.conf.Forward.SharedKey))
+	ping = appendMsgpackString(ping, username)
+	ping = appendMsgpackString(ping, passwordDigest)
+	if _, err := f.Client.Write(ping); err != nil {
+		return err
+	}
+
+	pong, err := f.readMessage("PONG", 5)
+	if err != nil {
+		return err
+	}
+	if ok, _ := pong[1].(bool); !ok {
+		return fmt.Errorf("Forward authentication failed: %v", pong[2])
+	}
+	serverHostname, _ := pong[3].(string)
+	if pong[4] != sha512Hex(salt, serverHostname, nonce, f.conf.Forward.SharedKey) {
+		return errors.New("Forward server shared key mismatch")
+	}
+	return nil
+}
+
+// readMessage reads the handshake message of the given type
+func (f *ForwardClient) readMessage(name string, size int) ([]interface{}, error) {
+	v, err := readMsgpack(f.reader)
+	if err != nil {
+		return nil, err
+	}
+	msg, ok := v.([]interface{})
+	if !ok || len(msg) < size || msg[0] != name {
+		return nil, errors.New("Forward handshake failed: " + name + " expected")
+	}
+	return msg, nil
+}
+
+// Push sends the chunks in order. The connection is closed on the error
+// and dialed again on the next push, the unsent chunks are retried.
+// Messages with the tag failed to render are dropped.
+func (f *ForwardClient) Push(l map[int64]LogMessage) error {
+	chunks, rejected, err := f.chunks(l)
+	if err != nil {
+		return err
+	}
+	var reason error
+	if len(rejected) > 0 {
+		reason = fmt.Errorf("Can't render the forward tag of %d messages", len(rejected))
+	}
+	if len(chunks) == 0 {
+		return &PushError{Rejected: rejected, Err: reason}
+	}
+
+	if f.Client == nil {
+		if err := f.dial(); err != nil {
+			return err
+		}
+	}
+
+	log.Infof("Sending %d messages in %d chunks to the forward host", len(l), len(chunks))
+	for i, chunk := range chunks {
+		if err := f.send(chunk); err != nil {
+			f.close()
+
+			failed := make(map[int64]LogMessage)
+			for _, c := range chunks[i:] {
+				for _, k := range c.keys {
+					failed[k] = l[k]
+				}
+			}
+			return &PushError{Failed: failed, Rejected: rejected, Err: err}
+		}
+	}
+	if len(rejected) > 0 {
+		return &PushError{Rejected: rejected, Err: reason}
+	}
+	return nil
+}
+
+// send writes the PackedForward message and waits for the ack if it is required
+func (f *ForwardClient) send(chunk *forwardChunk) error {
+	entries := chunk.entries
+	if f.conf.Forward.Gzip {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		gz.Write(entries)
+		if err := gz.Close(); err != nil {
+			return err
+		}
+		entries = buf.Bytes()
+	}
+
+	options := 1
+	if f.conf.Forward.Gzip {
+		options++
+	}
+	var id string
+	if f.conf.Forward.RequireAck {
+		uid := uuid.New()
+		id = base64.StdEncoding.EncodeToString(uid[:])
+		options++
+	}
+
+	var msg []byte
+	msg = appendMsgpackArrayHeader(msg, 3)
+	msg = appendMsgpackString(msg, chunk.tag)
+	msg = appendMsgpackBin(msg, entries)
+	msg = appendMsgpackMapHeader(msg, options)
+	msg = appendMsgpackString(msg, "size")
+	msg = appendMsgpackInt(msg, int64(len(chunk.keys)))
+	if f.conf.Forward.Gzip {
+		msg = appendMsgpackString(msg, "compressed")
+		msg = appendMsgpackString(msg, "gzip")
+	}
+	if id != "" {
+		msg = appendMsgpackString(msg, "chunk")
+		msg = appendMsgpackString(msg, id)
+	}
+
+	f.Client.SetWriteDeadline(time.Now().Add(f.timeout()))
+	if _, err := f.Client.Write(msg); err != nil {
+		return err
+	}
+	if id == "" {
+		return nil
+	}
+
+	f.Client.SetReadDeadline(time.Now().Add(f.timeout()))
+	v, err := readMsgpack(f.reader)
+	if err != nil {
+		return err
+	}
+	resp, _ := v.(map[string]interface{})
+	if resp["ack"] != id {
+		return errors.New("Wrong forward ack")
+	}
+	return nil
+}
+
+// chunks groups the messages by the tag, the order of the messages is kept
+// within the tag. Returns the messages with the tag failed to render.
+func (f *ForwardClient) chunks(l map[int64]LogMessage) ([]*forwardChunk, map[int64]LogMessage, error) {
+	index := make(map[string]*forwardChunk)
+	var chunks []*forwardChunk
+	rejected := make(map[int64]LogMessage)
+	for _, key := range sortedKeys(l) {
+		m := l[key]
+		tag, err := f.tag.render(m)
+		if err == nil && tag == "" {
+			err = errors.New("empty tag")
+		}
+		if err != nil {
+			log.Errorf("Can't render the tag of the %s/%s-%s: %s", m.Namespace, m.PodName, m.Container, err.Error())
+			rejected[key] = m
+			continue
+		}
+
+		record, err := forwardRecord(m)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		c, ok := index[tag]
+		if !ok {
+			c = &forwardChunk{tag: tag}
+			index[tag] = c
+			chunks = append(chunks, c)
+		}
+		c.keys = append(c.keys, key)
+		c.entries = appendMsgpackArrayHeader(c.entries, 2)
+		c.entries = appendMsgpackEventTime(c.entries, m.Timestamp)
+		c.entries = appendMsgpackValue(c.entries, record)
+	}
+	return chunks, rejected, nil
+}
+
+// forwardRecord returns the message as the map of its JSON fields
+func forwardRecord(m LogMessage) (map[string]interface{}, error) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	var record map[string]interface{}
+	err = json.Unmarshal(data, &record)
+	return record, err
+}
+
+func sha512Hex(values ...string) string {
+	h := sha512.New()
+	for _, v := range values {
+		h.Write([]byte(v))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
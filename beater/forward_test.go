@@ -0,0 +1,215 @@
+package beater
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSHA512Hex(t *testing.T) {
+	want := "ddaf35a193617abacc417349ae20413112e6fa4e89a97ea20a9eeee64b55d39a" +
+		"2192992a274fc1a836ba3c23a3feebbd454d4423643ce80e2a9ac94fa54ca49f"
+	if got := sha512Hex("a", "bc"); got != want {
+		t.Errorf("sha512Hex() = %s, want %s", got, want)
+	}
+}
+
+// forwardServer is the aggregator accepting the single connection
+type forwardServer struct {
+	listener net.Listener
+	key      string
+	// chunks are the tags and the records of the received PackedForward messages
+	chunks chan forwardReceived
+	errs   chan error
+}
+
+type forwardReceived struct {
+	tag     string
+	options map[string]interface{}
+	records []interface{}
+}
+
+func newForwardServer(t *testing.T, key string) *forwardServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &forwardServer{
+		listener: listener,
+		key:      key,
+		chunks:   make(chan forwardReceived, 10),
+		errs:     make(chan error, 1),
+	}
+	go s.serve()
+	return s
+}
+
+func (s *forwardServer) serve() {
+	conn, err := s.listener.Accept()
+	if err != nil {
+		s.errs <- err
+		return
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	if s.key != "" {
+		if err := s.handshake(conn, r); err != nil {
+			s.errs <- err
+			return
+		}
+	}
+
+	for {
+		v, err := readMsgpack(r)
+		if err != nil {
+			return
+		}
+		msg := v.([]interface{})
+		received := forwardReceived{tag: msg[0].(string), options: msg[2].(map[string]interface{})}
+		entries := bufio.NewReader(bytes.NewReader([]byte(msg[1].(string))))
+		for {
+			entry, err := readMsgpack(entries)
+			if err != nil {
+				break
+			}
+			received.records = append(received.records, entry.([]interface{})[1])
+		}
+		s.chunks <- received
+
+		if chunk, ok := received.options["chunk"]; ok {
+			var ack []byte
+			ack = appendMsgpackMapHeader(ack, 1)
+			ack = appendMsgpackString(ack, "ack")
+			ack = appendMsgpackString(ack, chunk.(string))
+			conn.Write(ack)
+		}
+	}
+}
+
+func (s *forwardServer) handshake(conn net.Conn, r *bufio.Reader) error {
+	var helo []byte
+	helo = appendMsgpackArrayHeader(helo, 2)
+	helo = appendMsgpackString(helo, "HELO")
+	helo = appendMsgpackMapHeader(helo, 3)
+	helo = appendMsgpackString(helo, "nonce")
+	helo = appendMsgpackString(helo, "nonce")
+	helo = appendMsgpackString(helo, "auth")
+	helo = appendMsgpackString(helo, "")
+	helo = appendMsgpackString(helo, "keepalive")
+	helo = appendMsgpackBool(helo, true)
+	conn.Write(helo)
+
+	v, err := readMsgpack(r)
+	if err != nil {
+		return err
+	}
+	ping := v.([]interface{})
+	hostname, salt := ping[1].(string), ping[2].(string)
+	ok := ping[0] == "PING" && ping[3] == sha512Hex(salt, hostname, "nonce", s.key) && ping[5] == ""
+
+	var pong []byte
+	pong = appendMsgpackArrayHeader(pong, 5)
+	pong = appendMsgpackString(pong, "PONG")
+	pong = appendMsgpackBool(pong, ok)
+	pong = appendMsgpackString(pong, "")
+	pong = appendMsgpackString(pong, "aggregator")
+	pong = appendMsgpackString(pong, sha512Hex(salt, "aggregator", "nonce", s.key))
+	conn.Write(pong)
+	return nil
+}
+
+func newTestForwardClient(t *testing.T, addr string, conf ForwardConfig) *ForwardClient {
+	f := &ForwardClient{}
+	conf.Timeout = 5
+	if err := f.Connect(&SenderConfig{Hosts: []string{addr}, Forward: conf}); err != nil {
+		t.Fatal(err)
+	}
+	if f.Client == nil {
+		t.Fatal("Forward client is not connected")
+	}
+	return f
+}
+
+func TestForwardPushWithAck(t *testing.T) {
+	s := newForwardServer(t, "secret")
+	defer s.listener.Close()
+	f := newTestForwardClient(t, s.listener.Addr().String(), ForwardConfig{
+		Tag:        "kube.{{ .Namespace }}",
+		SharedKey:  "secret",
+		RequireAck: true,
+	})
+	defer f.close()
+
+	err := f.Push(map[int64]LogMessage{
+		1: {Namespace: "a", Message: "1", Timestamp: time.Unix(1, 0)},
+		2: {Namespace: "b", Message: "2", Timestamp: time.Unix(2, 0)},
+		3: {Namespace: "a", Message: "3", Timestamp: time.Unix(3, 0)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []struct {
+		tag      string
+		messages []string
+	}{
+		{"kube.a", []string{"1", "3"}},
+		{"kube.b", []string{"2"}},
+	} {
+		var got forwardReceived
+		select {
+		case got = <-s.chunks:
+		case err := <-s.errs:
+			t.Fatal(err)
+		}
+		var messages []string
+		for _, r := range got.records {
+			messages = append(messages, r.(map[string]interface{})["message"].(string))
+		}
+		if got.tag != want.tag || !reflect.DeepEqual(messages, want.messages) {
+			t.Errorf("chunk %s %v, want %s %v", got.tag, messages, want.tag, want.messages)
+		}
+		if got.options["size"] != int64(len(want.messages)) {
+			t.Errorf("size = %v, want %d", got.options["size"], len(want.messages))
+		}
+	}
+}
+
+func TestForwardHandshakeKeyMismatch(t *testing.T) {
+	s := newForwardServer(t, "secret")
+	defer s.listener.Close()
+
+	f := &ForwardClient{}
+	conf := &SenderConfig{
+		Hosts:   []string{s.listener.Addr().String()},
+		Forward: ForwardConfig{SharedKey: "wrong", Timeout: 5},
+	}
+	if err := f.Connect(conf); err != nil {
+		t.Fatal(err)
+	}
+	if f.Client != nil {
+		t.Error("Client must not be connected with the wrong shared key")
+	}
+}
+
+func TestForwardPushWithoutAck(t *testing.T) {
+	s := newForwardServer(t, "")
+	defer s.listener.Close()
+	f := newTestForwardClient(t, s.listener.Addr().String(), ForwardConfig{})
+	defer f.close()
+
+	if err := f.Push(map[int64]LogMessage{1: {Namespace: "ns", PodName: "pod", Container: "con"}}); err != nil {
+		t.Fatal(err)
+	}
+	got := <-s.chunks
+	if got.tag != "kubernetes.ns.pod.con" || len(got.records) != 1 {
+		t.Errorf("chunk %s %v", got.tag, got.records)
+	}
+	if _, ok := got.options["chunk"]; ok {
+		t.Error("chunk option is set without the require_ack")
+	}
+}
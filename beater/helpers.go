@@ -4,6 +4,7 @@ import (
 	"os"
 	"regexp"
 	"strings"
+	"time"
 
 	"k8s.io/api/core/v1"
 )
@@ -43,6 +44,16 @@ func (i ignored) isIgnored(pod v1.Pod) bool {
 	return false
 }
 
+// matchString returns true if any of the regexps matches the string
+func (i ignored) matchString(s string) bool {
+	for _, r := range i {
+		if r.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
 func ignoredPods(ignorePod string) ignored {
 	if ignorePod == "" {
 		return nil
@@ -75,3 +86,142 @@ func getESCredsFromEnv() (string, string) {
 	pass := os.Getenv(ELASTIC_ENV_PASSWORD)
 	return user, pass
 }
+
+func getKafkaCredsFromEnv() (string, string) {
+	user := os.Getenv(KAFKA_ENV_USERNAME)
+	pass := os.Getenv(KAFKA_ENV_PASSWORD)
+	return user, pass
+}
+
+func getHTTPTokenFromEnv() string {
+	return os.Getenv(HTTP_ENV_TOKEN)
+}
+
+func getForwardSharedKeyFromEnv() string {
+	return os.Getenv(FORWARD_ENV_KEY)
+}
+
+func getS3CredsFromEnv() (string, string) {
+	accessKey := os.Getenv(S3_ENV_ACCESS_KEY)
+	secretKey := os.Getenv(S3_ENV_SECRET_KEY)
+	return accessKey, secretKey
+}
+
+const (
+	INIT_CONTAINER      string = "init"
+	CONTAINER           string = "container"
+	EPHEMERAL_CONTAINER string = "ephemeral"
+)
+
+// podContainer is a container of any kind from the pod spec
+type podContainer struct {
+	Name   string
+	Kind   string
+	Status *v1.ContainerStatus
+}
+
+// isRunning returns true if the container is running now
+func (c podContainer) isRunning() bool {
+	return c.Status != nil && c.Status.State.Running != nil
+}
+
+// isTerminated returns true if the container is terminated
+func (c podContainer) isTerminated() bool {
+	return c.Status != nil && c.Status.State.Terminated != nil
+}
+
+// podContainers returns init, regular and ephemeral containers of the pod
+func podContainers(pod v1.Pod) []podContainer {
+	var containers []podContainer
+	for _, c := range pod.Spec.InitContainers {
+		containers = append(containers, podContainer{
+			Name:   c.Name,
+			Kind:   INIT_CONTAINER,
+			Status: findContainerStatus(pod.Status.InitContainerStatuses, c.Name),
+		})
+	}
+	for _, c := range pod.Spec.Containers {
+		containers = append(containers, podContainer{
+			Name:   c.Name,
+			Kind:   CONTAINER,
+			Status: findContainerStatus(pod.Status.ContainerStatuses, c.Name),
+		})
+	}
+	for _, c := range pod.Spec.EphemeralContainers {
+		containers = append(containers, podContainer{
+			Name:   c.Name,
+			Kind:   EPHEMERAL_CONTAINER,
+			Status: findContainerStatus(pod.Status.EphemeralContainerStatuses, c.Name),
+		})
+	}
+	return containers
+}
+
+func findContainerStatus(statuses []v1.ContainerStatus, con string) *v1.ContainerStatus {
+	for i, status := range statuses {
+		if status.Name == con {
+			return &statuses[i]
+		}
+	}
+	return nil
+}
+
+// containerStatus returns the status of the pod container of any kind
+func containerStatus(pod v1.Pod, con string) *v1.ContainerStatus {
+	for _, c := range podContainers(pod) {
+		if c.Name == con {
+			return c.Status
+		}
+	}
+	return nil
+}
+
+// containerID returns the runtime ID of the pod container
+func containerID(pod v1.Pod, con string) string {
+	if status := containerStatus(pod, con); status != nil {
+		return status.ContainerID
+	}
+	return ""
+}
+
+// containerRules selects the containers to collect logs from by the names
+type containerRules struct {
+	include ignored
+	exclude ignored
+}
+
+func newContainerRules(include, exclude string) containerRules {
+	return containerRules{
+		include: ignoredPods(include),
+		exclude: ignoredPods(exclude),
+	}
+}
+
+// isAllowed returns true if the container matches any include rule
+// and does not match exclude rules
+func (r containerRules) isAllowed(con string) bool {
+	if r.include != nil && !r.include.matchString(con) {
+		return false
+	}
+	return !r.exclude.matchString(con)
+}
+
+// parseLogLine splits the log line into the RFC3339Nano timestamp
+// added by the Kubernetes and the message. Zero time is returned
+// if the line has no timestamp.
+func parseLogLine(line string) (time.Time, string) {
+	line = strings.TrimRight(line, "\r\n")
+	i := strings.IndexByte(line, ' ')
+	if i < 0 {
+		i = len(line)
+	}
+
+	ts, err := time.Parse(time.RFC3339Nano, line[:i])
+	if err != nil {
+		return time.Time{}, line
+	}
+	if i == len(line) {
+		return ts, ""
+	}
+	return ts, line[i+1:]
+}
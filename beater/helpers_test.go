@@ -0,0 +1,149 @@
+package beater
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestPodContainers(t *testing.T) {
+	pod := corev1.Pod{
+		Spec: corev1.PodSpec{
+			InitContainers: []corev1.Container{{Name: "migrate"}},
+			Containers:     []corev1.Container{{Name: "app"}, {Name: "sidecar"}},
+			EphemeralContainers: []corev1.EphemeralContainer{
+				{EphemeralContainerCommon: corev1.EphemeralContainerCommon{Name: "debugger"}},
+			},
+		},
+		Status: corev1.PodStatus{
+			InitContainerStatuses: []corev1.ContainerStatus{{Name: "migrate", ContainerID: "docker://migrate"}},
+			// Statuses are matched by the names, not the order
+			ContainerStatuses: []corev1.ContainerStatus{
+				{Name: "sidecar", ContainerID: "docker://sidecar"},
+				{Name: "app", ContainerID: "docker://app"},
+			},
+		},
+	}
+
+	var got [][3]string
+	for _, c := range podContainers(pod) {
+		id := ""
+		if c.Status != nil {
+			id = c.Status.ContainerID
+		}
+		got = append(got, [3]string{c.Name, c.Kind, id})
+	}
+	want := [][3]string{
+		{"migrate", INIT_CONTAINER, "docker://migrate"},
+		{"app", CONTAINER, "docker://app"},
+		{"sidecar", CONTAINER, "docker://sidecar"},
+		// The status is not reported yet
+		{"debugger", EPHEMERAL_CONTAINER, ""},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("podContainers() = %v, want %v", got, want)
+	}
+
+	for con, want := range map[string]string{"migrate": "docker://migrate", "app": "docker://app", "debugger": "", "missing": ""} {
+		if got := containerID(pod, con); got != want {
+			t.Errorf("containerID(%s) = %q, want %q", con, got, want)
+		}
+	}
+}
+
+func TestPodContainerState(t *testing.T) {
+	for _, c := range []struct {
+		status     *corev1.ContainerStatus
+		running    bool
+		terminated bool
+	}{
+		{nil, false, false},
+		{&corev1.ContainerStatus{State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{}}}, false, false},
+		{&corev1.ContainerStatus{State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}}, true, false},
+		{&corev1.ContainerStatus{State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{}}}, false, true},
+	} {
+		con := podContainer{Name: "app", Status: c.status}
+		if con.isRunning() != c.running || con.isTerminated() != c.terminated {
+			t.Errorf("%+v: isRunning() = %v, isTerminated() = %v", c.status, con.isRunning(), con.isTerminated())
+		}
+	}
+}
+
+func TestContainerRules(t *testing.T) {
+	for _, c := range []struct {
+		include, exclude string
+		allowed          []string
+		denied           []string
+	}{
+		{"", "", []string{"app", "istio-proxy"}, nil},
+		{"", "^istio-proxy$,^linkerd", []string{"app", "proxy"}, []string{"istio-proxy", "linkerd-proxy"}},
+		{"^app", "", []string{"app", "app-worker"}, []string{"sidecar"}},
+		{"^app", "worker$", []string{"app"}, []string{"app-worker", "sidecar"}},
+	} {
+		rules := newContainerRules(c.include, c.exclude)
+		for _, con := range c.allowed {
+			if !rules.isAllowed(con) {
+				t.Errorf("include %q, exclude %q: %s must be allowed", c.include, c.exclude, con)
+			}
+		}
+		for _, con := range c.denied {
+			if rules.isAllowed(con) {
+				t.Errorf("include %q, exclude %q: %s must be denied", c.include, c.exclude, con)
+			}
+		}
+	}
+}
+
+func TestParseLogLine(t *testing.T) {
+	ts := time.Date(2021, 3, 14, 9, 15, 2, 123456789, time.UTC)
+	for _, c := range []struct {
+		line    string
+		ts      time.Time
+		message string
+	}{
+		{"2021-03-14T09:15:02.123456789Z GET / 200\n", ts, "GET / 200"},
+		{"2021-03-14T09:15:02.123456789Z  indented\r\n", ts, " indented"},
+		{"2021-03-14T09:15:02Z x", ts.Truncate(time.Second), "x"},
+		{"2021-03-14T09:15:02.123456789Z", ts, ""},
+		{"2021-03-14T09:15:02.123456789Z \n", ts, ""},
+		// Lines without the timestamp are left as is
+		{"GET / 200", time.Time{}, "GET / 200"},
+		{"2021-03-14 09:15:02 x", time.Time{}, "2021-03-14 09:15:02 x"},
+		{"", time.Time{}, ""},
+	} {
+		got, message := parseLogLine(c.line)
+		if !got.Equal(c.ts) || message != c.message {
+			t.Errorf("parseLogLine(%q) = %v, %q, want %v, %q", c.line, got, message, c.ts, c.message)
+		}
+	}
+}
+
+func TestNewLogMessage(t *testing.T) {
+	p := &PodLogs{}
+	pod := corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "pod"},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app"}}},
+		Status: corev1.PodStatus{
+			ContainerStatuses: []corev1.ContainerStatus{{Name: "app", ContainerID: "docker://app"}},
+		},
+	}
+
+	// The Kubernetes timestamp is the time of the message
+	ts := time.Date(2021, 3, 14, 9, 15, 2, 0, time.UTC)
+	l := p.newLogMessage(pod, "app", "2021-03-14T09:15:02Z hello")
+	if l.Message != "hello" || !l.Timestamp.Equal(ts) || !l.logTime.Equal(ts) || l.ContainerID != "docker://app" {
+		t.Errorf("newLogMessage() = %+v", l)
+	}
+	if l.SenderTime.Before(ts) || l.SenderTime.Equal(ts) {
+		t.Errorf("SenderTime %v must be the read time", l.SenderTime)
+	}
+
+	// The read time is used without the timestamp
+	l = p.newLogMessage(pod, "app", "hello")
+	if l.Message != "hello" || !l.Timestamp.Equal(l.SenderTime) || !l.logTime.Equal(l.SenderTime) {
+		t.Errorf("newLogMessage() = %+v, want the read time", l)
+	}
+}
@@ -0,0 +1,236 @@
+package beater
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"text/template"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	NDJSON_HTTP_FORMAT     = "ndjson"
+	JSON_ARRAY_HTTP_FORMAT = "json_array"
+)
+
+// HTTPConfig is the http output settings. Hosts are the endpoint URLs,
+// the next one is tried if the request fails.
+type HTTPConfig struct {
+	Method string `json:"method"`
+	// Format is `ndjson' or `json_array'
+	Format string `json:"format"`
+	// Template is the Go template of the single message,
+	// the message is marshalled into the JSON if it is empty
+	Template    string            `json:"template"`
+	Headers     map[string]string `json:"headers"`
+	BearerToken string            `json:"bearer_token"`
+	Gzip        bool              `json:"gzip"`
+	// DropStatuses are the response codes to drop the batch,
+	// the batch is retried on the other codes except 2xx
+	DropStatuses []int     `json:"drop_statuses"`
+	Timeout      int       `json:"timeout"`
+	TLS          TLSConfig `json:"tls"`
+}
+
+type HTTPClient struct {
+	Client *http.Client
+	conf   *SenderConfig
+	tmpl   *template.Template
+}
+
+// httpTemplateData is the data of the message template
+type httpTemplateData struct {
+	LogMessage
+	Labels map[string]string
+}
+
+func (h *HTTPClient) Connect(conf *SenderConfig) error {
+	if len(conf.Hosts) == 0 {
+		return errors.New("HTTP endpoints are not set")
+	}
+	switch conf.HTTP.Format {
+	case "", NDJSON_HTTP_FORMAT, JSON_ARRAY_HTTP_FORMAT:
+	default:
+		return errors.New("Wrong http format")
+	}
+	if conf.HTTP.Method == "" {
+		conf.HTTP.Method = http.MethodPost
+	}
+	if conf.HTTP.BearerToken == "" {
+		conf.HTTP.BearerToken = getHTTPTokenFromEnv()
+	}
+
+	if conf.HTTP.Template != "" {
+		tmpl, err := template.New("").Funcs(template.FuncMap{
+			"json": func(v interface{}) (string, error) {
+				data, err := json.Marshal(v)
+				return string(data), err
+			},
+		}).Option("missingkey=zero").Parse(conf.HTTP.Template)
+		if err != nil {
+			return err
+		}
+		h.tmpl = tmpl
+	}
+
+	client, err := newHTTPClient(&conf.HTTP.TLS, conf.HTTP.Timeout)
+	if err != nil {
+		return err
+	}
+	h.Client = client
+	h.conf = conf
+	return nil
+}
+
+// Push sends the batch to the first endpoint which accepts it. The batch rejected
+// with the drop statuses and the messages failed to render are dropped.
+func (h *HTTPClient) Push(l map[int64]LogMessage) error {
+	body, rejected, err := h.body(l)
+	if err != nil {
+		return err
+	}
+	var reason error
+	if len(rejected) > 0 {
+		reason = fmt.Errorf("Can't render the template of %d messages", len(rejected))
+		if len(rejected) == len(l) {
+			return &PushError{Rejected: rejected, Err: reason}
+		}
+	}
+
+	log.Infof("Sending %d messages to the HTTP endpoint", len(l)-len(rejected))
+	for _, url := range h.conf.Hosts {
+		err = h.push(url, body)
+		if _, ok := err.(*PermanentError); ok || err == nil {
+			break
+		}
+		log.Error(err)
+	}
+
+	switch err.(type) {
+	case nil:
+		if len(rejected) > 0 {
+			return &PushError{Rejected: rejected, Err: reason}
+		}
+		return nil
+	case *PermanentError:
+		return err
+	}
+	if len(rejected) == 0 {
+		return err
+	}
+	failed := make(map[int64]LogMessage, len(l)-len(rejected))
+	for k, v := range l {
+		if _, ok := rejected[k]; !ok {
+			failed[k] = v
+		}
+	}
+	return &PushError{Failed: failed, Rejected: rejected, Err: err}
+}
+
+func (h *HTTPClient) push(url string, body []byte) error {
+	req, err := http.NewRequest(h.conf.HTTP.Method, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	if h.conf.HTTP.Format == JSON_ARRAY_HTTP_FORMAT {
+		req.Header.Set("Content-Type", "application/json")
+	} else {
+		req.Header.Set("Content-Type", "application/x-ndjson")
+	}
+	if h.conf.HTTP.Gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	switch {
+	case h.conf.HTTP.BearerToken != "":
+		req.Header.Set("Authorization", "Bearer "+h.conf.HTTP.BearerToken)
+	case h.conf.Username != "":
+		req.SetBasicAuth(h.conf.Username, h.conf.Password)
+	}
+	for k, v := range h.conf.HTTP.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := h.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+
+	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		return nil
+	}
+	err = fmt.Errorf("HTTP endpoint responded %d: %s", resp.StatusCode, string(data))
+	for _, code := range h.conf.HTTP.DropStatuses {
+		if code == resp.StatusCode {
+			return &PermanentError{Err: err}
+		}
+	}
+	return err
+}
+
+// body encodes the messages in order, gzipped if it is enabled.
+// Returns the messages failed to render.
+func (h *HTTPClient) body(l map[int64]LogMessage) ([]byte, map[int64]LogMessage, error) {
+	var buf bytes.Buffer
+	var w io.Writer = &buf
+	var gz *gzip.Writer
+	if h.conf.HTTP.Gzip {
+		gz = gzip.NewWriter(&buf)
+		w = gz
+	}
+
+	array := h.conf.HTTP.Format == JSON_ARRAY_HTTP_FORMAT
+	if array {
+		io.WriteString(w, "[")
+	}
+	rejected := make(map[int64]LogMessage)
+	var n int
+	for _, k := range sortedKeys(l) {
+		m := l[k]
+		item, err := h.item(m)
+		if err != nil {
+			log.Errorf("Can't render the message of the %s/%s-%s: %s", m.Namespace, m.PodName, m.Container, err.Error())
+			rejected[k] = m
+			continue
+		}
+		if array && n > 0 {
+			io.WriteString(w, ",")
+		}
+		w.Write(item)
+		if !array {
+			io.WriteString(w, "\n")
+		}
+		n++
+	}
+	if array {
+		io.WriteString(w, "]")
+	}
+
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			return nil, nil, err
+		}
+	}
+	return buf.Bytes(), rejected, nil
+}
+
+// item returns the message rendered by the template or marshalled into the JSON
+func (h *HTTPClient) item(l LogMessage) ([]byte, error) {
+	if h.tmpl == nil {
+		return json.Marshal(l)
+	}
+
+	var buf bytes.Buffer
+	if err := h.tmpl.Execute(&buf, httpTemplateData{LogMessage: l, Labels: l.labels}); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSpace(buf.Bytes()), nil
+}
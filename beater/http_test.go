@@ -0,0 +1,76 @@
+package beater
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHTTPPushStatuses(t *testing.T) {
+	var status int
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer failing.Close()
+	var accepted int
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		accepted++
+	}))
+	defer ok.Close()
+
+	h := &HTTPClient{}
+	conf := &SenderConfig{Hosts: []string{failing.URL, ok.URL}, HTTP: HTTPConfig{DropStatuses: []int{400}}}
+	if err := h.Connect(conf); err != nil {
+		t.Fatal(err)
+	}
+	batch := map[int64]LogMessage{1: {Message: "a"}}
+
+	for _, status = range []int{401, 403, 404, 413, 429, 503} {
+		accepted = 0
+		if err := h.Push(batch); err != nil || accepted != 1 {
+			t.Errorf("%d: Push() = %v, accepted %d", status, err, accepted)
+		}
+	}
+
+	status = 400
+	accepted = 0
+	err := h.Push(batch)
+	if _, ok := err.(*PermanentError); !ok || accepted != 0 {
+		t.Errorf("Push() = %v, accepted %d, want the permanent error", err, accepted)
+	}
+}
+
+func TestHTTPPushTemplateError(t *testing.T) {
+	var body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		body = string(data)
+	}))
+	defer server.Close()
+
+	h := &HTTPClient{}
+	conf := &SenderConfig{Hosts: []string{server.URL}, HTTP: HTTPConfig{
+		Format:   JSON_ARRAY_HTTP_FORMAT,
+		Template: `{{ json .Fields.n }}`,
+	}}
+	if err := h.Connect(conf); err != nil {
+		t.Fatal(err)
+	}
+
+	err := h.Push(map[int64]LogMessage{
+		1: {Fields: map[string]interface{}{"n": 1}},
+		2: {Fields: map[string]interface{}{"n": func() {}}},
+		3: {Fields: map[string]interface{}{"n": 3}},
+	})
+	perr, ok := err.(*PushError)
+	if !ok {
+		t.Fatalf("Push() = %v, want the PushError", err)
+	}
+	if len(perr.Failed) != 0 || len(perr.Rejected) != 1 || perr.Rejected[2].Fields == nil {
+		t.Errorf("Failed %v, Rejected %v", perr.Failed, perr.Rejected)
+	}
+	if body != "[1,3]" {
+		t.Errorf("body = %q, want [1,3]", body)
+	}
+}
@@ -0,0 +1,325 @@
+package beater
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/Shopify/sarama"
+	log "github.com/sirupsen/logrus"
+	"github.com/vjeantet/jodaTime"
+	"github.com/xdg/scram"
+)
+
+const (
+	POD_PARTITION_KEY       = "pod"
+	CONTAINER_PARTITION_KEY = "container"
+)
+
+// KafkaConfig is the kafka output settings. Brokers are taken from the hosts.
+// Topic is the template of the message, e.g. `logs-{{ .Namespace }}'
+// or `{{ index .Labels "app" }}'.
+type KafkaConfig struct {
+	Topic string `json:"topic"`
+	// PartitionKey is `pod', `container' or empty for the random partitions
+	PartitionKey string `json:"partition_key"`
+	// Compression is `none', `gzip', `snappy', `lz4' or `zstd'
+	Compression string `json:"compression"`
+	// Acks is `none', `leader' or `all'
+	Acks       string `json:"acks"`
+	Idempotent bool   `json:"idempotent"`
+	Version    string `json:"version"`
+	// SASLMechanism is `PLAIN', `SCRAM-SHA-256' or `SCRAM-SHA-512'.
+	// Username and password are taken from the sender config.
+	SASLMechanism string    `json:"sasl_mechanism"`
+	TLS           TLSConfig `json:"tls"`
+}
+
+// kafkaProducer is the part of the sarama.SyncProducer used by the client,
+// so it can be replaced by the stub broker
+type kafkaProducer interface {
+	SendMessages([]*sarama.ProducerMessage) error
+	Close() error
+}
+
+type KafkaClient struct {
+	Producer kafkaProducer
+	topic    *messageTemplate
+	key      string
+}
+
+func (k *KafkaClient) Connect(conf *SenderConfig) error {
+	var err error
+	if k.topic, err = newMessageTemplate(conf.Kafka.Topic); err != nil {
+		return err
+	}
+	switch conf.Kafka.PartitionKey {
+	case "", POD_PARTITION_KEY, CONTAINER_PARTITION_KEY:
+		k.key = conf.Kafka.PartitionKey
+	default:
+		return errors.New("Wrong kafka partition key")
+	}
+
+	if k.Producer != nil {
+		return nil
+	}
+	cfg, err := newSaramaConfig(conf)
+	if err != nil {
+		return err
+	}
+	k.Producer, err = sarama.NewSyncProducer(conf.Hosts, cfg)
+	return err
+}
+
+func newSaramaConfig(conf *SenderConfig) (*sarama.Config, error) {
+	cfg := sarama.NewConfig()
+	cfg.ClientID = "kubeat"
+	cfg.Producer.Return.Successes = true
+	// Batches are retried by the sender
+	cfg.Producer.Retry.Max = 1
+
+	if conf.Kafka.Version != "" {
+		version, err := sarama.ParseKafkaVersion(conf.Kafka.Version)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Version = version
+	}
+
+	switch conf.Kafka.Acks {
+	case "", "all":
+		cfg.Producer.RequiredAcks = sarama.WaitForAll
+	case "leader":
+		cfg.Producer.RequiredAcks = sarama.WaitForLocal
+	case "none":
+		cfg.Producer.RequiredAcks = sarama.NoResponse
+	default:
+		return nil, errors.New("Wrong kafka acks")
+	}
+
+	switch conf.Kafka.Compression {
+	case "", "none":
+		cfg.Producer.Compression = sarama.CompressionNone
+	case "gzip":
+		cfg.Producer.Compression = sarama.CompressionGZIP
+	case "snappy":
+		cfg.Producer.Compression = sarama.CompressionSnappy
+	case "lz4":
+		cfg.Producer.Compression = sarama.CompressionLZ4
+	case "zstd":
+		cfg.Producer.Compression = sarama.CompressionZSTD
+		if !cfg.Version.IsAtLeast(sarama.V2_1_0_0) {
+			cfg.Version = sarama.V2_1_0_0
+		}
+	default:
+		return nil, errors.New("Wrong kafka compression")
+	}
+
+	if conf.Kafka.Idempotent {
+		// Idempotent producer requires the single in-flight request and all the acks
+		cfg.Producer.Idempotent = true
+		cfg.Producer.RequiredAcks = sarama.WaitForAll
+		cfg.Net.MaxOpenRequests = 1
+		if !cfg.Version.IsAtLeast(sarama.V0_11_0_0) {
+			cfg.Version = sarama.V0_11_0_0
+		}
+	}
+
+	tlsConfig, err := conf.Kafka.TLS.build()
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		cfg.Net.TLS.Enable = true
+		cfg.Net.TLS.Config = tlsConfig
+	}
+
+	if conf.Kafka.SASLMechanism != "" {
+		if conf.Username == "" || conf.Password == "" {
+			conf.Username, conf.Password = getKafkaCredsFromEnv()
+		}
+		cfg.Net.SASL.Enable = true
+		cfg.Net.SASL.User = conf.Username
+		cfg.Net.SASL.Password = conf.Password
+		switch conf.Kafka.SASLMechanism {
+		case sarama.SASLTypePlaintext:
+			cfg.Net.SASL.Mechanism = sarama.SASLTypePlaintext
+		case sarama.SASLTypeSCRAMSHA256:
+			cfg.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA256
+			cfg.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+				return &scramClient{HashGeneratorFcn: scram.SHA256}
+			}
+		case sarama.SASLTypeSCRAMSHA512:
+			cfg.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA512
+			cfg.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+				return &scramClient{HashGeneratorFcn: scramSHA512}
+			}
+		default:
+			return nil, errors.New("Wrong kafka SASL mechanism")
+		}
+	}
+
+	return cfg, cfg.Validate()
+}
+
+// Push produces the messages in order. Messages rejected by the brokers
+// are returned in the PushError to be retried. Messages with the invalid topic
+// or too large are dropped.
+func (k *KafkaClient) Push(l map[int64]LogMessage) error {
+	keys := sortedKeys(l)
+	msgs := make([]*sarama.ProducerMessage, 0, len(keys))
+	rejected := make(map[int64]LogMessage)
+	var reason error
+	for _, key := range keys {
+		v := l[key]
+		topic, err := k.topic.render(v)
+		if err == nil && topic == "" {
+			err = errors.New("empty topic")
+		}
+		if err != nil {
+			rejected[key] = v
+			reason = fmt.Errorf("Can't render the topic of the %s/%s-%s: %s", v.Namespace, v.PodName, v.Container, err.Error())
+			continue
+		}
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+
+		msg := &sarama.ProducerMessage{
+			Topic:    topic,
+			Value:    sarama.ByteEncoder(data),
+			Metadata: key,
+		}
+		switch k.key {
+		case POD_PARTITION_KEY:
+			msg.Key = sarama.StringEncoder(v.Namespace + "/" + v.PodName)
+		case CONTAINER_PARTITION_KEY:
+			msg.Key = sarama.StringEncoder(v.Namespace + "/" + v.PodName + "/" + v.Container)
+		}
+		msgs = append(msgs, msg)
+	}
+
+	var err error
+	if len(msgs) > 0 {
+		log.Infof("Sending %d messages to the Kafka", len(msgs))
+		err = k.Producer.SendMessages(msgs)
+	}
+	if err == nil && len(rejected) == 0 {
+		return nil
+	}
+
+	perrs, ok := err.(sarama.ProducerErrors)
+	if err != nil && !ok {
+		return err
+	}
+	failed := make(map[int64]LogMessage)
+	for _, perr := range perrs {
+		key, ok := perr.Msg.Metadata.(int64)
+		if !ok {
+			continue
+		}
+		switch perr.Err {
+		case sarama.ErrInvalidTopic, sarama.ErrMessageSizeTooLarge, sarama.ErrInvalidMessage:
+			rejected[key] = l[key]
+		default:
+			failed[key] = l[key]
+		}
+		reason = perr.Err
+	}
+	return &PushError{
+		Failed:   failed,
+		Rejected: rejected,
+		Err: fmt.Errorf("%d of %d messages rejected by the Kafka: %s",
+			len(failed)+len(rejected), len(l), reason.Error()),
+	}
+}
+
+// scramSHA512 is missing in the scram package
+var scramSHA512 scram.HashGeneratorFcn = func() hash.Hash { return sha512.New() }
+
+// scramClient is the SCRAM conversation for the sarama SASL
+type scramClient struct {
+	*scram.Client
+	*scram.ClientConversation
+	scram.HashGeneratorFcn
+}
+
+func (s *scramClient) Begin(user, password, authzID string) (err error) {
+	s.Client, err = s.HashGeneratorFcn.NewClient(user, password, authzID)
+	if err != nil {
+		return err
+	}
+	s.ClientConversation = s.Client.NewConversation()
+	return nil
+}
+
+func (s *scramClient) Step(challenge string) (string, error) {
+	return s.ClientConversation.Step(challenge)
+}
+
+func (s *scramClient) Done() bool {
+	return s.ClientConversation.Done()
+}
+
+// messageTemplate renders the strings like the topic names from the message
+type messageTemplate struct {
+	text string
+	tmpl *template.Template
+}
+
+// messageTemplateData is the data of the message template
+type messageTemplateData struct {
+	Namespace string
+	PodName   string
+	Container string
+	Labels    map[string]string
+	Fields    map[string]interface{}
+	Meta      map[string]interface{}
+	Timestamp time.Time
+}
+
+func newMessageTemplate(text string) (*messageTemplate, error) {
+	if text == "" {
+		return nil, errors.New("Empty template")
+	}
+	t := &messageTemplate{text: text}
+	if !strings.Contains(text, "{{") {
+		return t, nil
+	}
+
+	// date formats the time with the joda pattern like the elasticsearch index,
+	// e.g. `{{ date "YYYY.MM.dd" .Timestamp }}'
+	tmpl, err := template.New("").Funcs(template.FuncMap{
+		"date": jodaTime.Format,
+	}).Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	t.tmpl = tmpl
+	return t, nil
+}
+
+func (t *messageTemplate) render(l LogMessage) (string, error) {
+	if t.tmpl == nil {
+		return t.text, nil
+	}
+
+	var buf bytes.Buffer
+	err := t.tmpl.Execute(&buf, messageTemplateData{
+		Namespace: l.Namespace,
+		PodName:   l.PodName,
+		Container: l.Container,
+		Labels:    l.labels,
+		Fields:    l.Fields,
+		Meta:      l.Meta,
+		Timestamp: l.Timestamp,
+	})
+	return buf.String(), err
+}
@@ -0,0 +1,188 @@
+package beater
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/Shopify/sarama"
+)
+
+// stubProducer keeps the sent messages and fails the messages of the failed topics
+type stubProducer struct {
+	sent   []*sarama.ProducerMessage
+	failed map[string]error
+}
+
+func (p *stubProducer) SendMessages(msgs []*sarama.ProducerMessage) error {
+	p.sent = append(p.sent, msgs...)
+	var errs sarama.ProducerErrors
+	for _, msg := range msgs {
+		if err, ok := p.failed[msg.Topic]; ok {
+			errs = append(errs, &sarama.ProducerError{Msg: msg, Err: err})
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (p *stubProducer) Close() error { return nil }
+
+func newTestKafkaClient(t *testing.T, conf KafkaConfig) (*KafkaClient, *stubProducer) {
+	producer := &stubProducer{}
+	k := &KafkaClient{Producer: producer}
+	if err := k.Connect(&SenderConfig{Kafka: conf}); err != nil {
+		t.Fatal(err)
+	}
+	return k, producer
+}
+
+func TestKafkaPushOrder(t *testing.T) {
+	k, producer := newTestKafkaClient(t, KafkaConfig{Topic: "logs-{{ .Namespace }}"})
+
+	err := k.Push(map[int64]LogMessage{
+		30: {Namespace: "b", Message: "3"},
+		10: {Namespace: "a", Message: "1"},
+		20: {Namespace: "a", Message: "2"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var topics []string
+	var seqs []int64
+	for _, msg := range producer.sent {
+		topics = append(topics, msg.Topic)
+		seqs = append(seqs, msg.Metadata.(int64))
+		if msg.Key != nil {
+			t.Errorf("Key = %v, want the random partition", msg.Key)
+		}
+	}
+	if want := []string{"logs-a", "logs-a", "logs-b"}; !reflect.DeepEqual(topics, want) {
+		t.Errorf("topics = %v, want %v", topics, want)
+	}
+	if want := []int64{10, 20, 30}; !reflect.DeepEqual(seqs, want) {
+		t.Errorf("seqs = %v, want %v", seqs, want)
+	}
+}
+
+func TestKafkaPartitionKey(t *testing.T) {
+	for key, want := range map[string]string{
+		POD_PARTITION_KEY:       "ns/pod",
+		CONTAINER_PARTITION_KEY: "ns/pod/con",
+	} {
+		k, producer := newTestKafkaClient(t, KafkaConfig{Topic: "logs", PartitionKey: key})
+		if err := k.Push(map[int64]LogMessage{1: {Namespace: "ns", PodName: "pod", Container: "con"}}); err != nil {
+			t.Fatal(err)
+		}
+		got, err := producer.sent[0].Key.Encode()
+		if err != nil || string(got) != want {
+			t.Errorf("%s: Key = %q, want %q", key, got, want)
+		}
+	}
+
+	k := &KafkaClient{Producer: &stubProducer{}}
+	if err := k.Connect(&SenderConfig{Kafka: KafkaConfig{Topic: "logs", PartitionKey: "node"}}); err == nil {
+		t.Error("Connect must reject the wrong partition key")
+	}
+}
+
+func TestKafkaProducerErrors(t *testing.T) {
+	k, producer := newTestKafkaClient(t, KafkaConfig{Topic: "{{ .Namespace }}"})
+	producer.failed = map[string]error{
+		"down":  sarama.ErrNotLeaderForPartition,
+		"large": sarama.ErrMessageSizeTooLarge,
+	}
+
+	l := map[int64]LogMessage{
+		1: {Namespace: "ok"},
+		2: {Namespace: "down"},
+		3: {Namespace: "large"},
+		4: {Namespace: "ok"},
+		5: {Namespace: "down"},
+	}
+	err := k.Push(l)
+	perr, ok := err.(*PushError)
+	if !ok {
+		t.Fatalf("Push() = %v, want the PushError", err)
+	}
+	if want := map[int64]LogMessage{2: l[2], 5: l[5]}; !reflect.DeepEqual(perr.Failed, want) {
+		t.Errorf("Failed = %v, want %v", perr.Failed, want)
+	}
+	if want := map[int64]LogMessage{3: l[3]}; !reflect.DeepEqual(perr.Rejected, want) {
+		t.Errorf("Rejected = %v, want %v", perr.Rejected, want)
+	}
+
+	// Other errors fail the whole batch
+	producer.failed = nil
+	k.Producer = &failingProducer{}
+	if err := k.Push(l); err == nil || len(failedMessages(l, err)) != len(l) {
+		t.Errorf("Push() = %v, want the whole batch failed", err)
+	}
+}
+
+type failingProducer struct{}
+
+func (p *failingProducer) SendMessages([]*sarama.ProducerMessage) error {
+	return errors.New("brokers are down")
+}
+
+func (p *failingProducer) Close() error { return nil }
+
+func TestKafkaTopicRenderError(t *testing.T) {
+	k, producer := newTestKafkaClient(t, KafkaConfig{Topic: "logs-{{ .Fields.app.name }}"})
+
+	l := map[int64]LogMessage{
+		1: {Fields: map[string]interface{}{"app": map[string]interface{}{"name": "web"}}},
+		2: {Fields: map[string]interface{}{"app": "web"}},
+	}
+	err := k.Push(l)
+	perr, ok := err.(*PushError)
+	if !ok {
+		t.Fatalf("Push() = %v, want the PushError", err)
+	}
+	if len(perr.Failed) != 0 || len(perr.Rejected) != 1 || perr.Rejected[2].Fields == nil {
+		t.Errorf("Failed = %v, Rejected = %v", perr.Failed, perr.Rejected)
+	}
+	if len(producer.sent) != 1 || producer.sent[0].Topic != "logs-web" {
+		t.Errorf("sent %v", producer.sent)
+	}
+}
+
+func TestNewSaramaConfig(t *testing.T) {
+	for _, c := range []KafkaConfig{
+		{Acks: "some"},
+		{Compression: "brotli"},
+		{SASLMechanism: "GSSAPI"},
+		{Version: "latest"},
+	} {
+		if _, err := newSaramaConfig(&SenderConfig{Username: "user", Password: "pass", Kafka: c}); err == nil {
+			t.Errorf("%+v must be rejected", c)
+		}
+	}
+
+	cfg, err := newSaramaConfig(&SenderConfig{
+		Username: "user",
+		Password: "pass",
+		Kafka: KafkaConfig{
+			Acks:          "leader",
+			Compression:   "zstd",
+			Idempotent:    true,
+			SASLMechanism: sarama.SASLTypeSCRAMSHA512,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Producer.RequiredAcks != sarama.WaitForAll || cfg.Net.MaxOpenRequests != 1 {
+		t.Error("Idempotent producer must wait for all the acks of the single request")
+	}
+	if cfg.Producer.Compression != sarama.CompressionZSTD || !cfg.Version.IsAtLeast(sarama.V2_1_0_0) {
+		t.Errorf("Compression %v, version %s", cfg.Producer.Compression, cfg.Version)
+	}
+	if cfg.Net.SASL.Mechanism != sarama.SASLTypeSCRAMSHA512 || cfg.Net.SASL.SCRAMClientGeneratorFunc == nil {
+		t.Error("SCRAM-SHA-512 is not set")
+	}
+}
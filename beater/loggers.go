@@ -5,10 +5,10 @@ import (
 	"crypto/tls"
 	"encoding/json"
 	"flag"
-	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"regexp"
 	"strings"
 	"sync"
@@ -18,13 +18,11 @@ import (
 	log "github.com/sirupsen/logrus"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 )
 
 const (
-	containersErrorRe   string = `.*choose one of: \[(.*)\] .*`
 	containerCreatingRe string = `.*ContainerCreating.*`
 	TAIL_LOGS_METHOD    string = "tail"
 	FOLLOW_LOGS_METHOD  string = "follow"
@@ -32,36 +30,41 @@ const (
 )
 
 type PodLogs struct {
-	Channels      map[string]chan bool
-	Client        *kubernetes.Clientset
-	Config        *rest.Config
-	Ignored       string
-	Namespace     string
-	SkipVerify    bool
-	EnableWatcher bool
+	Client     *kubernetes.Clientset
+	Config     *rest.Config
+	Ignored    string
+	Namespace  string
+	SkipVerify bool
+
+	// Namespaces to collect logs from, Namespace is used if empty
+	Namespaces []string
+	// NamespaceSelector selects namespaces by the labels
+	NamespaceSelector string
+	// AllNamespaces enables cluster-wide logs collection
+	AllNamespaces bool
+	// Containers selects the pod containers by the names
+	Containers containerRules
 
 	getLogsMethod string
 
 	db     *memdb.MemDB
 	tick   int
 	sc     *SenderConfig
-	sender *Sender
+	router *Router
 	mux    sync.Mutex
 
+	checkpoints *Checkpoints
+	enricher    *Enricher
+	// joiners are the multiline joiners of the tailed containers
+	joiners map[string]*multiline
+
 	initTime   time.Time
 	updateTime time.Time
 }
 
-// Add adds control channel
-func (p *PodLogs) Add(pod string, ch chan bool) {
-	p.mux.Lock()
-	p.Channels[pod] = ch
-	p.mux.Unlock()
-}
-
 // Del deletes pod control channel
-func (p *PodLogs) Del(pod string) {
-	err := p.DelWatcherFromDB(pod)
+func (p *PodLogs) Del(ns, pod string) {
+	err := p.DelWatcherFromDB(ns, pod)
 	if err != nil {
 		log.Error(err)
 	}
@@ -71,59 +74,88 @@ func (p *PodLogs) Len() int {
 	return p.GetWatchersFromDBLen()
 }
 
-func (p *PodLogs) PodTicker() {
+// Dropped returns the number of the lines dropped by the outputs backpressure policies
+func (p *PodLogs) Dropped() uint64 {
+	return p.router.Dropped()
+}
+
+// Rejected returns the number of the lines dropped by the outputs
+// after the permanent errors or the exhausted retries
+func (p *PodLogs) Rejected() uint64 {
+	return p.router.Rejected()
+}
+
+// NamespacesLen returns the logwatchers count per namespace
+func (p *PodLogs) NamespacesLen() map[string]int {
+	return p.GetNamespaceWatchersFromDBLen()
+}
+
+// namespaces returns the list of namespaces to collect logs from
+func (p *PodLogs) namespaces() []string {
+	if len(p.Namespaces) > 0 {
+		return p.Namespaces
+	}
+	return []string{p.Namespace}
+}
 
-	if !p.EnableWatcher {
-		go p.sender.Ticker()
+// Start starts the outputs tickers and the pods controller.
+// It blocks forever.
+func (p *PodLogs) Start() {
+	p.router.Start()
+	if p.checkpoints != nil {
+		go p.checkpoints.Ticker(p.tick)
 	}
 
-	ticker := time.NewTicker(time.Second * time.Duration(p.tick))
-	p.updateTime = p.initTime
-	for c := range ticker.C {
-		log.Warn("New tick in pod watcher")
+	stopCh := make(chan struct{})
+	controller := newPodController(p)
+	controller.Start(stopCh)
+
+	switch p.getLogsMethod {
+	case FOLLOW_LOGS_METHOD:
+		// Logwatchers are driven by the controller
+	case TAIL_LOGS_METHOD:
+		go p.tailTicker(controller, stopCh)
+	default:
+		log.Fatalf("Unsopported get logs method `%s`!", p.getLogsMethod)
+	}
 
-		timeout := int64(10)
-		pods, err := p.Client.CoreV1().Pods(p.Namespace).List(metav1.ListOptions{TimeoutSeconds: &timeout})
-		if err != nil {
-			log.Error("Error on tick: ", c, " ", err.Error())
+	<-stopCh
+}
+
+// tailTicker gets the latest logs of the pods known by the controller
+// every tick
+func (p *PodLogs) tailTicker(controller *podController, stopCh chan struct{}) {
+	controller.WaitForCacheSync(stopCh)
+
+	ticker := time.NewTicker(time.Second * time.Duration(p.tick))
+	p.setUpdateTime(p.initTime)
+	for range ticker.C {
+		if p.router.Pressured() {
+			// The next tick collects logs since the last run
+			log.Warn("Sender buffer is above the high watermark, skipping the tick")
 			continue
 		}
+		log.Warn("New tick in pod watcher")
 
-		log.Infof("Got %d pods", len(pods.Items))
-		switch p.getLogsMethod {
-		case FOLLOW_LOGS_METHOD:
-			p.followRun(pods.Items)
-			break
-		case TAIL_LOGS_METHOD:
-			p.tailRun(pods.Items)
-			break
-		default:
-			log.Fatalf("Unsopported get logs method `%s`!", p.getLogsMethod)
-		}
-		p.updateTime = time.Now()
+		pods := controller.List()
+		log.Infof("Got %d pods", len(pods))
+		p.tailRun(pods)
+		p.setUpdateTime(time.Now())
 	}
 }
 
-// followRun runs a new gorutine for each running pod
-// or stops it if the pod is not running
-func (p *PodLogs) followRun(pods []corev1.Pod) {
-	ignored := ignoredPods(p.Ignored)
-	for _, pod := range pods {
-		if ok, watcher, err := p.IsWatcherInTheDB(pod.Name); !ok && err == nil &&
-			pod.Status.Phase == "Running" &&
-			!ignored.isIgnored(pod) && !checkAnnotation(pod.Annotations) {
-			ch, err := p.AddWatcherToDb(pod.Name)
-			if err != nil {
-				log.Error(err)
-				continue
-			}
-			go p.Run(pod.Name, ch, "")
-		} else if ok && err == nil && pod.Status.Phase != "Running" || ok && ignored.isIgnored(pod) {
-			p.Stop(watcher.Chan)
-		} else if err != nil {
-			log.Error(err)
-		}
-	}
+// lastUpdate returns the time of the last tail run. It is read
+// by the collectors of the previous instances of the restarted containers.
+func (p *PodLogs) lastUpdate() time.Time {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	return p.updateTime
+}
+
+func (p *PodLogs) setUpdateTime(t time.Time) {
+	p.mux.Lock()
+	p.updateTime = t
+	p.mux.Unlock()
 }
 
 // tailRun get the latest container logs from the since time
@@ -155,28 +187,115 @@ func (p *PodLogs) tailRun(pods []corev1.Pod) {
 	wg.Wait()
 }
 
-// getTailedLogs get pod logs from the since time
+// getTailedLogs get logs of the running pod containers from the since time
 func (p *PodLogs) getTailedLogs(pod corev1.Pod) {
-	sinceTime := &metav1.Time{p.updateTime}
+	updateTime := p.lastUpdate()
+	for _, con := range podContainers(pod) {
+		if !con.isRunning() || !p.Containers.isAllowed(con.Name) {
+			continue
+		}
 
-	opts := &corev1.PodLogOptions{}
-	opts.Follow = false
-	opts.SinceTime = sinceTime
+		sinceTime := &metav1.Time{updateTime}
+		// Resume from the checkpoint on the first tick
+		if since, ok := p.sinceTime(pod, con.Name); ok && updateTime.Equal(p.initTime) {
+			sinceTime = &metav1.Time{since}
+		}
 
-	resp, err := p.Client.CoreV1().Pods(p.Namespace).GetLogs(pod.Name, opts).Do().Raw()
+		opts := &corev1.PodLogOptions{}
+		opts.Follow = false
+		opts.Timestamps = true
+		opts.Container = con.Name
+		opts.SinceTime = sinceTime
+
+		resp, err := p.Client.CoreV1().Pods(pod.Namespace).GetLogs(pod.Name, opts).Do().Raw()
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+
+		p.proceedTailedLogs(resp, pod, con.Name, sinceTime.Time, p.tailSender(pod, con.Name))
+	}
+}
+
+// getContainerLogs gets the logs of the terminated container once.
+// Containers finished before the kubeat start are skipped if there is no checkpoint.
+func (p *PodLogs) getContainerLogs(pod corev1.Pod, con podContainer) {
+	opts := &corev1.PodLogOptions{
+		Container:  con.Name,
+		Timestamps: true,
+	}
+	since, ok := p.sinceTime(pod, con.Name)
+	if ok {
+		opts.SinceTime = &metav1.Time{since}
+	} else if con.Status.State.Terminated.FinishedAt.Time.Before(p.initTime) {
+		return
+	}
+
+	resp, err := p.Client.CoreV1().Pods(pod.Namespace).GetLogs(pod.Name, opts).Do().Raw()
 	if err != nil {
 		log.Error(err)
 		return
 	}
 
-	p.proceedTailedLogs(resp, pod.Name)
+	send, flush := p.lineSender(pod, con.Name)
+	defer flush()
+	p.proceedTailedLogs(resp, pod, con.Name, since, send)
+}
+
+// getPreviousLogs gets the logs of the crashed container instance
+// and tags them with the termination state
+func (p *PodLogs) getPreviousLogs(pod corev1.Pod, con podContainer) {
+	terminated := con.Status.LastTerminationState.Terminated
+	opts := &corev1.PodLogOptions{
+		Container:  con.Name,
+		Previous:   true,
+		Timestamps: true,
+	}
+	since, ok := p.checkpoint(pod, con.Name, terminated.ContainerID)
+	if !ok && p.getLogsMethod == TAIL_LOGS_METHOD {
+		since = p.lastUpdate()
+	}
+	if !since.IsZero() {
+		opts.SinceTime = &metav1.Time{since}
+	}
+
+	resp, err := p.Client.CoreV1().Pods(pod.Namespace).GetLogs(pod.Name, opts).Do().Raw()
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	state := &TerminatedState{
+		ExitCode:     terminated.ExitCode,
+		Signal:       terminated.Signal,
+		Reason:       terminated.Reason,
+		RestartCount: con.Status.RestartCount,
+		FinishedAt:   terminated.FinishedAt.Time,
+	}
+	log.Warnf("Collecting logs of the previous instance of the %s/%s-%s. Exit code %d, reason `%s'",
+		pod.Namespace, pod.Name, con.Name, state.ExitCode, state.Reason)
+
+	send, flush := p.lineSender(pod, con.Name)
+	defer flush()
+	for _, line := range strings.Split(string(resp), "\n") {
+		if line == "" {
+			continue
+		}
+		l := p.newLogMessage(pod, con.Name, line)
+		if !l.logTime.After(since) {
+			continue
+		}
+		l.ContainerID = terminated.ContainerID
+		l.Terminated = state
+		send(l)
+	}
 }
 
 // getWatcherTime returns LogWatcher.updateTime ot time.Time.Now()
 func (p *PodLogs) getWatcherTime(pod corev1.Pod) (time.Time, string) {
 	containers := pod.Spec.Containers
 	if len(containers) > 0 {
-		if w, err := p.GetWatcherFromDB(pod.Name + containers[0].Name); err != nil && w != nil {
+		if w, err := p.GetWatcherFromDB(pod.Namespace, pod.Name+"-"+containers[0].Name); err != nil && w != nil {
 			return w.updateTime, containers[0].Name
 		} else if err != nil {
 			log.Error(err)
@@ -185,135 +304,139 @@ func (p *PodLogs) getWatcherTime(pod corev1.Pod) (time.Time, string) {
 	return time.Now(), ""
 }
 
-// proceedTailedLogs ...
-func (p *PodLogs) proceedTailedLogs(logs []byte, pod string) {
+// proceedTailedLogs sends the log lines written after the since time
+func (p *PodLogs) proceedTailedLogs(logs []byte, pod corev1.Pod, con string, since time.Time, send func(LogMessage)) {
 	for _, line := range strings.Split(string(logs), "\n") {
-		if line != "" {
-			p.sender.Send(p.Namespace, pod, line, "")
-			log.Debugf("Line: '%s' sended. For pod %s", line, pod)
+		if line == "" {
+			continue
 		}
+		l := p.newLogMessage(pod, con, line)
+		if !l.logTime.After(since) {
+			continue
+		}
+		send(l)
+		log.Debugf("Line: '%s' sended. For pod %s/%s", line, pod.Namespace, pod.Name)
 	}
 }
 
-// Watch watches for k8s events
-// DEPRECATED
-func (p *PodLogs) Watch() {
-
-	go p.PodTicker()
-	go p.sender.Ticker()
-
-	// ignored := ignoredPods(p.Ignored)
-
-	w, err := p.Client.CoreV1().Pods(p.Namespace).Watch(metav1.ListOptions{})
-	if err != nil {
-		panic(err)
+// Close pushes or spills the buffered messages and flushes the checkpoints
+func (p *PodLogs) Close() error {
+	p.mux.Lock()
+	joiners := p.joiners
+	p.joiners = nil
+	p.mux.Unlock()
+	for _, m := range joiners {
+		m.Close()
 	}
-	ch := w.ResultChan()
 
-	for {
-		event := <-ch
-		e := marshalEvent(event)
-		name := e.Name()
-
-		log.Warn("New event received: ", event.Type)
-		switch event.Type {
-		case "MODIFIED":
-			ch := make(chan bool, 1)
-			if podCh, ok := p.Channels[name]; !ok && e.State() == "Running" {
-				p.Add(name, ch)
-				go p.Run(name, ch, "")
-			} else if ok && e.State() != "Running" {
-				p.Stop(podCh)
-			}
-		case "ADDED":
-			ch := make(chan bool, 1)
-			if _, ok := p.Channels[name]; !ok && e.State() == "Running" {
-				p.Add(name, ch)
-				go p.Run(name, ch, "")
-			}
-		case "DELETED":
-			if ch, ok := p.Channels[name]; ok {
-				p.Del(name)
-				ch <- true
-			}
-		}
+	if err := p.router.Close(); err != nil {
+		log.Error(err)
 	}
+	return p.checkpoints.Flush()
 }
 
 func (p *PodLogs) Stop(ch chan bool) {
 	ch <- true
 }
 
-func (p *PodLogs) Shutdown(pod, con string) {
-	l := fmt.Sprintf("Shutdown a watcher for `%s'", pod)
-	if con != "" {
-		l = fmt.Sprintf("Shutdown a watcher for `%s-%s'", pod, con)
-	}
-	log.Warnf(l)
-	if ok, watcher, _ := p.IsWatcherInTheDB(pod + "-" + con); ok {
-		p.Del(pod + "-" + con)
-		p.Stop(watcher.Chan)
-	}
-	if ok, watcher, _ := p.IsWatcherInTheDB(pod); ok {
-		p.Del(pod)
-		p.Stop(watcher.Chan)
+// Shutdown stops the container or the pod logwatcher if it is running
+// and flushes the multiline joiner of the tailed container
+func (p *PodLogs) Shutdown(ns, pod, con string) {
+	p.closeJoiners(ns, pod, con)
+	for _, name := range []string{pod + "-" + con, pod} {
+		if ok, watcher, _ := p.IsWatcherInTheDB(ns, name); ok {
+			log.Warnf("Shutdown a watcher for `%s/%s'", ns, name)
+			p.Del(ns, name)
+			p.Stop(watcher.Chan)
+		}
 	}
 }
 
-func (p *PodLogs) newLogRequest(pod, con string) (*http.Request, error) {
+func (p *PodLogs) newLogRequest(pod corev1.Pod, con string) (*http.Request, error) {
 	http.DefaultTransport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: p.SkipVerify}
-	podApi := p.Config.Host + "/api/v1/namespaces/" + p.Namespace + "/pods/" + pod
-	var req *http.Request
-	if con == "" {
-		r, err := http.NewRequest("GET", podApi+"/log?follow=true&tailLines=10", nil)
-		if err != nil {
-			p.Del(pod)
-			if c, ok := p.Channels[pod+"-"+con]; ok {
-				p.Stop(c)
-				p.Del(pod + "-" + con)
-			}
-			return r, err
-		}
-		req = r
-	} else {
-		r, err := http.NewRequest(
-			"GET",
-			podApi+"/log?follow=true&tailLines=10&container="+con,
-			nil)
-		if err != nil {
-			p.Del(pod)
-			if c, ok := p.Channels[pod+"-"+con]; ok {
-				p.Stop(c)
-				p.Del(pod + "-" + con)
-			}
-			return r, err
-		}
-		req = r
+	podApi := p.Config.Host + "/api/v1/namespaces/" + pod.Namespace + "/pods/" + pod.Name
+
+	query := url.Values{}
+	query.Set("follow", "true")
+	query.Set("timestamps", "true")
+	if con != "" {
+		query.Set("container", con)
+	}
+	if since, ok := p.sinceTime(pod, con); ok {
+		query.Set("sinceTime", since.UTC().Format(time.RFC3339))
+	} else if !p.startedAfterInit(pod, con) {
+		query.Set("tailLines", "10")
+	}
+
+	req, err := http.NewRequest("GET", podApi+"/log?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
 	}
 
 	req.Header.Add("Authorization", "Bearer "+p.Config.BearerToken)
 	return req, nil
 }
 
+// sinceTime returns the checkpoint of the container
+func (p *PodLogs) sinceTime(pod corev1.Pod, con string) (time.Time, bool) {
+	return p.checkpoint(pod, con, containerID(pod, con))
+}
+
+// checkpoint returns the checkpoint of the container instance in the outputs it is routed to
+func (p *PodLogs) checkpoint(pod corev1.Pod, con, id string) (time.Time, bool) {
+	return p.checkpoints.Get(pod.Namespace, pod.Name, con, id, p.router.Outputs(pod, con))
+}
+
+// startedAfterInit returns true if the container was started after the kubeat,
+// so all of its logs should be collected
+func (p *PodLogs) startedAfterInit(pod corev1.Pod, con string) bool {
+	status := containerStatus(pod, con)
+	if status == nil || status.State.Running == nil {
+		return false
+	}
+	return status.State.Running.StartedAt.Time.After(p.initTime)
+}
+
+// newLogMessage creates a message from the container log line
+// prefixed with the Kubernetes timestamp
+func (p *PodLogs) newLogMessage(pod corev1.Pod, con, line string) LogMessage {
+	now := time.Now()
+	ts, message := parseLogLine(line)
+	if ts.IsZero() {
+		ts = now
+	}
+
+	return LogMessage{
+		Namespace:   pod.Namespace,
+		PodName:     pod.Name,
+		Container:   con,
+		ContainerID: containerID(pod, con),
+		Message:     message,
+		Timestamp:   ts,
+		SenderTime:  now,
+		Meta:        p.enricher.Meta(pod, con),
+		logTime:     ts,
+		labels:      pod.Labels,
+	}
+}
+
 // Run runs the logwatcher
-func (p *PodLogs) Run(pod string, ch chan bool, con string) {
-	log.Warnf("Trying to start watcher for pod %s-%s", pod, con)
+func (p *PodLogs) Run(pod corev1.Pod, ch chan bool, con string) {
+	ns, name := pod.Namespace, pod.Name
+	log.Warnf("Trying to start watcher for pod %s/%s-%s", ns, name, con)
 	c := &http.Client{}
 
 	req, err := p.newLogRequest(pod, con)
 	if err != nil {
 		log.Error(err)
-		p.Shutdown(pod, con)
+		p.Shutdown(ns, name, con)
+		return
 	}
 
 	resp, err := c.Do(req)
 	if err != nil {
 		log.Error(err)
-		p.Del(pod)
-		if c, ok := p.Channels[pod+"-"+con]; ok {
-			p.Stop(c)
-			p.Del(pod + "-" + con)
-		}
+		p.Shutdown(ns, name, con)
 		return
 	}
 	defer resp.Body.Close()
@@ -328,92 +451,67 @@ func (p *PodLogs) Run(pod string, ch chan bool, con string) {
 		data, err := ioutil.ReadAll(resp.Body)
 		if err != nil {
 			log.Error(err)
-			p.Shutdown(pod, con)
+			p.Shutdown(ns, name, con)
 			return
 		}
 
 		log.Error(string(data))
-		if e.IsContanerCreating() {
-			log.Error("Container not created yet")
-			p.Shutdown(pod, con)
-			return
-		}
-
-		err = json.Unmarshal(data, &e)
-		if err != nil {
+		if err := json.Unmarshal(data, &e); err != nil {
 			log.Error(err)
-			p.Shutdown(pod, con)
-			return
-		}
-
-		cons := e.Containers()
-		if len(cons) > 0 {
-			for _, container := range cons {
-				ch, err := p.AddWatcherToDb(pod + "-" + con)
-				if err != nil {
-					log.Error(err)
-					continue
-				}
-				go p.Run(pod, ch, container)
-			}
+		} else if e.IsContanerCreating() {
+			log.Error("Container not created yet")
 		}
+		p.Shutdown(ns, name, con)
 		return
 	}
 
-	log.Warnf("Watcher for pod %s-%s started", pod, con)
+	// Lines of the checkpoint second are returned again
+	since, _ := p.sinceTime(pod, con)
+	send, flush := p.lineSender(pod, con)
+	defer flush()
+
+	log.Warnf("Watcher for pod %s/%s-%s started", ns, name, con)
 	reader := bufio.NewReader(resp.Body)
 	for {
 		if stop {
-			log.Warn("Stopping logwatcher for Pod: ", pod)
-			p.Shutdown(pod, con)
+			log.Warn("Stopping logwatcher for Pod: ", name)
+			p.Shutdown(ns, name, con)
 			return
 		}
+		// Stop reading the stream while the sender is behind
+		p.router.Wait()
 		line, err := reader.ReadBytes('\n')
 		if err != nil && err == io.EOF {
-			log.Errorf("Received EOF for pod %s. Shutdown logwatcher.", pod)
-			p.Shutdown(pod, con)
-			continue
+			log.Errorf("Received EOF for pod %s. Shutdown logwatcher.", name)
+			p.Shutdown(ns, name, con)
+			return
 		} else if err != nil {
-			log.Errorf("Error received %s for pod %s-%s. Shutdown logwatcher.", err.Error(), pod, con)
-			p.Shutdown(pod, con)
-			continue
+			log.Errorf("Error received %s for pod %s-%s. Shutdown logwatcher.", err.Error(), name, con)
+			p.Shutdown(ns, name, con)
+			return
 		}
 
-		p.sender.Send(p.Namespace, pod, string(line), con)
-	}
-}
-
-func (e WatchEvent) Name() string {
-	return e.Object.Metadata.Name
-}
-
-func (e WatchEvent) State() string {
-	return e.Object.Status.Phase
-}
-
-func marshalEvent(event watch.Event) WatchEvent {
-	var e WatchEvent
-
-	data, err := json.Marshal(event)
-	if err != nil {
-		log.Error(err)
-		return e
-	}
-
-	err = json.Unmarshal(data, &e)
-	if err != nil {
-		log.Error(err)
+		l := p.newLogMessage(pod, con, string(line))
+		if !l.logTime.After(since) {
+			continue
+		}
+		send(l)
 	}
-	return e
 }
 
 func NewPodLogs(namespace string, client *kubernetes.Clientset, config *rest.Config) *PodLogs {
 	podLogs := &PodLogs{
-		Namespace:     namespace,
-		Channels:      make(map[string]chan bool),
-		Client:        client,
-		Config:        config,
-		EnableWatcher: isWatcherEnabled(),
+		Namespace: namespace,
+		Client:    client,
+		Config:    config,
+
+		Namespaces:        getNamespacesFromFlags(),
+		NamespaceSelector: flag.Lookup("kube-namespace-selector").Value.String(),
+		AllNamespaces:     flag.Lookup("kube-all-namespaces").Value.String() == "true",
+		Containers: newContainerRules(
+			flag.Lookup("include-containers").Value.String(),
+			flag.Lookup("exclude-containers").Value.String(),
+		),
 
 		getLogsMethod: getLogsMethodFromFlags(),
 		tick:          GetTickFromFlags(),
@@ -428,6 +526,18 @@ func NewPodLogs(namespace string, client *kubernetes.Clientset, config *rest.Con
 	}
 	podLogs.db = db
 
+	checkpoints, err := getCheckpointsFromFlags(client, namespace)
+	if err != nil {
+		panic(err)
+	}
+	podLogs.checkpoints = checkpoints
+
+	enricher, err := getEnricherFromFlags(client)
+	if err != nil {
+		panic(err)
+	}
+	podLogs.enricher = enricher
+
 	err = podLogs.NewSender()
 	if err != nil {
 		panic(err)
@@ -460,26 +570,18 @@ func (l *LogRequestError) IsContanerCreating() bool {
 	return false
 }
 
-func (l *LogRequestError) Containers() (containers []string) {
-	re, err := regexp.Compile(containersErrorRe)
-	if err != nil {
-		log.Error(err)
-		return
-	}
-	if re.MatchString(l.Message) {
-		m := re.FindStringSubmatch(l.Message)
-		if len(m) > 1 {
-			for _, con := range strings.Split(m[1], " ") {
-				containers = append(containers, con)
-			}
-		}
-	}
-
-	return
-}
-
 // getLogsMethodFromFlags find a get-logs-method in the flags
 func getLogsMethodFromFlags() string {
 	method := flag.Lookup("get-logs-method").Value.String()
 	return method
 }
+
+// getNamespacesFromFlags find a kube-namespaces in the flags
+func getNamespacesFromFlags() (namespaces []string) {
+	for _, ns := range strings.Split(flag.Lookup("kube-namespaces").Value.String(), ",") {
+		if ns = strings.TrimSpace(ns); ns != "" {
+			namespaces = append(namespaces, ns)
+		}
+	}
+	return
+}
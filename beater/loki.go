@@ -0,0 +1,317 @@
+package beater
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/golang/snappy"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	lokiPushPath = "/loki/api/v1/push"
+
+	PROTOBUF_LOKI_FORMAT = "protobuf"
+	JSON_LOKI_FORMAT     = "json"
+
+	JSON_LINE_FORMAT    = "json"
+	MESSAGE_LINE_FORMAT = "message"
+)
+
+var (
+	lokiLabelRe       = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+	defaultLokiLabels = []string{"namespace", "pod", "container"}
+)
+
+// LokiConfig is the loki output settings. Hosts are the loki base URLs.
+type LokiConfig struct {
+	// Labels of the streams: `namespace', `pod', `container', `container_id'
+	Labels []string `json:"labels"`
+	// PodLabels are added into the stream labels with the `_' instead of the invalid characters
+	PodLabels    []string          `json:"pod_labels"`
+	StaticLabels map[string]string `json:"static_labels"`
+	TenantID     string            `json:"tenant_id"`
+	// Format is `protobuf' or `json'
+	Format string `json:"format"`
+	// LineFormat is `json' for the whole message or `message' for the message only
+	LineFormat string    `json:"line_format"`
+	Timeout    int       `json:"timeout"`
+	TLS        TLSConfig `json:"tls"`
+}
+
+type LokiClient struct {
+	Client *http.Client
+	conf   *SenderConfig
+}
+
+// lokiStream is the entries with the same labels
+type lokiStream struct {
+	labels  string
+	stream  map[string]string
+	entries []lokiEntry
+}
+
+type lokiEntry struct {
+	ts   int64
+	line string
+}
+
+func (c *LokiClient) Connect(conf *SenderConfig) error {
+	if len(conf.Hosts) == 0 {
+		return errors.New("Loki hosts are not set")
+	}
+	for _, name := range conf.Loki.Labels {
+		switch name {
+		case "namespace", "pod", "container", "container_id":
+		default:
+			return errors.New("Wrong loki label " + name)
+		}
+	}
+	switch conf.Loki.Format {
+	case "", PROTOBUF_LOKI_FORMAT, JSON_LOKI_FORMAT:
+	default:
+		return errors.New("Wrong loki format")
+	}
+	switch conf.Loki.LineFormat {
+	case "", JSON_LINE_FORMAT, MESSAGE_LINE_FORMAT:
+	default:
+		return errors.New("Wrong loki line format")
+	}
+
+	client, err := newHTTPClient(&conf.Loki.TLS, conf.Loki.Timeout)
+	if err != nil {
+		return err
+	}
+	c.Client = client
+	c.conf = conf
+	return nil
+}
+
+// Push sends the messages grouped into the streams. Loki stores the valid entries
+// and responds 400 naming the ones out of order or too far behind, such batch
+// is considered pushed. Other errors are retried on the next hosts.
+func (c *LokiClient) Push(l map[int64]LogMessage) error {
+	streams, err := c.streams(l)
+	if err != nil {
+		return err
+	}
+
+	var body []byte
+	var contentType string
+	if c.conf.Loki.Format == JSON_LOKI_FORMAT {
+		body, err = marshalLokiJSON(streams)
+		contentType = "application/json"
+	} else {
+		body = snappy.Encode(nil, marshalLokiProto(streams))
+		contentType = "application/x-protobuf"
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Sending %d messages in %d streams to the Loki", len(l), len(streams))
+	for _, host := range c.conf.Hosts {
+		err = c.push(strings.TrimRight(host, "/")+lokiPushPath, contentType, body)
+		if _, ok := err.(*PermanentError); ok || err == nil {
+			return err
+		}
+		log.Error(err)
+	}
+	return err
+}
+
+func (c *LokiClient) push(url, contentType string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if c.conf.Loki.TenantID != "" {
+		req.Header.Set("X-Scope-OrgID", c.conf.Loki.TenantID)
+	}
+	if c.conf.Username != "" {
+		req.SetBasicAuth(c.conf.Username, c.conf.Password)
+	}
+
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+
+	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		return nil
+	}
+	err = fmt.Errorf("Loki responded %d: %s", resp.StatusCode, string(data))
+	if resp.StatusCode == http.StatusBadRequest && isLokiRejected(string(data)) {
+		log.Warn("Loki refused some entries: ", string(data))
+		return nil
+	}
+	// The batch is refused by the Loki, only the rate limit is retried
+	if resp.StatusCode >= 400 && resp.StatusCode <= 499 && resp.StatusCode != http.StatusTooManyRequests {
+		return &PermanentError{Err: err}
+	}
+	return err
+}
+
+// isLokiRejected returns true if the refused entries can't be accepted in any attempt
+func isLokiRejected(body string) bool {
+	return strings.Contains(body, "out of order") || strings.Contains(body, "too far behind")
+}
+
+// streams groups the messages by the labels. Entries of the stream are sorted by the time.
+func (c *LokiClient) streams(l map[int64]LogMessage) ([]*lokiStream, error) {
+	index := make(map[string]*lokiStream)
+	var streams []*lokiStream
+	for _, key := range sortedKeys(l) {
+		m := l[key]
+
+		line := m.Message
+		if c.conf.Loki.LineFormat != MESSAGE_LINE_FORMAT {
+			data, err := json.Marshal(m)
+			if err != nil {
+				return nil, err
+			}
+			line = string(data)
+		}
+
+		labels, stream := c.labels(m)
+		s, ok := index[labels]
+		if !ok {
+			s = &lokiStream{labels: labels, stream: stream}
+			index[labels] = s
+			streams = append(streams, s)
+		}
+		s.entries = append(s.entries, lokiEntry{ts: m.Timestamp.UnixNano(), line: line})
+	}
+
+	for _, stream := range streams {
+		entries := stream.entries
+		sort.SliceStable(entries, func(i, j int) bool { return entries[i].ts < entries[j].ts })
+	}
+	return streams, nil
+}
+
+// labels returns the stream labels of the message in the `{name="value"}' form
+// and as the map
+func (c *LokiClient) labels(m LogMessage) (string, map[string]string) {
+	labels := make(map[string]string)
+	for k, v := range c.conf.Loki.StaticLabels {
+		labels[k] = v
+	}
+
+	names := c.conf.Loki.Labels
+	if len(names) == 0 {
+		names = defaultLokiLabels
+	}
+	for _, name := range names {
+		switch name {
+		case "namespace":
+			labels[name] = m.Namespace
+		case "pod":
+			labels[name] = m.PodName
+		case "container":
+			labels[name] = m.Container
+		case "container_id":
+			labels[name] = m.ContainerID
+		}
+	}
+	for _, name := range c.conf.Loki.PodLabels {
+		if v, ok := m.labels[name]; ok {
+			labels[lokiLabelRe.ReplaceAllString(name, "_")] = v
+		}
+	}
+
+	keys := make([]string, 0, len(labels))
+	for k, v := range labels {
+		if v == "" {
+			delete(labels, k)
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, k+"="+strconv.Quote(labels[k]))
+	}
+	return "{" + strings.Join(pairs, ", ") + "}", labels
+}
+
+// marshalLokiJSON encodes the streams into the JSON push request
+func marshalLokiJSON(streams []*lokiStream) ([]byte, error) {
+	type jsonStream struct {
+		Stream map[string]string `json:"stream"`
+		Values [][2]string       `json:"values"`
+	}
+
+	req := struct {
+		Streams []jsonStream `json:"streams"`
+	}{}
+	for _, stream := range streams {
+		s := jsonStream{Stream: stream.stream}
+		for _, e := range stream.entries {
+			s.Values = append(s.Values, [2]string{strconv.FormatInt(e.ts, 10), e.line})
+		}
+		req.Streams = append(req.Streams, s)
+	}
+	return json.Marshal(req)
+}
+
+// marshalLokiProto encodes the streams into the logproto.PushRequest:
+//
+//	PushRequest  { repeated Stream streams = 1; }
+//	Stream       { string labels = 1; repeated Entry entries = 2; }
+//	Entry        { google.protobuf.Timestamp timestamp = 1; string line = 2; }
+//	Timestamp    { int64 seconds = 1; int32 nanos = 2; }
+func marshalLokiProto(streams []*lokiStream) []byte {
+	var req []byte
+	for _, stream := range streams {
+		var s []byte
+		s = appendProtoBytes(s, 1, []byte(stream.labels))
+		for _, e := range stream.entries {
+			var ts []byte
+			ts = appendProtoVarint(ts, 1, uint64(e.ts/1e9))
+			ts = appendProtoVarint(ts, 2, uint64(e.ts%1e9))
+
+			var entry []byte
+			entry = appendProtoBytes(entry, 1, ts)
+			entry = appendProtoBytes(entry, 2, []byte(e.line))
+			s = appendProtoBytes(s, 2, entry)
+		}
+		req = appendProtoBytes(req, 1, s)
+	}
+	return req
+}
+
+func appendProtoVarint(b []byte, field int, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = appendUvarint(b, uint64(field)<<3)
+	return appendUvarint(b, v)
+}
+
+func appendProtoBytes(b []byte, field int, v []byte) []byte {
+	b = appendUvarint(b, uint64(field)<<3|2)
+	b = appendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(b, buf[:n]...)
+}
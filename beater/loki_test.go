@@ -0,0 +1,158 @@
+package beater
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+)
+
+// lokiTestRequest is the PushRequest of the single stream `{pod="a"}'
+// with the entry "x" at 1.000000002
+var lokiTestRequest = []byte{
+	0x0a, 0x16, // streams, 22 bytes
+	0x0a, 0x09, '{', 'p', 'o', 'd', '=', '"', 'a', '"', '}', // labels
+	0x12, 0x09, // entries, 9 bytes
+	0x0a, 0x04, 0x08, 0x01, 0x10, 0x02, // timestamp {seconds: 1, nanos: 2}
+	0x12, 0x01, 'x', // line
+}
+
+func TestMarshalLokiProto(t *testing.T) {
+	streams := []*lokiStream{{
+		labels:  `{pod="a"}`,
+		entries: []lokiEntry{{ts: 1000000002, line: "x"}},
+	}}
+	if got := marshalLokiProto(streams); !bytes.Equal(got, lokiTestRequest) {
+		t.Errorf("marshalLokiProto() = % x, want % x", got, lokiTestRequest)
+	}
+
+	// Zero fields are omitted
+	streams[0].entries[0].ts = 0
+	want := []byte{0x0a, 0x12, 0x0a, 0x09, '{', 'p', 'o', 'd', '=', '"', 'a', '"', '}',
+		0x12, 0x05, 0x0a, 0x00, 0x12, 0x01, 'x'}
+	if got := marshalLokiProto(streams); !bytes.Equal(got, want) {
+		t.Errorf("marshalLokiProto() = % x, want % x", got, want)
+	}
+}
+
+func TestAppendUvarint(t *testing.T) {
+	for v, want := range map[uint64][]byte{
+		0:     {0x00},
+		1:     {0x01},
+		127:   {0x7f},
+		128:   {0x80, 0x01},
+		300:   {0xac, 0x02},
+		16384: {0x80, 0x80, 0x01},
+	} {
+		if got := appendUvarint(nil, v); !bytes.Equal(got, want) {
+			t.Errorf("appendUvarint(%d) = % x, want % x", v, got, want)
+		}
+	}
+}
+
+func TestLokiSnappy(t *testing.T) {
+	// Short block is the length and the literal
+	want := append([]byte{0x18, 23 << 2}, lokiTestRequest...)
+	if got := snappy.Encode(nil, lokiTestRequest); !bytes.Equal(got, want) {
+		t.Errorf("snappy.Encode() = % x, want % x", got, want)
+	}
+}
+
+func newTestLokiClient(t *testing.T, hosts ...string) *LokiClient {
+	c := &LokiClient{}
+	if err := c.Connect(&SenderConfig{Hosts: hosts, Loki: LokiConfig{Labels: []string{"pod"}}}); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestLokiPush(t *testing.T) {
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != lokiPushPath || r.Header.Get("Content-Type") != "application/x-protobuf" {
+			t.Errorf("Wrong request %s %s", r.URL.Path, r.Header.Get("Content-Type"))
+		}
+		data, _ := ioutil.ReadAll(r.Body)
+		body, _ = snappy.Decode(nil, data)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	c := newTestLokiClient(t, server.URL)
+	c.conf.Loki.LineFormat = MESSAGE_LINE_FORMAT
+	err := c.Push(map[int64]LogMessage{
+		1: {PodName: "a", Message: "x", Timestamp: time.Unix(1, 2)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(body, lokiTestRequest) {
+		t.Errorf("body = % x, want % x", body, lokiTestRequest)
+	}
+}
+
+func TestLokiPushErrors(t *testing.T) {
+	var status int
+	var response string
+	var pushes int
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pushes++
+		w.WriteHeader(status)
+		w.Write([]byte(response))
+	}))
+	defer failing.Close()
+	var accepted int
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		accepted++
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ok.Close()
+
+	c := newTestLokiClient(t, failing.URL, ok.URL)
+	batch := map[int64]LogMessage{1: {PodName: "a", Message: "x", Timestamp: time.Unix(1, 0)}}
+
+	// Valid entries of the batch with the out of order ones are stored by the Loki
+	for _, response = range []string{"entry out of order for stream", "entry too far behind"} {
+		status = http.StatusBadRequest
+		if err := c.Push(batch); err != nil {
+			t.Errorf("Push() = %v, want the batch pushed", err)
+		}
+		if accepted != 0 {
+			t.Errorf("out of order batch pushed to the next host")
+		}
+	}
+
+	// The refused batch is dropped without the next hosts
+	for _, status = range []int{http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden,
+		http.StatusNotFound, http.StatusRequestEntityTooLarge} {
+		response = "error"
+		err := c.Push(batch)
+		if _, ok := err.(*PermanentError); !ok || accepted != 0 {
+			t.Errorf("%d: Push() = %v, accepted %d, want the permanent error", status, err, accepted)
+		}
+	}
+
+	// The rest are pushed to the next host
+	for _, status = range []int{http.StatusTooManyRequests, http.StatusBadGateway} {
+		accepted = 0
+		if err := c.Push(batch); err != nil || accepted != 1 {
+			t.Errorf("%d: Push() = %v, accepted %d", status, err, accepted)
+		}
+	}
+
+	// Error of the last host is returned
+	c.conf.Hosts = c.conf.Hosts[:1]
+	status = http.StatusBadGateway
+	if err := c.Push(batch); err == nil {
+		t.Error("Push() must return the error of 502")
+	} else if _, ok := err.(*PermanentError); ok {
+		t.Error("502 must be retried")
+	}
+	if pushes != 10 {
+		t.Errorf("pushes = %d, want 10", pushes)
+	}
+}
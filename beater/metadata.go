@@ -0,0 +1,259 @@
+package beater
+
+import (
+	"errors"
+	"flag"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	LABELS_ENRICHER string = "labels"
+	NODE_ENRICHER   string = "node"
+	IP_ENRICHER     string = "ip"
+	OWNER_ENRICHER  string = "owner"
+	IMAGE_ENRICHER  string = "image"
+)
+
+// Enricher populates the LogMessage.Meta with the pod metadata
+type Enricher struct {
+	Client kubernetes.Interface
+
+	Labels      bool
+	Annotations []string
+	Node        bool
+	IP          bool
+	Owner       bool
+	Image       bool
+
+	pods map[types.UID]*podMeta
+	// owners are the resolved controllers of the cached pods ReplicaSets and Jobs
+	owners map[types.UID]metav1.OwnerReference
+	mux    sync.Mutex
+}
+
+// podMeta is the cached metadata of the pod
+type podMeta struct {
+	resourceVersion string
+	meta            map[string]interface{}
+	images          map[string]corev1.ContainerStatus
+	// controller is the UID of the pod controller
+	controller types.UID
+}
+
+// NewEnricher creates the enricher from the comma separated list of enrichers
+func NewEnricher(client kubernetes.Interface, enrichers string, annotations []string) (*Enricher, error) {
+	e := &Enricher{
+		Client:      client,
+		Annotations: annotations,
+		pods:        make(map[types.UID]*podMeta),
+		owners:      make(map[types.UID]metav1.OwnerReference),
+	}
+
+	for _, name := range strings.Split(enrichers, ",") {
+		switch strings.TrimSpace(name) {
+		case "":
+		case LABELS_ENRICHER:
+			e.Labels = true
+		case NODE_ENRICHER:
+			e.Node = true
+		case IP_ENRICHER:
+			e.IP = true
+		case OWNER_ENRICHER:
+			e.Owner = true
+		case IMAGE_ENRICHER:
+			e.Image = true
+		default:
+			return nil, errors.New("Wrong enricher " + name)
+		}
+	}
+
+	return e, nil
+}
+
+// isEnabled returns true if any of the enrichers is enabled
+func (e *Enricher) isEnabled() bool {
+	return e.Labels || len(e.Annotations) > 0 || e.Node || e.IP || e.Owner || e.Image
+}
+
+// Meta returns the metadata of the pod container
+func (e *Enricher) Meta(pod corev1.Pod, con string) map[string]interface{} {
+	if e == nil || !e.isEnabled() {
+		return nil
+	}
+
+	e.mux.Lock()
+	m, ok := e.pods[pod.UID]
+	e.mux.Unlock()
+	if !ok {
+		m = e.podMeta(pod)
+	}
+
+	meta := make(map[string]interface{}, len(m.meta)+2)
+	for k, v := range m.meta {
+		meta[k] = v
+	}
+	if e.Image {
+		if status, ok := m.images[con]; ok {
+			meta["image"] = status.Image
+			meta["image_id"] = status.ImageID
+		}
+	}
+
+	return meta
+}
+
+// Update refreshes the cached pod metadata
+func (e *Enricher) Update(pod corev1.Pod) {
+	if e == nil || !e.isEnabled() {
+		return
+	}
+
+	e.mux.Lock()
+	m, ok := e.pods[pod.UID]
+	e.mux.Unlock()
+	if ok && m.resourceVersion == pod.ResourceVersion {
+		return
+	}
+	e.podMeta(pod)
+}
+
+// Forget removes the pod from the cache and its owner
+// if there are no other pods of the same controller
+func (e *Enricher) Forget(pod corev1.Pod) {
+	if e == nil {
+		return
+	}
+	e.mux.Lock()
+	defer e.mux.Unlock()
+
+	m, ok := e.pods[pod.UID]
+	delete(e.pods, pod.UID)
+	if !ok || m.controller == "" {
+		return
+	}
+	for _, other := range e.pods {
+		if other.controller == m.controller {
+			return
+		}
+	}
+	delete(e.owners, m.controller)
+}
+
+// podMeta builds and caches the pod metadata
+func (e *Enricher) podMeta(pod corev1.Pod) *podMeta {
+	m := &podMeta{
+		resourceVersion: pod.ResourceVersion,
+		meta:            make(map[string]interface{}),
+		images:          make(map[string]corev1.ContainerStatus),
+	}
+
+	if e.Labels && len(pod.Labels) > 0 {
+		m.meta["labels"] = pod.Labels
+	}
+	if len(e.Annotations) > 0 {
+		annotations := make(map[string]string)
+		for _, key := range e.Annotations {
+			if v, ok := pod.Annotations[key]; ok {
+				annotations[key] = v
+			}
+		}
+		if len(annotations) > 0 {
+			m.meta["annotations"] = annotations
+		}
+	}
+	if e.Node && pod.Spec.NodeName != "" {
+		m.meta["node_name"] = pod.Spec.NodeName
+	}
+	if e.IP && pod.Status.PodIP != "" {
+		m.meta["pod_ip"] = pod.Status.PodIP
+	}
+	if e.Owner {
+		ref := metav1.GetControllerOf(&pod)
+		if ref != nil {
+			m.controller = ref.UID
+		}
+		if owner := e.resolveOwner(pod.Namespace, ref); owner != nil {
+			m.meta["owner_kind"] = owner.Kind
+			m.meta["owner_name"] = owner.Name
+		}
+	}
+	if e.Image {
+		for _, con := range podContainers(pod) {
+			if con.Status != nil {
+				m.images[con.Name] = *con.Status
+			}
+		}
+	}
+
+	e.mux.Lock()
+	e.pods[pod.UID] = m
+	e.mux.Unlock()
+
+	return m
+}
+
+// resolveOwner returns the top level controller of the pod.
+// ReplicaSets are resolved to the Deployments and Jobs to the CronJobs.
+func (e *Enricher) resolveOwner(ns string, ref *metav1.OwnerReference) *metav1.OwnerReference {
+	if ref == nil {
+		return nil
+	}
+	if ref.Kind != "ReplicaSet" && ref.Kind != "Job" {
+		return ref
+	}
+
+	e.mux.Lock()
+	owner, ok := e.owners[ref.UID]
+	e.mux.Unlock()
+	if ok {
+		return &owner
+	}
+
+	var meta metav1.Object
+	switch ref.Kind {
+	case "ReplicaSet":
+		rs, err := e.Client.AppsV1().ReplicaSets(ns).Get(ref.Name, metav1.GetOptions{})
+		if err != nil {
+			log.Error(err)
+			return ref
+		}
+		meta = rs
+	case "Job":
+		job, err := e.Client.BatchV1().Jobs(ns).Get(ref.Name, metav1.GetOptions{})
+		if err != nil {
+			log.Error(err)
+			return ref
+		}
+		meta = job
+	}
+
+	owner = *ref
+	if top := metav1.GetControllerOf(meta); top != nil {
+		owner = *top
+	}
+
+	e.mux.Lock()
+	e.owners[ref.UID] = owner
+	e.mux.Unlock()
+
+	return &owner
+}
+
+// getEnricherFromFlags creates the enricher from the enrich flags
+func getEnricherFromFlags(client kubernetes.Interface) (*Enricher, error) {
+	var annotations []string
+	for _, key := range strings.Split(flag.Lookup("enrich-annotations").Value.String(), ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			annotations = append(annotations, key)
+		}
+	}
+
+	return NewEnricher(client, flag.Lookup("enrich").Value.String(), annotations)
+}
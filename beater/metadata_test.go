@@ -0,0 +1,55 @@
+package beater
+
+import (
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func controllerRef(kind, name string, uid types.UID) []metav1.OwnerReference {
+	controller := true
+	return []metav1.OwnerReference{{Kind: kind, Name: name, UID: uid, Controller: &controller}}
+}
+
+func TestEnricherOwners(t *testing.T) {
+	rs := &appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{
+		Name:            "web-5d4f",
+		Namespace:       "ns",
+		UID:             "rs",
+		OwnerReferences: controllerRef("Deployment", "web", "deploy"),
+	}}
+	e, err := NewEnricher(fake.NewSimpleClientset(rs), OWNER_ENRICHER, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var pods []corev1.Pod
+	for _, name := range []string{"web-5d4f-a", "web-5d4f-b"} {
+		pods = append(pods, corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+			Name:            name,
+			Namespace:       "ns",
+			UID:             types.UID(name),
+			OwnerReferences: controllerRef("ReplicaSet", "web-5d4f", "rs"),
+		}})
+	}
+	for _, pod := range pods {
+		meta := e.Meta(pod, "web")
+		if meta["owner_kind"] != "Deployment" || meta["owner_name"] != "web" {
+			t.Errorf("%s owner %v/%v", pod.Name, meta["owner_kind"], meta["owner_name"])
+		}
+	}
+
+	// The owner is kept while there are pods of the ReplicaSet
+	e.Forget(pods[0])
+	if _, ok := e.owners["rs"]; !ok {
+		t.Error("Owner is removed with the other pod cached")
+	}
+	e.Forget(pods[1])
+	if len(e.owners) != 0 || len(e.pods) != 0 {
+		t.Errorf("%d owners, %d pods left after the Forget", len(e.owners), len(e.pods))
+	}
+}
@@ -0,0 +1,311 @@
+package beater
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"time"
+)
+
+// Minimal MessagePack encoding of the forward protocol messages
+
+func appendMsgpackNil(b []byte) []byte {
+	return append(b, 0xc0)
+}
+
+func appendMsgpackBool(b []byte, v bool) []byte {
+	if v {
+		return append(b, 0xc3)
+	}
+	return append(b, 0xc2)
+}
+
+func appendMsgpackInt(b []byte, v int64) []byte {
+	switch {
+	case v >= 0 && v <= 0x7f:
+		return append(b, byte(v))
+	case v < 0 && v >= -32:
+		return append(b, byte(v))
+	case v >= math.MinInt32 && v <= math.MaxInt32:
+		b = append(b, 0xd2)
+		return appendUint32(b, uint32(v))
+	}
+	b = append(b, 0xd3)
+	return appendUint64(b, uint64(v))
+}
+
+func appendMsgpackFloat(b []byte, v float64) []byte {
+	b = append(b, 0xcb)
+	return appendUint64(b, math.Float64bits(v))
+}
+
+func appendMsgpackString(b []byte, s string) []byte {
+	n := len(s)
+	switch {
+	case n <= 31:
+		b = append(b, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		b = append(b, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		b = append(b, 0xda)
+		b = appendUint16(b, uint16(n))
+	default:
+		b = append(b, 0xdb)
+		b = appendUint32(b, uint32(n))
+	}
+	return append(b, s...)
+}
+
+func appendMsgpackBin(b []byte, v []byte) []byte {
+	n := len(v)
+	switch {
+	case n <= math.MaxUint8:
+		b = append(b, 0xc4, byte(n))
+	case n <= math.MaxUint16:
+		b = append(b, 0xc5)
+		b = appendUint16(b, uint16(n))
+	default:
+		b = append(b, 0xc6)
+		b = appendUint32(b, uint32(n))
+	}
+	return append(b, v...)
+}
+
+func appendMsgpackArrayHeader(b []byte, n int) []byte {
+	switch {
+	case n <= 15:
+		return append(b, 0x90|byte(n))
+	case n <= math.MaxUint16:
+		b = append(b, 0xdc)
+		return appendUint16(b, uint16(n))
+	}
+	b = append(b, 0xdd)
+	return appendUint32(b, uint32(n))
+}
+
+func appendMsgpackMapHeader(b []byte, n int) []byte {
+	switch {
+	case n <= 15:
+		return append(b, 0x80|byte(n))
+	case n <= math.MaxUint16:
+		b = append(b, 0xde)
+		return appendUint16(b, uint16(n))
+	}
+	b = append(b, 0xdf)
+	return appendUint32(b, uint32(n))
+}
+
+// appendMsgpackEventTime appends the fluentd EventTime extension
+func appendMsgpackEventTime(b []byte, t time.Time) []byte {
+	b = append(b, 0xd7, 0x00)
+	b = appendUint32(b, uint32(t.Unix()))
+	return appendUint32(b, uint32(t.Nanosecond()))
+}
+
+// appendMsgpackValue appends the value decoded from the JSON
+func appendMsgpackValue(b []byte, v interface{}) []byte {
+	switch v := v.(type) {
+	case nil:
+		return appendMsgpackNil(b)
+	case bool:
+		return appendMsgpackBool(b, v)
+	case string:
+		return appendMsgpackString(b, v)
+	case float64:
+		if v == math.Trunc(v) && v >= math.MinInt64 && v < math.MaxInt64 {
+			return appendMsgpackInt(b, int64(v))
+		}
+		return appendMsgpackFloat(b, v)
+	case []interface{}:
+		b = appendMsgpackArrayHeader(b, len(v))
+		for _, item := range v {
+			b = appendMsgpackValue(b, item)
+		}
+		return b
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		b = appendMsgpackMapHeader(b, len(keys))
+		for _, k := range keys {
+			b = appendMsgpackString(b, k)
+			b = appendMsgpackValue(b, v[k])
+		}
+		return b
+	}
+	return appendMsgpackString(b, fmt.Sprint(v))
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	var buf [2]byte
+	binary.BigEndian.PutUint16(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+// readMsgpack decodes the single value. Strings and binaries are returned
+// as the string, maps as the map[string]interface{}, extensions are skipped.
+func readMsgpack(r *bufio.Reader) (interface{}, error) {
+	c, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case c <= 0x7f:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c&0xf0 == 0x80:
+		return readMsgpackMap(r, int(c&0x0f))
+	case c&0xf0 == 0x90:
+		return readMsgpackArray(r, int(c&0x0f))
+	case c&0xe0 == 0xa0:
+		return readMsgpackString(r, int(c&0x1f))
+	}
+
+	switch c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xd9:
+		n, err := readMsgpackUint(r, 1)
+		if err != nil {
+			return nil, err
+		}
+		return readMsgpackString(r, int(n))
+	case 0xc5, 0xda:
+		n, err := readMsgpackUint(r, 2)
+		if err != nil {
+			return nil, err
+		}
+		return readMsgpackString(r, int(n))
+	case 0xc6, 0xdb:
+		n, err := readMsgpackUint(r, 4)
+		if err != nil {
+			return nil, err
+		}
+		return readMsgpackString(r, int(n))
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		v, err := readMsgpackUint(r, 1<<(c-0xcc))
+		return int64(v), err
+	case 0xd0:
+		v, err := readMsgpackUint(r, 1)
+		return int64(int8(v)), err
+	case 0xd1:
+		v, err := readMsgpackUint(r, 2)
+		return int64(int16(v)), err
+	case 0xd2:
+		v, err := readMsgpackUint(r, 4)
+		return int64(int32(v)), err
+	case 0xd3:
+		v, err := readMsgpackUint(r, 8)
+		return int64(v), err
+	case 0xca:
+		v, err := readMsgpackUint(r, 4)
+		return float64(math.Float32frombits(uint32(v))), err
+	case 0xcb:
+		v, err := readMsgpackUint(r, 8)
+		return math.Float64frombits(v), err
+	case 0xdc:
+		n, err := readMsgpackUint(r, 2)
+		if err != nil {
+			return nil, err
+		}
+		return readMsgpackArray(r, int(n))
+	case 0xdd:
+		n, err := readMsgpackUint(r, 4)
+		if err != nil {
+			return nil, err
+		}
+		return readMsgpackArray(r, int(n))
+	case 0xde:
+		n, err := readMsgpackUint(r, 2)
+		if err != nil {
+			return nil, err
+		}
+		return readMsgpackMap(r, int(n))
+	case 0xdf:
+		n, err := readMsgpackUint(r, 4)
+		if err != nil {
+			return nil, err
+		}
+		return readMsgpackMap(r, int(n))
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		_, err := r.Discard(1 + 1<<(c-0xd4))
+		return nil, err
+	case 0xc7, 0xc8, 0xc9:
+		n, err := readMsgpackUint(r, 1<<(c-0xc7))
+		if err != nil {
+			return nil, err
+		}
+		_, err = r.Discard(int(n) + 1)
+		return nil, err
+	}
+	return nil, fmt.Errorf("Wrong msgpack type 0x%x", c)
+}
+
+func readMsgpackUint(r *bufio.Reader, size int) (uint64, error) {
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return 0, err
+	}
+	var v uint64
+	for _, c := range buf {
+		v = v<<8 | uint64(c)
+	}
+	return v, nil
+}
+
+func readMsgpackString(r *bufio.Reader, n int) (string, error) {
+	buf := make([]byte, n)
+	_, err := io.ReadFull(r, buf)
+	return string(buf), err
+}
+
+func readMsgpackArray(r *bufio.Reader, n int) ([]interface{}, error) {
+	items := make([]interface{}, 0, n)
+	for i := 0; i < n; i++ {
+		v, err := readMsgpack(r)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, v)
+	}
+	return items, nil
+}
+
+func readMsgpackMap(r *bufio.Reader, n int) (map[string]interface{}, error) {
+	m := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		k, err := readMsgpack(r)
+		if err != nil {
+			return nil, err
+		}
+		v, err := readMsgpack(r)
+		if err != nil {
+			return nil, err
+		}
+		m[fmt.Sprint(k)] = v
+	}
+	return m, nil
+}
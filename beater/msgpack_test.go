@@ -0,0 +1,112 @@
+package beater
+
+import (
+	"bufio"
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAppendMsgpack(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		got  []byte
+		want []byte
+	}{
+		{"nil", appendMsgpackNil(nil), []byte{0xc0}},
+		{"false", appendMsgpackBool(nil, false), []byte{0xc2}},
+		{"true", appendMsgpackBool(nil, true), []byte{0xc3}},
+		{"0", appendMsgpackInt(nil, 0), []byte{0x00}},
+		{"127", appendMsgpackInt(nil, 127), []byte{0x7f}},
+		{"128", appendMsgpackInt(nil, 128), []byte{0xd2, 0x00, 0x00, 0x00, 0x80}},
+		{"-1", appendMsgpackInt(nil, -1), []byte{0xff}},
+		{"-32", appendMsgpackInt(nil, -32), []byte{0xe0}},
+		{"-33", appendMsgpackInt(nil, -33), []byte{0xd2, 0xff, 0xff, 0xff, 0xdf}},
+		{"1<<32", appendMsgpackInt(nil, 1<<32), []byte{0xd3, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00}},
+		{"1.5", appendMsgpackFloat(nil, 1.5), []byte{0xcb, 0x3f, 0xf8, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}},
+		{"empty string", appendMsgpackString(nil, ""), []byte{0xa0}},
+		{"fixstr", appendMsgpackString(nil, "abc"), []byte{0xa3, 'a', 'b', 'c'}},
+		{"str8", appendMsgpackString(nil, strings.Repeat("a", 32))[:2], []byte{0xd9, 0x20}},
+		{"str16", appendMsgpackString(nil, strings.Repeat("a", 256))[:3], []byte{0xda, 0x01, 0x00}},
+		{"str32", appendMsgpackString(nil, strings.Repeat("a", 65536))[:5], []byte{0xdb, 0x00, 0x01, 0x00, 0x00}},
+		{"bin8", appendMsgpackBin(nil, []byte{1}), []byte{0xc4, 0x01, 0x01}},
+		{"bin16", appendMsgpackBin(nil, make([]byte, 256))[:3], []byte{0xc5, 0x01, 0x00}},
+		{"fixarray", appendMsgpackArrayHeader(nil, 15), []byte{0x9f}},
+		{"array16", appendMsgpackArrayHeader(nil, 16), []byte{0xdc, 0x00, 0x10}},
+		{"array32", appendMsgpackArrayHeader(nil, 65536), []byte{0xdd, 0x00, 0x01, 0x00, 0x00}},
+		{"fixmap", appendMsgpackMapHeader(nil, 1), []byte{0x81}},
+		{"map16", appendMsgpackMapHeader(nil, 16), []byte{0xde, 0x00, 0x10}},
+		{"event time", appendMsgpackEventTime(nil, time.Unix(1, 2)),
+			[]byte{0xd7, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x02}},
+		{"value", appendMsgpackValue(nil, map[string]interface{}{
+			"b": float64(1),
+			"a": []interface{}{true, nil, 0.5},
+		}), []byte{0x82,
+			0xa1, 'a', 0x93, 0xc3, 0xc0, 0xcb, 0x3f, 0xe0, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+			0xa1, 'b', 0x01}},
+	} {
+		if !bytes.Equal(c.got, c.want) {
+			t.Errorf("%s: % x, want % x", c.name, c.got, c.want)
+		}
+	}
+}
+
+func TestReadMsgpack(t *testing.T) {
+	for _, c := range []struct {
+		data []byte
+		want interface{}
+	}{
+		{[]byte{0xc0}, nil},
+		{[]byte{0xc3}, true},
+		{[]byte{0x05}, int64(5)},
+		{[]byte{0xf0}, int64(-16)},
+		{[]byte{0xcc, 0xff}, int64(255)},
+		{[]byte{0xcd, 0x01, 0x00}, int64(256)},
+		{[]byte{0xce, 0x00, 0x01, 0x00, 0x00}, int64(65536)},
+		{[]byte{0xd0, 0x80}, int64(-128)},
+		{[]byte{0xd1, 0xff, 0x00}, int64(-256)},
+		{[]byte{0xca, 0x3f, 0xc0, 0x00, 0x00}, 1.5},
+		{[]byte{0xa2, 'o', 'k'}, "ok"},
+		{[]byte{0xc4, 0x02, 'o', 'k'}, "ok"},
+		{[]byte{0x92, 0x01, 0xa1, 'a'}, []interface{}{int64(1), "a"}},
+		{[]byte{0x81, 0xa3, 'a', 'c', 'k', 0xa1, 'x'}, map[string]interface{}{"ack": "x"}},
+		// Extensions are skipped
+		{[]byte{0x92, 0xd7, 0x00, 0, 0, 0, 1, 0, 0, 0, 2, 0x01}, []interface{}{nil, int64(1)}},
+		{[]byte{0xc7, 0x01, 0x05, 0xff}, nil},
+	} {
+		got, err := readMsgpack(bufio.NewReader(bytes.NewReader(c.data)))
+		if err != nil || !reflect.DeepEqual(got, c.want) {
+			t.Errorf("readMsgpack(% x) = %#v, %v, want %#v", c.data, got, err, c.want)
+		}
+	}
+
+	if _, err := readMsgpack(bufio.NewReader(bytes.NewReader([]byte{0xc1}))); err == nil {
+		t.Error("0xc1 must be rejected")
+	}
+	if _, err := readMsgpack(bufio.NewReader(bytes.NewReader([]byte{0xa3, 'a'}))); err == nil {
+		t.Error("Short string must be rejected")
+	}
+}
+
+func TestMsgpackRoundTrip(t *testing.T) {
+	v := map[string]interface{}{
+		"message": strings.Repeat("x", 300),
+		"fields":  map[string]interface{}{"n": int64(-1000), "ok": false},
+		"list":    []interface{}{"a", int64(1 << 40)},
+	}
+	var b []byte
+	b = appendMsgpackMapHeader(b, 3)
+	b = appendMsgpackString(b, "message")
+	b = appendMsgpackString(b, v["message"].(string))
+	b = appendMsgpackString(b, "fields")
+	b = appendMsgpackValue(b, map[string]interface{}{"n": float64(-1000), "ok": false})
+	b = appendMsgpackString(b, "list")
+	b = appendMsgpackValue(b, []interface{}{"a", float64(1 << 40)})
+
+	got, err := readMsgpack(bufio.NewReader(bytes.NewReader(b)))
+	if err != nil || !reflect.DeepEqual(got, v) {
+		t.Errorf("readMsgpack() = %#v, %v, want %#v", got, err, v)
+	}
+}
@@ -0,0 +1,255 @@
+package beater
+
+import (
+	"encoding/json"
+	"flag"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	multiline_annotation_key = "kubeat-multiline"
+	DEFAULT_MULTILINE_LINES  = 500
+)
+
+// MultilineConfig describes how the lines are joined into the single event.
+// The line starts a new event if it matches the StartPattern or
+// does not match the ContinuationPattern. Negate inverts the patterns match.
+type MultilineConfig struct {
+	StartPattern        string `json:"start_pattern"`
+	ContinuationPattern string `json:"continuation_pattern"`
+	Negate              bool   `json:"negate"`
+	MaxLines            int    `json:"max_lines"`
+	// FlushTimeout in seconds
+	FlushTimeout int `json:"flush_timeout"`
+}
+
+func (c *MultilineConfig) isEnabled() bool {
+	return c != nil && (c.StartPattern != "" || c.ContinuationPattern != "")
+}
+
+// multiline joins the lines of the single container stream
+type multiline struct {
+	start   *regexp.Regexp
+	cont    *regexp.Regexp
+	negate  bool
+	max     int
+	timeout time.Duration
+
+	send    func(LogMessage)
+	pending *LogMessage
+	lines   []string
+	timer   *time.Timer
+	mux     sync.Mutex
+}
+
+func newMultiline(conf *MultilineConfig, send func(LogMessage)) (*multiline, error) {
+	m := &multiline{
+		negate:  conf.Negate,
+		max:     conf.MaxLines,
+		timeout: time.Second * time.Duration(conf.FlushTimeout),
+		send:    send,
+	}
+	if m.max <= 0 {
+		m.max = DEFAULT_MULTILINE_LINES
+	}
+	if m.timeout <= 0 {
+		m.timeout = time.Second * 5
+	}
+
+	var err error
+	if conf.StartPattern != "" {
+		if m.start, err = regexp.Compile(conf.StartPattern); err != nil {
+			return nil, err
+		}
+	}
+	if conf.ContinuationPattern != "" {
+		if m.cont, err = regexp.Compile(conf.ContinuationPattern); err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+// isStart returns true if the line starts a new event
+func (m *multiline) isStart(line string) bool {
+	if m.start != nil && m.start.MatchString(line) != m.negate {
+		return true
+	}
+	if m.cont != nil {
+		return m.cont.MatchString(line) == m.negate
+	}
+	return false
+}
+
+// Add appends the line to the pending event or flushes it and starts a new one
+func (m *multiline) Add(l LogMessage) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	if m.pending != nil && (m.isStart(l.Message) || len(m.lines) >= m.max) {
+		m.flushLocked()
+	}
+
+	if m.pending == nil {
+		m.pending = &l
+		m.lines = []string{l.Message}
+	} else {
+		m.lines = append(m.lines, l.Message)
+		// The event is checkpointed at its last line,
+		// so the joined lines are not read again after the restart
+		m.pending.logTime = l.logTime
+	}
+
+	if m.timer == nil {
+		m.timer = time.AfterFunc(m.timeout, m.Flush)
+	} else {
+		m.timer.Reset(m.timeout)
+	}
+}
+
+// Flush sends the pending event
+func (m *multiline) Flush() {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.flushLocked()
+}
+
+func (m *multiline) flushLocked() {
+	if m.pending == nil {
+		return
+	}
+
+	l := *m.pending
+	l.Message = strings.Join(m.lines, "\n")
+	m.pending = nil
+	m.lines = nil
+	m.send(l)
+}
+
+// Close flushes the pending event and stops the flush timer
+func (m *multiline) Close() {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	if m.timer != nil {
+		m.timer.Stop()
+	}
+	m.flushLocked()
+}
+
+// getMultilineConfig returns the multiline config of the pod container.
+// Annotations `kubeat-multiline.<container>' and `kubeat-multiline'
+// take precedence over the multiline flag.
+func getMultilineConfig(pod corev1.Pod, con string) (*MultilineConfig, error) {
+	data, ok := pod.Annotations[multiline_annotation_key+"."+con]
+	if !ok {
+		data, ok = pod.Annotations[multiline_annotation_key]
+	}
+	if !ok {
+		data = flag.Lookup("multiline").Value.String()
+	}
+	if data == "" {
+		return nil, nil
+	}
+
+	conf := &MultilineConfig{}
+	if err := json.Unmarshal([]byte(data), conf); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+// lineSender returns the function sending messages of the pod container
+// through the multiline joiner and the decoder if they are configured,
+// and the function flushing the joiner
+func (p *PodLogs) lineSender(pod corev1.Pod, con string) (func(LogMessage), func()) {
+	send, m := p.newLineSender(pod, con)
+	if m == nil {
+		return send, func() {}
+	}
+	return m.Add, m.Close
+}
+
+// tailSender returns the function sending messages of the pod container
+// polled by the tail ticker. The multiline joiner is kept between the ticks,
+// so the events are not split by the polls. It is flushed by the timeout
+// or closed when the container is restarted or shut down.
+func (p *PodLogs) tailSender(pod corev1.Pod, con string) func(LogMessage) {
+	key := checkpointKey(pod.Namespace, pod.Name, con, containerID(pod, con), "")
+
+	p.mux.Lock()
+	if m, ok := p.joiners[key]; ok {
+		p.mux.Unlock()
+		return m.Add
+	}
+	p.mux.Unlock()
+
+	// The joiners of the previous container instances are not needed anymore
+	p.closeJoiners(pod.Namespace, pod.Name, con)
+
+	send, m := p.newLineSender(pod, con)
+	if m == nil {
+		return send
+	}
+	p.mux.Lock()
+	if p.joiners == nil {
+		p.joiners = make(map[string]*multiline)
+	}
+	p.joiners[key] = m
+	p.mux.Unlock()
+	return m.Add
+}
+
+// closeJoiners flushes and forgets the tail joiners of the pod container
+func (p *PodLogs) closeJoiners(ns, pod, con string) {
+	prefix := strings.Join([]string{ns, pod, con, ""}, "/")
+
+	var closed []*multiline
+	p.mux.Lock()
+	for key, m := range p.joiners {
+		if strings.HasPrefix(key, prefix) {
+			closed = append(closed, m)
+			delete(p.joiners, key)
+		}
+	}
+	p.mux.Unlock()
+
+	for _, m := range closed {
+		m.Close()
+	}
+}
+
+// newLineSender returns the function sending messages through the decoder
+// and the multiline joiner of the pod container if it is configured
+func (p *PodLogs) newLineSender(pod corev1.Pod, con string) (func(LogMessage), *multiline) {
+	send := p.router.SendMessage
+	if decoder := getDecoder(pod, con); decoder != "" && decoder != NONE_DECODER {
+		send = func(l LogMessage) {
+			decodeMessage(&l, decoder)
+			p.router.SendMessage(l)
+		}
+	}
+
+	conf, err := getMultilineConfig(pod, con)
+	if err != nil {
+		log.Errorf("Wrong multiline config of the %s/%s-%s: %s", pod.Namespace, pod.Name, con, err.Error())
+		return send, nil
+	}
+	if !conf.isEnabled() {
+		return send, nil
+	}
+
+	m, err := newMultiline(conf, send)
+	if err != nil {
+		log.Errorf("Wrong multiline pattern of the %s/%s-%s: %s", pod.Namespace, pod.Name, con, err.Error())
+		return send, nil
+	}
+	return send, m
+}
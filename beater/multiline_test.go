@@ -0,0 +1,172 @@
+package beater
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// joinLines sends the lines through the multiline and returns the events
+func joinLines(t *testing.T, conf *MultilineConfig, lines ...string) []LogMessage {
+	var events []LogMessage
+	m, err := newMultiline(conf, func(l LogMessage) { events = append(events, l) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, line := range lines {
+		m.Add(LogMessage{Message: line, logTime: time.Unix(int64(i), 0)})
+	}
+	m.Close()
+	return events
+}
+
+func eventMessages(events []LogMessage) []string {
+	var messages []string
+	for _, l := range events {
+		messages = append(messages, l.Message)
+	}
+	return messages
+}
+
+func TestMultilinePatterns(t *testing.T) {
+	trace := []string{
+		"2021-03-14 ERROR failed",
+		"java.lang.NullPointerException",
+		"\tat com.example.Main.run(Main.java:10)",
+		"2021-03-14 INFO done",
+	}
+	for _, c := range []struct {
+		name string
+		conf MultilineConfig
+		want []string
+	}{
+		{"start", MultilineConfig{StartPattern: `^\d{4}-`}, []string{
+			"2021-03-14 ERROR failed\njava.lang.NullPointerException\n\tat com.example.Main.run(Main.java:10)",
+			"2021-03-14 INFO done",
+		}},
+		{"continuation", MultilineConfig{ContinuationPattern: `^\s`}, []string{
+			"2021-03-14 ERROR failed",
+			"java.lang.NullPointerException\n\tat com.example.Main.run(Main.java:10)",
+			"2021-03-14 INFO done",
+		}},
+		{"negated start", MultilineConfig{StartPattern: `^(\s|java)`, Negate: true}, []string{
+			"2021-03-14 ERROR failed\njava.lang.NullPointerException\n\tat com.example.Main.run(Main.java:10)",
+			"2021-03-14 INFO done",
+		}},
+		{"max lines", MultilineConfig{StartPattern: `^\d{4}-`, MaxLines: 2}, []string{
+			"2021-03-14 ERROR failed\njava.lang.NullPointerException",
+			"\tat com.example.Main.run(Main.java:10)",
+			"2021-03-14 INFO done",
+		}},
+	} {
+		if got := eventMessages(joinLines(t, &c.conf, trace...)); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: %q, want %q", c.name, got, c.want)
+		}
+	}
+}
+
+func TestMultilineLogTime(t *testing.T) {
+	events := joinLines(t, &MultilineConfig{StartPattern: `^\S`}, "a", " b", " c", "d")
+	if len(events) != 2 {
+		t.Fatalf("%d events, want 2", len(events))
+	}
+	// The event is checkpointed at the last line
+	if !events[0].logTime.Equal(time.Unix(2, 0)) || !events[1].logTime.Equal(time.Unix(3, 0)) {
+		t.Errorf("log times %v, %v", events[0].logTime, events[1].logTime)
+	}
+}
+
+func TestMultilineFlushTimeout(t *testing.T) {
+	events := make(chan LogMessage, 1)
+	m, err := newMultiline(&MultilineConfig{StartPattern: `^\S`}, func(l LogMessage) { events <- l })
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.timeout = 10 * time.Millisecond
+	defer m.Close()
+
+	m.Add(LogMessage{Message: "a"})
+	m.Add(LogMessage{Message: " b"})
+	select {
+	case l := <-events:
+		if l.Message != "a\n b" {
+			t.Errorf("Message = %q", l.Message)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Pending event is not flushed by the timeout")
+	}
+}
+
+func TestMultilineWrongPattern(t *testing.T) {
+	if _, err := newMultiline(&MultilineConfig{StartPattern: "("}, func(LogMessage) {}); err == nil {
+		t.Error("Wrong pattern must be rejected")
+	}
+}
+
+func TestGetMultilineConfig(t *testing.T) {
+	pod := corev1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{
+		multiline_annotation_key:          `{"start_pattern": "^\\S"}`,
+		multiline_annotation_key + ".app": `{"continuation_pattern": "^\\s", "max_lines": 10}`,
+	}}}
+	conf, err := getMultilineConfig(pod, "app")
+	if err != nil || conf.ContinuationPattern != `^\s` || conf.MaxLines != 10 {
+		t.Errorf("app config %+v, %v", conf, err)
+	}
+	conf, err = getMultilineConfig(pod, "sidecar")
+	if err != nil || conf.StartPattern != `^\S` {
+		t.Errorf("sidecar config %+v, %v", conf, err)
+	}
+}
+
+func TestTailSender(t *testing.T) {
+	route, _ := newRoute(nil)
+	sender := &Sender{
+		name:   "es",
+		Config: &SenderConfig{Limit: 100, BatchBytes: DEFAULT_BATCH_BYTES},
+		buffer: newTestBuffer(100, BLOCK_POLICY, nil),
+	}
+	db, err := NewDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &PodLogs{db: db, router: &Router{outputs: []*output{{sender: sender, route: route}}}}
+	pod := corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "pod", Annotations: map[string]string{
+			multiline_annotation_key: `{"start_pattern": "^\\S"}`,
+			decode_annotation_key:    NONE_DECODER,
+		}},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "app"}}},
+		Status: corev1.PodStatus{
+			ContainerStatuses: []corev1.ContainerStatus{{Name: "app", ContainerID: "docker://a"}},
+		},
+	}
+
+	// The event is not split by the ticks
+	p.tailSender(pod, "app")(LogMessage{Message: "panic"})
+	p.tailSender(pod, "app")(LogMessage{Message: " at main"})
+	if n, _ := sender.buffer.Len(); n != 0 {
+		t.Fatalf("%d messages are sent before the event is finished", n)
+	}
+	p.tailSender(pod, "app")(LogMessage{Message: "next"})
+
+	// The joiner of the restarted container is flushed
+	pod.Status.ContainerStatuses[0].ContainerID = "docker://b"
+	p.tailSender(pod, "app")(LogMessage{Message: "restarted"})
+	want := []string{"panic\n at main", "next"}
+	if got := bufferMessages(sender.buffer.Peek(10, DEFAULT_BATCH_BYTES)); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Sent %q, want %q", got, want)
+	}
+
+	// The container going away flushes the pending event
+	p.Shutdown("ns", "pod", "app")
+	want = append(want, "restarted")
+	if got := bufferMessages(sender.buffer.Peek(10, DEFAULT_BATCH_BYTES)); !reflect.DeepEqual(got, want) {
+		t.Errorf("Sent %q after the shutdown, want %q", got, want)
+	}
+	if len(p.joiners) != 0 {
+		t.Errorf("Joiners %v are not forgotten", p.joiners)
+	}
+}
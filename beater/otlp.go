@@ -0,0 +1,478 @@
+package beater
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/http2"
+)
+
+const (
+	GRPC_OTLP_PROTOCOL = "grpc"
+	HTTP_OTLP_PROTOCOL = "http"
+
+	otlpHTTPPath = "/v1/logs"
+	otlpGRPCPath = "/opentelemetry.proto.collector.logs.v1.LogsService/Export"
+)
+
+var (
+	otlpLevelRe = regexp.MustCompile(`(?i)\b(trace|debug|info|notice|warn|warning|err|error|crit|critical|alert|emerg|fatal|panic)\b`)
+
+	// otlpOwnerKinds are the owners with the semantic convention attributes
+	otlpOwnerKinds = map[string]string{
+		"Deployment":  "k8s.deployment.name",
+		"StatefulSet": "k8s.statefulset.name",
+		"DaemonSet":   "k8s.daemonset.name",
+		"ReplicaSet":  "k8s.replicaset.name",
+		"Job":         "k8s.job.name",
+		"CronJob":     "k8s.cronjob.name",
+	}
+)
+
+// OTLPConfig is the OpenTelemetry logs output settings. Hosts are the collector
+// base URLs, e.g. `http://otel-collector:4317' for the gRPC
+// or `http://otel-collector:4318' for the HTTP.
+type OTLPConfig struct {
+	// Protocol is `grpc' or `http'
+	Protocol string            `json:"protocol"`
+	Headers  map[string]string `json:"headers"`
+	// ResourceAttributes are added to the every resource, e.g. `k8s.cluster.name'
+	ResourceAttributes map[string]string `json:"resource_attributes"`
+	Gzip               bool              `json:"gzip"`
+	Timeout            int               `json:"timeout"`
+	TLS                TLSConfig         `json:"tls"`
+}
+
+type OTLPClient struct {
+	Client *http.Client
+	conf   *SenderConfig
+}
+
+// otlpResource is the log records of the same container
+type otlpResource struct {
+	attributes []byte
+	records    []byte
+}
+
+func (c *OTLPClient) Connect(conf *SenderConfig) error {
+	if len(conf.Hosts) == 0 {
+		return errors.New("OTLP hosts are not set")
+	}
+	if conf.OTLP.Protocol == "" {
+		conf.OTLP.Protocol = GRPC_OTLP_PROTOCOL
+	}
+
+	switch conf.OTLP.Protocol {
+	case HTTP_OTLP_PROTOCOL:
+		client, err := newHTTPClient(&conf.OTLP.TLS, conf.OTLP.Timeout)
+		if err != nil {
+			return err
+		}
+		c.Client = client
+	case GRPC_OTLP_PROTOCOL:
+		client, err := newGRPCClient(&conf.OTLP.TLS, conf.OTLP.Timeout)
+		if err != nil {
+			return err
+		}
+		c.Client = client
+	default:
+		return errors.New("Wrong otlp protocol")
+	}
+	c.conf = conf
+	return nil
+}
+
+// newGRPCClient creates the HTTP/2 client, the prior knowledge HTTP/2
+// is used if the TLS is disabled
+func newGRPCClient(c *TLSConfig, timeout int) (*http.Client, error) {
+	tlsConfig, err := c.build()
+	if err != nil {
+		return nil, err
+	}
+	if timeout <= 0 {
+		timeout = 30
+	}
+
+	transport := &http2.Transport{TLSClientConfig: tlsConfig}
+	if tlsConfig == nil {
+		transport.AllowHTTP = true
+		transport.DialTLS = func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.DialTimeout(network, addr, time.Second*time.Duration(timeout))
+		}
+	}
+	return &http.Client{
+		Transport: transport,
+		Timeout:   time.Second * time.Duration(timeout),
+	}, nil
+}
+
+// Push exports the messages in the single request. The batch is limited by the `limit'.
+// The batch rejected as invalid is dropped, other errors are retried on the next hosts.
+func (c *OTLPClient) Push(l map[int64]LogMessage) error {
+	body := c.marshal(l)
+	if c.conf.OTLP.Gzip {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		gz.Write(body)
+		if err := gz.Close(); err != nil {
+			return err
+		}
+		body = buf.Bytes()
+	}
+
+	log.Infof("Sending %d messages to the OTLP collector", len(l))
+	var err error
+	for _, host := range c.conf.Hosts {
+		if c.conf.OTLP.Protocol == GRPC_OTLP_PROTOCOL {
+			err = c.pushGRPC(strings.TrimRight(host, "/")+otlpGRPCPath, body)
+		} else {
+			err = c.pushHTTP(strings.TrimRight(host, "/")+otlpHTTPPath, body)
+		}
+		if _, ok := err.(*PermanentError); ok || err == nil {
+			return err
+		}
+		log.Error(err)
+	}
+	return err
+}
+
+func (c *OTLPClient) pushHTTP(url string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	if c.conf.OTLP.Gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	c.setHeaders(req)
+
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	err = fmt.Errorf("OTLP collector responded %d: %s", resp.StatusCode, string(data))
+	if resp.StatusCode == http.StatusBadRequest {
+		return &PermanentError{Err: err}
+	}
+	return err
+}
+
+func (c *OTLPClient) pushGRPC(url string, body []byte) error {
+	// Length-prefixed message: the compressed flag and the big endian length
+	frame := make([]byte, 5, 5+len(body))
+	if c.conf.OTLP.Gzip {
+		frame[0] = 1
+	}
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(body)))
+	frame = append(frame, body...)
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(frame))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	if c.conf.OTLP.Gzip {
+		req.Header.Set("Grpc-Encoding", "gzip")
+	}
+	c.setHeaders(req)
+
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// Trailers are available after the body is read
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("OTLP collector responded %d", resp.StatusCode)
+	}
+	status, message := resp.Trailer.Get("Grpc-Status"), resp.Trailer.Get("Grpc-Message")
+	if status == "" {
+		status, message = resp.Header.Get("Grpc-Status"), resp.Header.Get("Grpc-Message")
+	}
+
+	if status == "0" {
+		return nil
+	}
+	err = fmt.Errorf("OTLP collector responded with the status %s: %s", status, message)
+	// INVALID_ARGUMENT
+	if status == "3" {
+		return &PermanentError{Err: err}
+	}
+	return err
+}
+
+func (c *OTLPClient) setHeaders(req *http.Request) {
+	if c.conf.Username != "" {
+		req.SetBasicAuth(c.conf.Username, c.conf.Password)
+	}
+	for k, v := range c.conf.OTLP.Headers {
+		req.Header.Set(k, v)
+	}
+}
+
+// marshal encodes the messages into the ExportLogsServiceRequest:
+//
+//	ExportLogsServiceRequest { repeated ResourceLogs resource_logs = 1; }
+//	ResourceLogs             { Resource resource = 1; repeated ScopeLogs scope_logs = 2; }
+//	Resource                 { repeated KeyValue attributes = 1; }
+//	ScopeLogs                { InstrumentationScope scope = 1; repeated LogRecord log_records = 2; }
+//	InstrumentationScope     { string name = 1; }
+//
+// Records are grouped into the resources by the container.
+func (c *OTLPClient) marshal(l map[int64]LogMessage) []byte {
+	index := make(map[string]*otlpResource)
+	var resources []*otlpResource
+	for _, key := range sortedKeys(l) {
+		m := l[key]
+
+		id := m.Namespace + "/" + m.PodName + "/" + m.Container + "/" + m.ContainerID
+		r, ok := index[id]
+		if !ok {
+			r = &otlpResource{attributes: c.resource(m)}
+			index[id] = r
+			resources = append(resources, r)
+		}
+		r.records = appendProtoBytes(r.records, 2, otlpLogRecord(m))
+	}
+
+	var req []byte
+	for _, r := range resources {
+		scope := appendProtoBytes(nil, 1, appendProtoBytes(nil, 1, []byte("kubeat")))
+		scope = append(scope, r.records...)
+
+		var rl []byte
+		rl = appendProtoBytes(rl, 1, r.attributes)
+		rl = appendProtoBytes(rl, 2, scope)
+		req = appendProtoBytes(req, 1, rl)
+	}
+	return req
+}
+
+// resource returns the Resource with the Kubernetes semantic convention attributes
+func (c *OTLPClient) resource(m LogMessage) []byte {
+	var res []byte
+	add := func(key string, v interface{}) {
+		if s, ok := v.(string); ok && s == "" {
+			return
+		}
+		res = appendProtoBytes(res, 1, otlpKeyValue(key, v))
+	}
+
+	keys := make([]string, 0, len(c.conf.OTLP.ResourceAttributes))
+	for k := range c.conf.OTLP.ResourceAttributes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		add(k, c.conf.OTLP.ResourceAttributes[k])
+	}
+
+	add("k8s.namespace.name", m.Namespace)
+	add("k8s.pod.name", m.PodName)
+	add("k8s.container.name", m.Container)
+	add("container.id", m.ContainerID)
+	if v, ok := m.Meta["node_name"].(string); ok {
+		add("k8s.node.name", v)
+	}
+	if v, ok := m.Meta["image"].(string); ok {
+		add("container.image.name", v)
+	}
+	if kind, ok := m.Meta["owner_kind"].(string); ok {
+		if key, ok := otlpOwnerKinds[kind]; ok {
+			add(key, m.Meta["owner_name"])
+		}
+	}
+	for _, name := range []string{"labels", "annotations"} {
+		values := stringMap(m.Meta[name])
+		keys := make([]string, 0, len(values))
+		for k := range values {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			add("k8s.pod."+strings.TrimSuffix(name, "s")+"."+k, values[k])
+		}
+	}
+	return res
+}
+
+// otlpLogRecord encodes the LogRecord:
+//
+//	LogRecord { fixed64 time_unix_nano = 1; SeverityNumber severity_number = 2;
+//	            string severity_text = 3; AnyValue body = 5; repeated KeyValue attributes = 6;
+//	            fixed64 observed_time_unix_nano = 11; }
+//
+// Fields and the meta not mapped to the resource are the attributes.
+func otlpLogRecord(m LogMessage) []byte {
+	level := m.Level
+	if level == "" {
+		level = otlpLevelRe.FindString(truncate(m.Message, 128))
+	}
+	number, text := otlpSeverity(level)
+
+	// Observed time is when the kubeat read the line
+	observed := m.SenderTime
+	if observed.IsZero() {
+		observed = time.Now()
+	}
+
+	var rec []byte
+	rec = appendProtoFixed64(rec, 1, uint64(m.Timestamp.UnixNano()))
+	rec = appendProtoVarint(rec, 2, uint64(number))
+	if text != "" {
+		rec = appendProtoBytes(rec, 3, []byte(text))
+	}
+	rec = appendProtoBytes(rec, 5, otlpAnyValue(m.Message))
+
+	attributes := make(map[string]interface{})
+	for k, v := range m.Meta {
+		switch k {
+		case "node_name", "image", "owner_kind", "owner_name", "labels", "annotations":
+		default:
+			attributes[k] = v
+		}
+	}
+	for k, v := range m.Fields {
+		attributes[k] = v
+	}
+	keys := make([]string, 0, len(attributes))
+	for k := range attributes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		rec = appendProtoBytes(rec, 6, otlpKeyValue(k, attributes[k]))
+	}
+
+	return appendProtoFixed64(rec, 11, uint64(observed.UnixNano()))
+}
+
+// otlpSeverity maps the message level to the OTLP severity number and text
+func otlpSeverity(level string) (int, string) {
+	switch strings.ToLower(level) {
+	case "trace":
+		return 1, "TRACE"
+	case "debug":
+		return 5, "DEBUG"
+	case "info", "notice":
+		return 9, "INFO"
+	case "warn", "warning":
+		return 13, "WARN"
+	case "err", "error":
+		return 17, "ERROR"
+	case "crit", "critical", "alert", "emerg", "fatal", "panic":
+		return 21, "FATAL"
+	}
+	return 0, level
+}
+
+// otlpKeyValue encodes the KeyValue { string key = 1; AnyValue value = 2; }
+func otlpKeyValue(key string, v interface{}) []byte {
+	var kv []byte
+	kv = appendProtoBytes(kv, 1, []byte(key))
+	return appendProtoBytes(kv, 2, otlpAnyValue(v))
+}
+
+// otlpAnyValue encodes the AnyValue, the field of the oneof is set even for the zero value:
+//
+//	AnyValue { string string_value = 1; bool bool_value = 2; int64 int_value = 3;
+//	           double double_value = 4; ArrayValue array_value = 5; KeyValueList kvlist_value = 6; }
+func otlpAnyValue(v interface{}) []byte {
+	var b []byte
+	switch v := v.(type) {
+	case nil:
+		return b
+	case string:
+		return appendProtoBytes(b, 1, []byte(v))
+	case bool:
+		b = appendUvarint(b, 2<<3)
+		if v {
+			return appendUvarint(b, 1)
+		}
+		return appendUvarint(b, 0)
+	case int:
+		b = appendUvarint(b, 3<<3)
+		return appendUvarint(b, uint64(v))
+	case int64:
+		b = appendUvarint(b, 3<<3)
+		return appendUvarint(b, uint64(v))
+	case float64:
+		b = appendUvarint(b, 4<<3|1)
+		var buf [8]byte
+		binary.LittleEndian.PutUint64(buf[:], math.Float64bits(v))
+		return append(b, buf[:]...)
+	case []interface{}:
+		var values []byte
+		for _, item := range v {
+			values = appendProtoBytes(values, 1, otlpAnyValue(item))
+		}
+		return appendProtoBytes(b, 5, values)
+	case map[string]string:
+		m := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			m[k] = item
+		}
+		return otlpAnyValue(m)
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		var values []byte
+		for _, k := range keys {
+			values = appendProtoBytes(values, 1, otlpKeyValue(k, v[k]))
+		}
+		return appendProtoBytes(b, 6, values)
+	}
+	return appendProtoBytes(b, 1, []byte(fmt.Sprint(v)))
+}
+
+// stringMap returns the map of strings set by the enricher or the processors
+func stringMap(v interface{}) map[string]string {
+	switch v := v.(type) {
+	case map[string]string:
+		return v
+	case map[string]interface{}:
+		m := make(map[string]string, len(v))
+		for k, item := range v {
+			m[k] = fmt.Sprint(item)
+		}
+		return m
+	}
+	return nil
+}
+
+func appendProtoFixed64(b []byte, field int, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = appendUvarint(b, uint64(field)<<3|1)
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], v)
+	return append(b, buf[:]...)
+}
@@ -0,0 +1,205 @@
+package beater
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// otlpTestRecord is the LogRecord of the "hi" error at 1ns observed at 2ns
+var otlpTestRecord = []byte{
+	0x09, 0x01, 0, 0, 0, 0, 0, 0, 0, // time_unix_nano
+	0x10, 0x11, // severity_number ERROR
+	0x1a, 0x05, 'E', 'R', 'R', 'O', 'R', // severity_text
+	0x2a, 0x04, 0x0a, 0x02, 'h', 'i', // body
+	0x59, 0x02, 0, 0, 0, 0, 0, 0, 0, // observed_time_unix_nano
+}
+
+func otlpTestRequest() []byte {
+	var req []byte
+	req = append(req, 0x0a, 0x4d) // resource_logs, 77 bytes
+	req = append(req, 0x0a, 0x1c) // resource, 28 bytes
+	req = append(req, 0x0a, 0x1a) // attributes, 26 bytes
+	req = append(req, 0x0a, 0x12)
+	req = append(req, "k8s.namespace.name"...)
+	req = append(req, 0x12, 0x04, 0x0a, 0x02, 'n', 's')
+	req = append(req, 0x12, 0x2d) // scope_logs, 45 bytes
+	req = append(req, 0x0a, 0x08, 0x0a, 0x06)
+	req = append(req, "kubeat"...)
+	req = append(req, 0x12, 0x21) // log_records, 33 bytes
+	return append(req, otlpTestRecord...)
+}
+
+var otlpTestMessage = LogMessage{Namespace: "ns", Message: "hi", Level: "error",
+	Timestamp: time.Unix(0, 1), SenderTime: time.Unix(0, 2)}
+
+func TestOTLPLogRecord(t *testing.T) {
+	if got := otlpLogRecord(otlpTestMessage); !bytes.Equal(got, otlpTestRecord) {
+		t.Errorf("otlpLogRecord() = % x, want % x", got, otlpTestRecord)
+	}
+}
+
+func TestOTLPMarshal(t *testing.T) {
+	c := &OTLPClient{conf: &SenderConfig{}}
+	want := otlpTestRequest()
+	if got := c.marshal(map[int64]LogMessage{1: otlpTestMessage}); !bytes.Equal(got, want) {
+		t.Errorf("marshal() = % x, want % x", got, want)
+	}
+}
+
+func TestOTLPAnyValue(t *testing.T) {
+	for _, c := range []struct {
+		v    interface{}
+		want []byte
+	}{
+		{"", []byte{0x0a, 0x00}},
+		{false, []byte{0x10, 0x00}},
+		{true, []byte{0x10, 0x01}},
+		{int64(-1), []byte{0x18, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}},
+		{1.5, []byte{0x21, 0, 0, 0, 0, 0, 0, 0xf8, 0x3f}},
+		{[]interface{}{"a"}, []byte{0x2a, 0x05, 0x0a, 0x03, 0x0a, 0x01, 'a'}},
+		{map[string]string{"k": "v"}, []byte{0x32, 0x0a, 0x0a, 0x08, 0x0a, 0x01, 'k', 0x12, 0x03, 0x0a, 0x01, 'v'}},
+	} {
+		if got := otlpAnyValue(c.v); !bytes.Equal(got, c.want) {
+			t.Errorf("otlpAnyValue(%#v) = % x, want % x", c.v, got, c.want)
+		}
+	}
+}
+
+func TestOTLPSeverity(t *testing.T) {
+	for message, want := range map[string]int{
+		"level=warn retrying":     13,
+		"[ERROR] failed":          17,
+		"informational message":   0,
+		"panic: runtime error":    21,
+		"GET /healthz 200 (info)": 9,
+	} {
+		number, _ := otlpSeverity(otlpLevelRe.FindString(message))
+		if number != want {
+			t.Errorf("%q severity = %d, want %d", message, number, want)
+		}
+	}
+}
+
+// newGRPCServer is the h2c server answering with the grpc-status trailer
+func newGRPCServer(t *testing.T, status *string, frames *[][]byte) *httptest.Server {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 || r.URL.Path != otlpGRPCPath || r.Header.Get("Content-Type") != "application/grpc" {
+			t.Errorf("Wrong request %s %s %s", r.Proto, r.URL.Path, r.Header.Get("Content-Type"))
+		}
+		data, _ := ioutil.ReadAll(r.Body)
+		*frames = append(*frames, data)
+
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		w.WriteHeader(http.StatusOK)
+		w.Header().Set("Grpc-Status", *status)
+		w.Header().Set("Grpc-Message", "test")
+	})
+	return httptest.NewServer(h2c.NewHandler(handler, &http2.Server{}))
+}
+
+func TestOTLPPushGRPC(t *testing.T) {
+	status := "0"
+	var frames [][]byte
+	server := newGRPCServer(t, &status, &frames)
+	defer server.Close()
+
+	c := &OTLPClient{}
+	if err := c.Connect(&SenderConfig{Hosts: []string{server.URL}}); err != nil {
+		t.Fatal(err)
+	}
+	batch := map[int64]LogMessage{1: otlpTestMessage}
+	if err := c.Push(batch); err != nil {
+		t.Fatal(err)
+	}
+
+	// Uncompressed flag, the big endian length and the message
+	body := otlpTestRequest()
+	want := append([]byte{0, 0, 0, 0, byte(len(body))}, body...)
+	if len(frames) != 1 || !bytes.Equal(frames[0], want) {
+		t.Errorf("frames = % x, want % x", frames, want)
+	}
+
+	status = "14"
+	if err := c.Push(batch); err == nil {
+		t.Error("UNAVAILABLE must be retried")
+	} else if _, ok := err.(*PermanentError); ok {
+		t.Error("UNAVAILABLE must not drop the batch")
+	}
+	status = "3"
+	if _, ok := c.Push(batch).(*PermanentError); !ok {
+		t.Error("INVALID_ARGUMENT must drop the batch")
+	}
+}
+
+func TestOTLPPushGRPCGzip(t *testing.T) {
+	status := "0"
+	var frames [][]byte
+	server := newGRPCServer(t, &status, &frames)
+	defer server.Close()
+
+	c := &OTLPClient{}
+	if err := c.Connect(&SenderConfig{Hosts: []string{server.URL}, OTLP: OTLPConfig{Gzip: true}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Push(map[int64]LogMessage{1: otlpTestMessage}); err != nil {
+		t.Fatal(err)
+	}
+
+	frame := frames[0]
+	if frame[0] != 1 || int(binary.BigEndian.Uint32(frame[1:5])) != len(frame)-5 {
+		t.Fatalf("Wrong frame header % x", frame[:5])
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(frame[5:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(gz)
+	if !bytes.Equal(body, otlpTestRequest()) {
+		t.Errorf("body = % x", body)
+	}
+}
+
+func TestOTLPPushHTTP(t *testing.T) {
+	var status int
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != otlpHTTPPath || r.Header.Get("Content-Type") != "application/x-protobuf" {
+			t.Errorf("Wrong request %s %s", r.URL.Path, r.Header.Get("Content-Type"))
+		}
+		body, _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	c := &OTLPClient{}
+	if err := c.Connect(&SenderConfig{Hosts: []string{server.URL}, OTLP: OTLPConfig{Protocol: HTTP_OTLP_PROTOCOL}}); err != nil {
+		t.Fatal(err)
+	}
+	batch := map[int64]LogMessage{1: otlpTestMessage}
+
+	status = http.StatusOK
+	if err := c.Push(batch); err != nil || !bytes.Equal(body, otlpTestRequest()) {
+		t.Errorf("Push() = %v, body % x", err, body)
+	}
+	for _, status = range []int{http.StatusUnauthorized, http.StatusNotFound, http.StatusServiceUnavailable} {
+		if err := c.Push(batch); err == nil {
+			t.Errorf("%d must be retried", status)
+		} else if _, ok := err.(*PermanentError); ok {
+			t.Errorf("%d must not drop the batch", status)
+		}
+	}
+	status = http.StatusBadRequest
+	if _, ok := c.Push(batch).(*PermanentError); !ok {
+		t.Error("400 must drop the batch")
+	}
+}
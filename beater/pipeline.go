@@ -0,0 +1,519 @@
+package beater
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vjeantet/grok"
+)
+
+const (
+	DROP_PROCESSOR          = "drop"
+	KEEP_PROCESSOR          = "keep"
+	ADD_FIELDS_PROCESSOR    = "add_fields"
+	RENAME_FIELDS_PROCESSOR = "rename_fields"
+	REMOVE_FIELDS_PROCESSOR = "remove_fields"
+	GROK_PROCESSOR          = "grok"
+	TRUNCATE_PROCESSOR      = "truncate"
+	RATE_LIMIT_PROCESSOR    = "rate_limit"
+)
+
+// Processor transforms the message before it is sent.
+// Process returns false if the message must be dropped.
+type Processor interface {
+	Process(l *LogMessage) bool
+}
+
+// ProcessorConfig is the single processor of the pipeline.
+// Fields are addressed by the paths like `message', `fields.user.id' or `meta.labels.app'.
+type ProcessorConfig struct {
+	Type string `json:"type"`
+	// Field is the source field of the drop, keep, grok and truncate processors.
+	// `message' by default
+	Field string `json:"field"`
+	// Pattern is the regexp of the drop and keep or the grok pattern
+	Pattern string `json:"pattern"`
+	// Patterns are the custom grok patterns
+	Patterns map[string]string `json:"patterns"`
+	// Target is the path to put the grok captures into. `fields' by default
+	Target string `json:"target"`
+	// Fields are the path: value of the add_fields and from: to of the rename_fields
+	Fields map[string]interface{} `json:"fields"`
+	// Names are the paths of the remove_fields
+	Names []string `json:"names"`
+	// MaxLength in bytes of the truncate
+	MaxLength int `json:"max_length"`
+	// Rate is the messages per second of the rate_limit, Burst is the bucket size
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+// Pipeline is the chain of the processors
+type Pipeline []Processor
+
+// NewPipeline creates the processors chain from the configs
+func NewPipeline(confs []ProcessorConfig) (Pipeline, error) {
+	var pipeline Pipeline
+	for i, conf := range confs {
+		p, err := newProcessor(conf)
+		if err != nil {
+			return nil, fmt.Errorf("Processor %d `%s': %s", i, conf.Type, err.Error())
+		}
+		pipeline = append(pipeline, p)
+	}
+	return pipeline, nil
+}
+
+// Process runs the message through the chain.
+// Returns false if any of the processors dropped it.
+func (p Pipeline) Process(l *LogMessage) bool {
+	for _, processor := range p {
+		if !processor.Process(l) {
+			return false
+		}
+	}
+	return true
+}
+
+func newProcessor(conf ProcessorConfig) (Processor, error) {
+	if conf.Field == "" {
+		conf.Field = "message"
+	}
+
+	switch conf.Type {
+	case DROP_PROCESSOR, KEEP_PROCESSOR:
+		re, err := regexp.Compile(conf.Pattern)
+		if err != nil {
+			return nil, err
+		}
+		return &matchProcessor{field: conf.Field, re: re, keep: conf.Type == KEEP_PROCESSOR}, nil
+	case ADD_FIELDS_PROCESSOR:
+		for path := range conf.Fields {
+			if !isSettableField(path) {
+				return nil, fmt.Errorf("Can't set the field `%s'", path)
+			}
+		}
+		return &addFieldsProcessor{fields: conf.Fields}, nil
+	case RENAME_FIELDS_PROCESSOR:
+		fields := make(map[string]string, len(conf.Fields))
+		for from, to := range conf.Fields {
+			s, ok := to.(string)
+			if !ok {
+				return nil, errors.New("Rename target of the " + from + " must be a string")
+			}
+			if !isSettableField(s) {
+				return nil, fmt.Errorf("Can't set the field `%s'", s)
+			}
+			fields[from] = s
+		}
+		return &renameFieldsProcessor{fields: fields}, nil
+	case REMOVE_FIELDS_PROCESSOR:
+		return &removeFieldsProcessor{names: conf.Names}, nil
+	case GROK_PROCESSOR:
+		return newGrokProcessor(conf)
+	case TRUNCATE_PROCESSOR:
+		if conf.MaxLength <= 0 {
+			return nil, errors.New("max_length must be positive")
+		}
+		if !isSettableField(conf.Field) {
+			return nil, fmt.Errorf("Can't set the field `%s'", conf.Field)
+		}
+		return &truncateProcessor{field: conf.Field, max: conf.MaxLength}, nil
+	case RATE_LIMIT_PROCESSOR:
+		if conf.Rate <= 0 {
+			return nil, errors.New("rate must be positive")
+		}
+		return newRateLimitProcessor(conf.Rate, conf.Burst), nil
+	}
+	return nil, errors.New("Wrong processor type")
+}
+
+// matchProcessor drops the messages matched by the regexp,
+// or not matched if keep is set
+type matchProcessor struct {
+	field string
+	re    *regexp.Regexp
+	keep  bool
+}
+
+func (m *matchProcessor) Process(l *LogMessage) bool {
+	v, _ := getFieldString(l, m.field)
+	return m.re.MatchString(v) == m.keep
+}
+
+type addFieldsProcessor struct {
+	fields map[string]interface{}
+}
+
+func (a *addFieldsProcessor) Process(l *LogMessage) bool {
+	for path, v := range a.fields {
+		setField(l, path, v)
+	}
+	return true
+}
+
+type renameFieldsProcessor struct {
+	fields map[string]string
+}
+
+func (r *renameFieldsProcessor) Process(l *LogMessage) bool {
+	for from, to := range r.fields {
+		if v, ok := getField(l, from); ok {
+			deleteField(l, from)
+			setField(l, to, v)
+		}
+	}
+	return true
+}
+
+type removeFieldsProcessor struct {
+	names []string
+}
+
+func (r *removeFieldsProcessor) Process(l *LogMessage) bool {
+	for _, path := range r.names {
+		deleteField(l, path)
+	}
+	return true
+}
+
+// grokProcessor extracts the named captures of the grok pattern.
+// The message is left as is if the pattern does not match.
+type grokProcessor struct {
+	field   string
+	target  string
+	pattern string
+	g       *grok.Grok
+}
+
+func newGrokProcessor(conf ProcessorConfig) (*grokProcessor, error) {
+	g, err := grok.NewWithConfig(&grok.Config{
+		NamedCapturesOnly: true,
+		Patterns:          conf.Patterns,
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Compile the pattern once to fail on the start
+	if _, err := g.Parse(conf.Pattern, ""); err != nil {
+		return nil, err
+	}
+
+	target := conf.Target
+	if target == "" {
+		target = "fields"
+	}
+	// Captures are set inside the target
+	if !isSettableField(target + ".capture") {
+		return nil, fmt.Errorf("Can't set the fields of the `%s'", target)
+	}
+	return &grokProcessor{field: conf.Field, target: target, pattern: conf.Pattern, g: g}, nil
+}
+
+func (g *grokProcessor) Process(l *LogMessage) bool {
+	v, ok := getFieldString(l, g.field)
+	if !ok {
+		return true
+	}
+
+	values, err := g.g.Parse(g.pattern, v)
+	if err != nil {
+		log.Error(err)
+		return true
+	}
+	for name, value := range values {
+		setField(l, g.target+"."+name, value)
+	}
+	return true
+}
+
+type truncateProcessor struct {
+	field string
+	max   int
+}
+
+func (t *truncateProcessor) Process(l *LogMessage) bool {
+	v, ok := getFieldString(l, t.field)
+	if !ok || len(v) <= t.max {
+		return true
+	}
+
+	// Do not cut the multibyte character
+	end := t.max
+	for end > 0 && !utf8.RuneStart(v[end]) {
+		end--
+	}
+	setField(l, t.field, v[:end])
+	return true
+}
+
+// rateLimitSweepInterval is how often the idle buckets are removed
+const rateLimitSweepInterval = time.Minute
+
+// rateLimitProcessor drops the messages of the container
+// exceeding the rate with the token bucket
+type rateLimitProcessor struct {
+	rate    float64
+	burst   float64
+	buckets map[string]*bucket
+	// swept is the time of the last idle buckets removal
+	swept time.Time
+	mux   sync.Mutex
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+func newRateLimitProcessor(rate float64, burst int) *rateLimitProcessor {
+	r := &rateLimitProcessor{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+		swept:   time.Now(),
+	}
+	if r.burst < 1 {
+		r.burst = rate
+	}
+	if r.burst < 1 {
+		r.burst = 1
+	}
+	return r
+}
+
+func (r *rateLimitProcessor) Process(l *LogMessage) bool {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	now := time.Now()
+	if now.Sub(r.swept) >= rateLimitSweepInterval {
+		r.sweep(now)
+	}
+	key := strings.Join([]string{l.Namespace, l.PodName, l.Container}, "/")
+	b, ok := r.buckets[key]
+	if !ok {
+		b = &bucket{tokens: r.burst, updated: now}
+		r.buckets[key] = b
+	}
+
+	b.tokens += now.Sub(b.updated).Seconds() * r.rate
+	if b.tokens > r.burst {
+		b.tokens = r.burst
+	}
+	b.updated = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// sweep removes the buckets refilled since the last message,
+// they are the same as the new ones. So the buckets of the deleted
+// containers are not kept.
+func (r *rateLimitProcessor) sweep(now time.Time) {
+	for key, b := range r.buckets {
+		if b.tokens+now.Sub(b.updated).Seconds()*r.rate >= r.burst {
+			delete(r.buckets, key)
+		}
+	}
+	r.swept = now
+}
+
+// getField returns the value of the message field by the path
+func getField(l *LogMessage, path string) (interface{}, bool) {
+	switch path {
+	case "message":
+		return l.Message, true
+	case "level":
+		return l.Level, l.Level != ""
+	case "namespace":
+		return l.Namespace, true
+	case "pod_name":
+		return l.PodName, true
+	case "container":
+		return l.Container, true
+	case "container_id":
+		return l.ContainerID, l.ContainerID != ""
+	}
+
+	root, keys := splitFieldPath(l, path)
+	if len(keys) == 0 {
+		return nil, false
+	}
+	var v interface{} = root
+	for _, key := range keys {
+		var ok bool
+		switch m := v.(type) {
+		case map[string]interface{}:
+			v, ok = m[key]
+		case map[string]string:
+			v, ok = m[key]
+		}
+		if !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+func getFieldString(l *LogMessage, path string) (string, bool) {
+	v, ok := getField(l, path)
+	if !ok {
+		return "", false
+	}
+	if s, ok := v.(string); ok {
+		return s, true
+	}
+	return fmt.Sprint(v), true
+}
+
+// setField sets the message field by the path. Only the message, level
+// and the paths inside the fields and meta objects can be set.
+func setField(l *LogMessage, path string, v interface{}) {
+	switch path {
+	case "message":
+		l.Message = fmt.Sprint(v)
+		return
+	case "level":
+		l.Level = fmt.Sprint(v)
+		return
+	}
+
+	if strings.HasPrefix(path, "meta.") {
+		if l.Meta == nil {
+			l.Meta = make(map[string]interface{})
+		}
+	} else if strings.HasPrefix(path, "fields.") {
+		if l.Fields == nil {
+			l.Fields = make(map[string]interface{})
+		}
+	}
+
+	root, keys := splitFieldPath(l, path)
+	if len(keys) == 0 {
+		log.Errorf("Can't set the field `%s'", path)
+		return
+	}
+	m := root
+	for _, key := range keys[:len(keys)-1] {
+		next, ok := fieldObject(m[key])
+		if !ok {
+			next = make(map[string]interface{})
+		}
+		m[key] = next
+		m = next
+	}
+	m[keys[len(keys)-1]] = v
+}
+
+// isSettableField returns true if the path can be set by the setField
+func isSettableField(path string) bool {
+	switch path {
+	case "message", "level":
+		return true
+	}
+
+	parts := strings.Split(path, ".")
+	if len(parts) < 2 || (parts[0] != "fields" && parts[0] != "meta") {
+		return false
+	}
+	for _, key := range parts[1:] {
+		if key == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// deleteField removes the field inside the fields and meta objects,
+// or clears the level
+func deleteField(l *LogMessage, path string) {
+	if path == "level" {
+		l.Level = ""
+		return
+	}
+
+	root, keys := splitFieldPath(l, path)
+	if len(keys) == 0 {
+		return
+	}
+	m := root
+	for _, key := range keys[:len(keys)-1] {
+		next, ok := fieldObject(m[key])
+		if !ok {
+			return
+		}
+		m[key] = next
+		m = next
+	}
+	delete(m, keys[len(keys)-1])
+}
+
+// fieldObject returns the object to change the fields inside it. The labels
+// and annotations of the pod are the string maps shared by the messages of
+// the enricher, they are copied to the object of the message.
+func fieldObject(v interface{}) (map[string]interface{}, bool) {
+	switch m := v.(type) {
+	case map[string]interface{}:
+		return m, true
+	case map[string]string:
+		object := make(map[string]interface{}, len(m))
+		for k, v := range m {
+			object[k] = v
+		}
+		return object, true
+	}
+	return nil, false
+}
+
+// splitFieldPath returns the fields or meta object and the keys inside it
+func splitFieldPath(l *LogMessage, path string) (map[string]interface{}, []string) {
+	parts := strings.Split(path, ".")
+	if len(parts) < 2 {
+		return nil, nil
+	}
+	switch parts[0] {
+	case "fields":
+		if l.Fields == nil {
+			return nil, nil
+		}
+		return l.Fields, parts[1:]
+	case "meta":
+		if l.Meta == nil {
+			return nil, nil
+		}
+		return l.Meta, parts[1:]
+	}
+	return nil, nil
+}
+
+// getPipelineConfig returns the processors from the pipeline-config file
+// if it is set, or from the sender config
+func getPipelineConfig(sc *SenderConfig) ([]ProcessorConfig, error) {
+	path := flag.Lookup("pipeline-config").Value.String()
+	if path == "" {
+		return sc.Processors, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var confs []ProcessorConfig
+	if err := json.Unmarshal(data, &confs); err != nil {
+		return nil, err
+	}
+	return confs, nil
+}
@@ -0,0 +1,313 @@
+package beater
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestPipeline(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		conf ProcessorConfig
+		in   LogMessage
+		want *LogMessage
+	}{
+		{
+			name: "drop matched",
+			conf: ProcessorConfig{Type: DROP_PROCESSOR, Pattern: "healthz"},
+			in:   LogMessage{Message: "GET /healthz"},
+		},
+		{
+			name: "drop not matched",
+			conf: ProcessorConfig{Type: DROP_PROCESSOR, Pattern: "healthz"},
+			in:   LogMessage{Message: "GET /"},
+			want: &LogMessage{Message: "GET /"},
+		},
+		{
+			name: "drop by the field",
+			conf: ProcessorConfig{Type: DROP_PROCESSOR, Field: "fields.status", Pattern: "^2"},
+			in:   LogMessage{Message: "x", Fields: map[string]interface{}{"status": float64(200)}},
+		},
+		{
+			name: "keep matched",
+			conf: ProcessorConfig{Type: KEEP_PROCESSOR, Field: "level", Pattern: "error"},
+			in:   LogMessage{Message: "x", Level: "error"},
+			want: &LogMessage{Message: "x", Level: "error"},
+		},
+		{
+			name: "keep not matched",
+			conf: ProcessorConfig{Type: KEEP_PROCESSOR, Field: "level", Pattern: "error"},
+			in:   LogMessage{Message: "x"},
+		},
+		{
+			name: "add fields",
+			conf: ProcessorConfig{Type: ADD_FIELDS_PROCESSOR, Fields: map[string]interface{}{
+				"fields.cluster": "prod", "meta.team.name": "core", "level": "info"}},
+			in: LogMessage{Message: "x"},
+			want: &LogMessage{Message: "x", Level: "info",
+				Fields: map[string]interface{}{"cluster": "prod"},
+				Meta:   map[string]interface{}{"team": map[string]interface{}{"name": "core"}}},
+		},
+		{
+			name: "rename fields",
+			conf: ProcessorConfig{Type: RENAME_FIELDS_PROCESSOR, Fields: map[string]interface{}{
+				"fields.client": "meta.client_ip", "fields.missing": "fields.other"}},
+			in: LogMessage{Message: "x", Fields: map[string]interface{}{"client": "10.0.0.1", "path": "/"}},
+			want: &LogMessage{Message: "x",
+				Fields: map[string]interface{}{"path": "/"},
+				Meta:   map[string]interface{}{"client_ip": "10.0.0.1"}},
+		},
+		{
+			name: "remove fields",
+			conf: ProcessorConfig{Type: REMOVE_FIELDS_PROCESSOR, Names: []string{"level", "fields.a.b", "meta.missing"}},
+			in: LogMessage{Message: "x", Level: "info",
+				Fields: map[string]interface{}{"a": map[string]interface{}{"b": 1, "c": 2}}},
+			want: &LogMessage{Message: "x",
+				Fields: map[string]interface{}{"a": map[string]interface{}{"c": 2}}},
+		},
+		{
+			name: "grok",
+			conf: ProcessorConfig{Type: GROK_PROCESSOR, Pattern: "%{IP:client} %{WORD:method} %{NUMBER:status}"},
+			in:   LogMessage{Message: "10.0.0.1 GET 200"},
+			want: &LogMessage{Message: "10.0.0.1 GET 200",
+				Fields: map[string]interface{}{"client": "10.0.0.1", "method": "GET", "status": "200"}},
+		},
+		{
+			name: "grok custom patterns into the target",
+			conf: ProcessorConfig{Type: GROK_PROCESSOR, Pattern: "%{ID:id}", Patterns: map[string]string{"ID": "[a-z]+-[0-9]+"},
+				Target: "meta.request"},
+			in: LogMessage{Message: "request abc-42"},
+			want: &LogMessage{Message: "request abc-42",
+				Meta: map[string]interface{}{"request": map[string]interface{}{"id": "abc-42"}}},
+		},
+		{
+			name: "grok not matched",
+			conf: ProcessorConfig{Type: GROK_PROCESSOR, Pattern: "%{IP:client}"},
+			in:   LogMessage{Message: "no address"},
+			want: &LogMessage{Message: "no address"},
+		},
+		{
+			name: "truncate",
+			conf: ProcessorConfig{Type: TRUNCATE_PROCESSOR, MaxLength: 4},
+			in:   LogMessage{Message: "abcdef"},
+			want: &LogMessage{Message: "abcd"},
+		},
+		{
+			name: "truncate keeps the multibyte character",
+			conf: ProcessorConfig{Type: TRUNCATE_PROCESSOR, MaxLength: 4},
+			in:   LogMessage{Message: "abcдef"},
+			want: &LogMessage{Message: "abc"},
+		},
+		{
+			name: "truncate the short field",
+			conf: ProcessorConfig{Type: TRUNCATE_PROCESSOR, Field: "fields.user", MaxLength: 4},
+			in:   LogMessage{Message: "abcdef", Fields: map[string]interface{}{"user": "ab"}},
+			want: &LogMessage{Message: "abcdef", Fields: map[string]interface{}{"user": "ab"}},
+		},
+	} {
+		pipeline, err := NewPipeline([]ProcessorConfig{c.conf})
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		l := c.in
+		kept := pipeline.Process(&l)
+		switch {
+		case c.want == nil && kept:
+			t.Errorf("%s: message %+v is kept, want it dropped", c.name, l)
+		case c.want != nil && !kept:
+			t.Errorf("%s: message is dropped, want %+v", c.name, *c.want)
+		case c.want != nil && !reflect.DeepEqual(l, *c.want):
+			t.Errorf("%s: %+v, want %+v", c.name, l, *c.want)
+		}
+	}
+}
+
+func TestPipelineChain(t *testing.T) {
+	pipeline, err := NewPipeline([]ProcessorConfig{
+		{Type: GROK_PROCESSOR, Pattern: "%{WORD:method} %{URIPATHPARAM:path}"},
+		{Type: DROP_PROCESSOR, Field: "fields.path", Pattern: "^/healthz"},
+		{Type: ADD_FIELDS_PROCESSOR, Fields: map[string]interface{}{"fields.cluster": "prod"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pipeline.Process(&LogMessage{Message: "GET /healthz"}) {
+		t.Error("Message dropped by the second processor is kept")
+	}
+	l := &LogMessage{Message: "GET /api"}
+	if !pipeline.Process(l) || l.Fields["cluster"] != "prod" || l.Fields["path"] != "/api" {
+		t.Errorf("Process() = %+v, want the fields set by the chain", l)
+	}
+}
+
+func TestPipelineEnrichedMeta(t *testing.T) {
+	e, err := NewEnricher(fake.NewSimpleClientset(), LABELS_ENRICHER, []string{"team"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pod := corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Name:        "web",
+		Namespace:   "ns",
+		UID:         "web",
+		Labels:      map[string]string{"app": "web", "tier": "front"},
+		Annotations: map[string]string{"team": "core"},
+	}}
+	e.Update(pod)
+
+	for _, c := range []struct {
+		name string
+		conf ProcessorConfig
+		want map[string]interface{}
+	}{
+		{
+			name: "drop by the label",
+			conf: ProcessorConfig{Type: DROP_PROCESSOR, Field: "meta.labels.app", Pattern: "^web$"},
+		},
+		{
+			name: "keep by the annotation",
+			conf: ProcessorConfig{Type: KEEP_PROCESSOR, Field: "meta.annotations.team", Pattern: "core"},
+			want: map[string]interface{}{
+				"labels":      map[string]string{"app": "web", "tier": "front"},
+				"annotations": map[string]string{"team": "core"},
+			},
+		},
+		{
+			name: "add the label",
+			conf: ProcessorConfig{Type: ADD_FIELDS_PROCESSOR, Fields: map[string]interface{}{"meta.labels.env": "prod"}},
+			want: map[string]interface{}{
+				"labels":      map[string]interface{}{"app": "web", "tier": "front", "env": "prod"},
+				"annotations": map[string]string{"team": "core"},
+			},
+		},
+		{
+			name: "rename the label",
+			conf: ProcessorConfig{Type: RENAME_FIELDS_PROCESSOR, Fields: map[string]interface{}{"meta.labels.app": "meta.app"}},
+			want: map[string]interface{}{
+				"app":         "web",
+				"labels":      map[string]interface{}{"tier": "front"},
+				"annotations": map[string]string{"team": "core"},
+			},
+		},
+		{
+			name: "remove the annotation",
+			conf: ProcessorConfig{Type: REMOVE_FIELDS_PROCESSOR, Names: []string{"meta.annotations.team"}},
+			want: map[string]interface{}{
+				"labels":      map[string]string{"app": "web", "tier": "front"},
+				"annotations": map[string]interface{}{},
+			},
+		},
+	} {
+		pipeline, err := NewPipeline([]ProcessorConfig{c.conf})
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		l := &LogMessage{Message: "x", Meta: e.Meta(pod, "app")}
+		kept := pipeline.Process(l)
+		switch {
+		case c.want == nil && kept:
+			t.Errorf("%s: message %+v is kept, want it dropped", c.name, l.Meta)
+		case c.want != nil && !kept:
+			t.Errorf("%s: message is dropped, want %v", c.name, c.want)
+		case c.want != nil && !reflect.DeepEqual(l.Meta, c.want):
+			t.Errorf("%s: meta %v, want %v", c.name, l.Meta, c.want)
+		}
+	}
+
+	// The labels of the pod and the cached metadata are not changed
+	if !reflect.DeepEqual(pod.Labels, map[string]string{"app": "web", "tier": "front"}) {
+		t.Errorf("Pod labels are changed to %v", pod.Labels)
+	}
+	want := map[string]interface{}{
+		"labels":      map[string]string{"app": "web", "tier": "front"},
+		"annotations": map[string]string{"team": "core"},
+	}
+	if got := e.Meta(pod, "app"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Meta() = %v after the pipeline, want %v", got, want)
+	}
+}
+
+func TestNewPipelineErrors(t *testing.T) {
+	for _, conf := range []ProcessorConfig{
+		{Type: "unknown"},
+		{Type: DROP_PROCESSOR, Pattern: "("},
+		{Type: ADD_FIELDS_PROCESSOR, Fields: map[string]interface{}{"cluster": "prod"}},
+		{Type: ADD_FIELDS_PROCESSOR, Fields: map[string]interface{}{"namespace": "prod"}},
+		{Type: ADD_FIELDS_PROCESSOR, Fields: map[string]interface{}{"fields.": "prod"}},
+		{Type: RENAME_FIELDS_PROCESSOR, Fields: map[string]interface{}{"fields.a": 1}},
+		{Type: RENAME_FIELDS_PROCESSOR, Fields: map[string]interface{}{"fields.a": "b"}},
+		{Type: GROK_PROCESSOR, Pattern: "%{MISSING:x}"},
+		{Type: GROK_PROCESSOR, Pattern: "%{WORD:x}", Target: "message"},
+		{Type: TRUNCATE_PROCESSOR},
+		{Type: TRUNCATE_PROCESSOR, Field: "pod_name", MaxLength: 10},
+		{Type: RATE_LIMIT_PROCESSOR},
+	} {
+		if _, err := NewPipeline([]ProcessorConfig{conf}); err == nil {
+			t.Errorf("NewPipeline(%+v) must fail", conf)
+		}
+	}
+}
+
+func TestIsSettableField(t *testing.T) {
+	for path, want := range map[string]bool{
+		"message":      true,
+		"level":        true,
+		"fields.a":     true,
+		"meta.a.b":     true,
+		"fields":       false,
+		"fields.":      false,
+		"meta..a":      false,
+		"namespace":    false,
+		"container_id": false,
+		"other.a":      false,
+		"":             false,
+	} {
+		if got := isSettableField(path); got != want {
+			t.Errorf("isSettableField(%q) = %v, want %v", path, got, want)
+		}
+	}
+}
+
+func TestRateLimitProcessor(t *testing.T) {
+	r := newRateLimitProcessor(1, 2)
+	l := &LogMessage{Namespace: "ns", PodName: "pod", Container: "con"}
+	for i, want := range []bool{true, true, false} {
+		if got := r.Process(l); got != want {
+			t.Errorf("message %d: Process() = %v, want %v", i, got, want)
+		}
+	}
+	other := &LogMessage{Namespace: "ns", PodName: "other", Container: "con"}
+	if !r.Process(other) {
+		t.Error("Containers must have their own buckets")
+	}
+}
+
+func TestRateLimitSweep(t *testing.T) {
+	r := newRateLimitProcessor(1, 2)
+	r.Process(&LogMessage{PodName: "idle"})
+	r.Process(&LogMessage{PodName: "busy"})
+	r.Process(&LogMessage{PodName: "busy"})
+
+	// The idle bucket is refilled in a second, the busy one in two
+	r.sweep(time.Now().Add(1500 * time.Millisecond))
+	if _, ok := r.buckets["/idle/"]; ok {
+		t.Error("Refilled bucket is not removed")
+	}
+	if _, ok := r.buckets["/busy/"]; !ok {
+		t.Error("Bucket is removed before it was refilled")
+	}
+
+	// Sweep runs on the message after the interval
+	r.swept = time.Now().Add(-rateLimitSweepInterval)
+	r.buckets["/busy/"].updated = time.Now().Add(-time.Hour)
+	r.Process(&LogMessage{PodName: "new"})
+	if len(r.buckets) != 1 {
+		t.Errorf("%d buckets after the sweep, want the new one", len(r.buckets))
+	}
+}
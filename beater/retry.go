@@ -0,0 +1,120 @@
+package beater
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// RetryConfig is the policy of the failed pushes retries.
+// Intervals are in seconds.
+type RetryConfig struct {
+	MaxAttempts     int     `json:"max_attempts"`
+	InitialInterval float64 `json:"initial_interval"`
+	MaxInterval     float64 `json:"max_interval"`
+	Multiplier      float64 `json:"multiplier"`
+	// Jitter is the random part of the interval, from 0 to 1
+	Jitter float64 `json:"jitter"`
+	// MaxElapsed stops the retries of the batch after the number of seconds
+	MaxElapsed float64 `json:"max_elapsed"`
+	// KeepExhausted leaves the messages failed after the retries in the buffer
+	// instead of dropping them, e.g. to keep them in the spool while the receiver is down
+	KeepExhausted bool `json:"keep_exhausted"`
+	// DeadLetter is the path of the file for the dropped messages
+	DeadLetter string `json:"dead_letter"`
+}
+
+func (r *RetryConfig) setDefaults() {
+	if r.MaxAttempts <= 0 {
+		r.MaxAttempts = 5
+	}
+	if r.InitialInterval <= 0 {
+		r.InitialInterval = 1
+	}
+	if r.MaxInterval <= 0 {
+		r.MaxInterval = 30
+	}
+	if r.Multiplier < 1 {
+		r.Multiplier = 2
+	}
+	if r.Jitter <= 0 || r.Jitter > 1 {
+		r.Jitter = 0.2
+	}
+	if r.MaxElapsed <= 0 {
+		r.MaxElapsed = 300
+	}
+}
+
+// backoff returns the interval before the next attempt
+func (r *RetryConfig) backoff(attempt int) time.Duration {
+	interval := r.InitialInterval * math.Pow(r.Multiplier, float64(attempt-1))
+	if interval > r.MaxInterval {
+		interval = r.MaxInterval
+	}
+	interval += interval * r.Jitter * (rand.Float64()*2 - 1)
+	return time.Duration(interval * float64(time.Second))
+}
+
+func (r *RetryConfig) maxElapsed() time.Duration {
+	return time.Duration(r.MaxElapsed * float64(time.Second))
+}
+
+// PushError is returned by the SenderClient when only some of the messages
+// were not pushed. Failed messages are retried, Rejected ones can't be pushed
+// at all and are dropped, the rest are considered pushed.
+type PushError struct {
+	Failed   map[int64]LogMessage
+	Rejected map[int64]LogMessage
+	Err      error
+}
+
+func (e *PushError) Error() string {
+	return e.Err.Error()
+}
+
+// PermanentError is returned by the SenderClient when the batch can't be pushed
+// at all, e.g. it is too large. The batch is dropped without the retries.
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+// failedMessages returns the messages of the batch to retry
+func failedMessages(batch map[int64]LogMessage, err error) map[int64]LogMessage {
+	if err == nil {
+		return nil
+	}
+	switch perr := err.(type) {
+	case *PushError:
+		return perr.Failed
+	case *PermanentError:
+		return nil
+	}
+	return batch
+}
+
+// rejectedMessages returns the messages of the batch to drop
+func rejectedMessages(batch map[int64]LogMessage, err error) map[int64]LogMessage {
+	switch perr := err.(type) {
+	case *PushError:
+		return perr.Rejected
+	case *PermanentError:
+		return batch
+	}
+	return nil
+}
+
+// joinMessages returns the messages of both batches
+func joinMessages(a, b map[int64]LogMessage) map[int64]LogMessage {
+	l := make(map[int64]LogMessage, len(a)+len(b))
+	for k, v := range a {
+		l[k] = v
+	}
+	for k, v := range b {
+		l[k] = v
+	}
+	return l
+}
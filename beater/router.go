@@ -0,0 +1,290 @@
+package beater
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// RouteConfig selects the messages of the output. All the set conditions must match,
+// lists match if any of the regexps matches. Labels and Fields are the regexps
+// of the pod labels and the message fields values by their names and paths.
+type RouteConfig struct {
+	Namespaces []string          `json:"namespaces"`
+	Containers []string          `json:"containers"`
+	Labels     map[string]string `json:"labels"`
+	Fields     map[string]string `json:"fields"`
+}
+
+type route struct {
+	namespaces ignored
+	containers ignored
+	labels     map[string]*regexp.Regexp
+	fields     map[string]*regexp.Regexp
+}
+
+// newRoute compiles the route. Nil route matches all the messages.
+func newRoute(conf *RouteConfig) (*route, error) {
+	if conf == nil {
+		return nil, nil
+	}
+
+	r := &route{}
+	var err error
+	if r.namespaces, err = compileRegexps(conf.Namespaces); err != nil {
+		return nil, err
+	}
+	if r.containers, err = compileRegexps(conf.Containers); err != nil {
+		return nil, err
+	}
+	if r.labels, err = compileRegexpsMap(conf.Labels); err != nil {
+		return nil, err
+	}
+	if r.fields, err = compileRegexpsMap(conf.Fields); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *route) match(l LogMessage) bool {
+	if r == nil {
+		return true
+	}
+	if r.namespaces != nil && !r.namespaces.matchString(l.Namespace) {
+		return false
+	}
+	if r.containers != nil && !r.containers.matchString(l.Container) {
+		return false
+	}
+	for name, re := range r.labels {
+		v, ok := l.labels[name]
+		if !ok || !re.MatchString(v) {
+			return false
+		}
+	}
+	for path, re := range r.fields {
+		v, ok := getFieldString(&l, path)
+		if !ok || !re.MatchString(v) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchContainer returns true if the messages of the pod container can match the route.
+// Fields are not known before the messages are read, so they are not checked.
+func (r *route) matchContainer(pod corev1.Pod, con string) bool {
+	if r == nil {
+		return true
+	}
+	if r.namespaces != nil && !r.namespaces.matchString(pod.Namespace) {
+		return false
+	}
+	if r.containers != nil && !r.containers.matchString(con) {
+		return false
+	}
+	for name, re := range r.labels {
+		v, ok := pod.Labels[name]
+		if !ok || !re.MatchString(v) {
+			return false
+		}
+	}
+	return true
+}
+
+func compileRegexps(list []string) (ignored, error) {
+	var regexps ignored
+	for _, s := range list {
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return nil, err
+		}
+		regexps = append(regexps, re)
+	}
+	return regexps, nil
+}
+
+func compileRegexpsMap(m map[string]string) (map[string]*regexp.Regexp, error) {
+	regexps := make(map[string]*regexp.Regexp, len(m))
+	for k, s := range m {
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return nil, err
+		}
+		regexps[k] = re
+	}
+	return regexps, nil
+}
+
+// output is the sender with its route
+type output struct {
+	sender *Sender
+	route  *route
+}
+
+// Router sends the messages to the outputs matched by their routes
+type Router struct {
+	pipeline Pipeline
+	outputs  []*output
+}
+
+// NewRouter creates the outputs from the sender config.
+// The config without the outputs list is the single output.
+// The processors are run before the routing.
+func NewRouter(sc *SenderConfig, checkpoints *Checkpoints, processors []ProcessorConfig) (*Router, error) {
+	router := &Router{}
+	if len(sc.Outputs) == 0 {
+		sender, err := newSender(sc, checkpoints, processors)
+		if err != nil {
+			return nil, err
+		}
+		router.outputs = []*output{{sender: sender}}
+		return router, nil
+	}
+
+	var err error
+	if router.pipeline, err = NewPipeline(processors); err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]bool)
+	spools := make(map[string]bool)
+	for i := range sc.Outputs {
+		conf := &sc.Outputs[i]
+		if conf.Name == "" {
+			return nil, fmt.Errorf("Output %d has no name", i)
+		}
+		if names[conf.Name] {
+			return nil, errors.New("Duplicate output name " + conf.Name)
+		}
+		names[conf.Name] = true
+		if conf.Spool.Path != "" {
+			if spools[conf.Spool.Path] {
+				return nil, errors.New("Duplicate spool path of the output " + conf.Name)
+			}
+			spools[conf.Spool.Path] = true
+		}
+
+		r, err := newRoute(conf.Route)
+		if err != nil {
+			return nil, fmt.Errorf("Output %s route: %s", conf.Name, err.Error())
+		}
+		sender, err := newSender(conf, checkpoints, conf.Processors)
+		if err != nil {
+			return nil, fmt.Errorf("Output %s: %s", conf.Name, err.Error())
+		}
+		log.Infof("Output %s of the type %s created", conf.Name, conf.Type)
+		router.outputs = append(router.outputs, &output{sender: sender, route: r})
+	}
+	return router, nil
+}
+
+// Start starts the outputs tickers
+func (r *Router) Start() {
+	for _, o := range r.outputs {
+		go o.sender.Ticker()
+	}
+}
+
+// SendMessage runs the message through the pipeline and sends it
+// to the matched outputs
+func (r *Router) SendMessage(l LogMessage) {
+	if !r.pipeline.Process(&l) {
+		return
+	}
+
+	if len(r.outputs) == 1 {
+		if r.outputs[0].route.match(l) {
+			r.outputs[0].sender.SendMessage(l)
+		}
+		return
+	}
+	for _, o := range r.outputs {
+		if o.route.match(l) {
+			// Outputs processors change the fields in place
+			o.sender.SendMessage(copyMessage(l))
+		}
+	}
+}
+
+// Outputs returns the names of the outputs the pod container is routed to
+func (r *Router) Outputs(pod corev1.Pod, con string) []string {
+	var names []string
+	for _, o := range r.outputs {
+		if o.route.matchContainer(pod, con) {
+			names = append(names, o.sender.name)
+		}
+	}
+	return names
+}
+
+// Wait blocks the reader while any of the outputs is behind
+func (r *Router) Wait() {
+	for _, o := range r.outputs {
+		o.sender.Wait()
+	}
+}
+
+// Pressured returns true if any of the outputs is behind
+func (r *Router) Pressured() bool {
+	for _, o := range r.outputs {
+		if o.sender.Pressured() {
+			return true
+		}
+	}
+	return false
+}
+
+// Dropped returns the number of the messages dropped by the outputs
+func (r *Router) Dropped() uint64 {
+	var dropped uint64
+	for _, o := range r.outputs {
+		dropped += o.sender.Dropped()
+	}
+	return dropped
+}
+
+// Rejected returns the number of the messages dropped by the receivers
+func (r *Router) Rejected() uint64 {
+	var rejected uint64
+	for _, o := range r.outputs {
+		rejected += o.sender.Rejected()
+	}
+	return rejected
+}
+
+// Close closes all the outputs
+func (r *Router) Close() error {
+	var err error
+	for _, o := range r.outputs {
+		if e := o.sender.Close(); e != nil {
+			log.Errorf("Output %s: %s", o.sender.name, e.Error())
+			err = e
+		}
+	}
+	return err
+}
+
+// copyMessage copies the message with its fields and metadata
+func copyMessage(l LogMessage) LogMessage {
+	l.Fields = copyMap(l.Fields)
+	l.Meta = copyMap(l.Meta)
+	return l
+}
+
+func copyMap(m map[string]interface{}) map[string]interface{} {
+	if m == nil {
+		return nil
+	}
+	c := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		if nested, ok := v.(map[string]interface{}); ok {
+			v = copyMap(nested)
+		}
+		c[k] = v
+	}
+	return c
+}
@@ -0,0 +1,76 @@
+package beater
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestRouterOutputs(t *testing.T) {
+	routes := map[string]*RouteConfig{
+		"all":    nil,
+		"prod":   {Namespaces: []string{"^prod$"}},
+		"nginx":  {Containers: []string{"^nginx"}, Labels: map[string]string{"tier": "front"}},
+		"errors": {Fields: map[string]string{"level": "error"}},
+	}
+	r := &Router{}
+	for _, name := range []string{"all", "prod", "nginx", "errors"} {
+		route, err := newRoute(routes[name])
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.outputs = append(r.outputs, &output{sender: &Sender{name: name}, route: route})
+	}
+
+	pod := corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "prod", Labels: map[string]string{"tier": "front"}}}
+	// Fields are not checked for the container
+	if got, want := r.Outputs(pod, "nginx"), []string{"all", "prod", "nginx", "errors"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Outputs() = %v, want %v", got, want)
+	}
+	pod.Namespace = "dev"
+	pod.Labels = nil
+	if got, want := r.Outputs(pod, "nginx"), []string{"all", "errors"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Outputs() = %v, want %v", got, want)
+	}
+}
+
+func TestRouterBackpressure(t *testing.T) {
+	blocking := &Sender{name: "es", buffer: newTestBuffer(5, BLOCK_POLICY, nil)}
+	dropping := &Sender{name: "kafka", buffer: newTestBuffer(2, DROP_NEWEST_POLICY, nil)}
+	r := &Router{outputs: []*output{{sender: blocking}, {sender: dropping}}}
+
+	for _, m := range []string{"a", "b", "c", "d"} {
+		blocking.buffer.Add(LogMessage{Message: m})
+		dropping.buffer.Add(LogMessage{Message: m})
+	}
+	if !r.Pressured() {
+		t.Error("Router is not pressured by the blocking output")
+	}
+	if r.Dropped() != 2 {
+		t.Errorf("Dropped() = %d, want 2", r.Dropped())
+	}
+
+	// Readers are paused until every output is below the high watermark
+	waited := make(chan bool)
+	go func() {
+		r.Wait()
+		close(waited)
+	}()
+	select {
+	case <-waited:
+		t.Fatal("Wait must block while the output is behind")
+	case <-time.After(50 * time.Millisecond):
+	}
+	blocking.buffer.Remove(sortedKeys(blocking.buffer.Peek(1, DEFAULT_BATCH_BYTES)))
+	select {
+	case <-waited:
+	case <-time.After(time.Second):
+		t.Fatal("Wait is not woken up")
+	}
+	if r.Pressured() {
+		t.Error("Router is pressured below the high watermark")
+	}
+}
@@ -0,0 +1,625 @@
+package beater
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	DEFAULT_S3_KEY          = `{{ .Namespace }}/{{ date "YYYY-MM-dd" .Timestamp }}/{{ date "HH" .Timestamp }}/{{ .PodName }}`
+	DEFAULT_S3_REGION       = "us-east-1"
+	DEFAULT_S3_PART_SIZE    = 8
+	DEFAULT_S3_OBJECT_SIZE  = 64
+	DEFAULT_S3_OBJECT_AGE   = 300
+	DEFAULT_S3_STAGING_PATH = "/var/lib/kubeat/s3"
+
+	GZIP_S3_COMPRESSION = "gzip"
+	NONE_S3_COMPRESSION = "none"
+
+	// minS3PartSize is the minimal size of the multipart upload part except the last one
+	minS3PartSize = 5
+)
+
+// S3Config is the S3 output settings. The first host is the endpoint URL,
+// e.g. `https://s3.eu-west-1.amazonaws.com' or `http://minio:9000'.
+// The access key and the secret key are the username and the password.
+//
+// Messages are appended to the object of the partition in the staging directory,
+// the object is uploaded when it reaches the ObjectSize or the ObjectAge.
+type S3Config struct {
+	Bucket string `json:"bucket"`
+	Region string `json:"region"`
+	// Prefix is prepended to the object keys
+	Prefix string `json:"prefix"`
+	// Key is the template of the object partition like the kafka topic
+	Key string `json:"key"`
+	// Compression is `gzip' or `none'
+	Compression string `json:"compression"`
+	// PartSize of the multipart upload in MiB, smaller objects are uploaded at once
+	PartSize int `json:"part_size"`
+	// ObjectSize in MiB and ObjectAge in seconds limit the staged object
+	ObjectSize int `json:"object_size"`
+	ObjectAge  int `json:"object_age"`
+	// StagingPath is the directory of the objects before the upload,
+	// mount the persistent volume to keep them between the restarts
+	StagingPath  string `json:"staging_path"`
+	StorageClass string `json:"storage_class"`
+	// PathStyle uses the `endpoint/bucket/key' URLs instead of the `bucket.endpoint/key'
+	PathStyle bool      `json:"path_style"`
+	Timeout   int       `json:"timeout"`
+	TLS       TLSConfig `json:"tls"`
+}
+
+type S3Client struct {
+	Client   *http.Client
+	conf     *S3Config
+	endpoint *url.URL
+	key      *messageTemplate
+
+	accessKey string
+	secretKey string
+
+	// staged are the objects in the staging directory by the name,
+	// current are the objects appended by the partition
+	staged  map[string]*s3Staged
+	current map[string]*s3Staged
+}
+
+// s3Object is the messages of the same partition
+type s3Object struct {
+	// dir is the prefix and the partition
+	dir  string
+	keys []int64
+	data bytes.Buffer
+}
+
+// s3Staged is the object in the staging directory. Objects found
+// on the start have the zero created time and are uploaded first.
+type s3Staged struct {
+	name    string
+	size    int64
+	created time.Time
+}
+
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (s *S3Client) Connect(conf *SenderConfig) error {
+	if len(conf.Hosts) == 0 {
+		return errors.New("S3 endpoint is not set")
+	}
+	c := conf.S3
+	if c.Bucket == "" {
+		return errors.New("S3 bucket is not set")
+	}
+	if c.Region == "" {
+		c.Region = DEFAULT_S3_REGION
+	}
+	if c.Key == "" {
+		c.Key = DEFAULT_S3_KEY
+	}
+	if c.Compression == "" {
+		c.Compression = GZIP_S3_COMPRESSION
+	}
+	if c.PartSize <= 0 {
+		c.PartSize = DEFAULT_S3_PART_SIZE
+	}
+	if c.PartSize < minS3PartSize {
+		c.PartSize = minS3PartSize
+	}
+	if c.ObjectSize <= 0 {
+		c.ObjectSize = DEFAULT_S3_OBJECT_SIZE
+	}
+	if c.ObjectAge <= 0 {
+		c.ObjectAge = DEFAULT_S3_OBJECT_AGE
+	}
+	if c.StagingPath == "" {
+		c.StagingPath = DEFAULT_S3_STAGING_PATH
+	}
+	c.StagingPath = filepath.Clean(c.StagingPath)
+	switch c.Compression {
+	case GZIP_S3_COMPRESSION, NONE_S3_COMPRESSION:
+	default:
+		return errors.New("Wrong s3 compression")
+	}
+
+	endpoint, err := url.Parse(strings.TrimRight(conf.Hosts[0], "/"))
+	if err != nil {
+		return err
+	}
+	if endpoint.Scheme == "" || endpoint.Host == "" {
+		return errors.New("Wrong S3 endpoint " + conf.Hosts[0])
+	}
+	if s.key, err = newMessageTemplate(c.Key); err != nil {
+		return err
+	}
+	client, err := newHTTPClient(&c.TLS, c.Timeout)
+	if err != nil {
+		return err
+	}
+
+	s.accessKey, s.secretKey = conf.Username, conf.Password
+	if s.accessKey == "" || s.secretKey == "" {
+		s.accessKey, s.secretKey = getS3CredsFromEnv()
+	}
+	s.Client = client
+	s.endpoint = endpoint
+	s.conf = &c
+	return s.loadStaged()
+}
+
+// loadStaged finds the objects left in the staging directory
+func (s *S3Client) loadStaged() error {
+	s.staged = make(map[string]*s3Staged)
+	s.current = make(map[string]*s3Staged)
+	if err := os.MkdirAll(s.conf.StagingPath, 0755); err != nil {
+		return err
+	}
+	err := filepath.Walk(s.conf.StagingPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(s.conf.StagingPath, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		s.staged[name] = &s3Staged{name: name, size: info.Size()}
+		return nil
+	})
+	if len(s.staged) > 0 {
+		log.Infof("Found %d staged S3 objects", len(s.staged))
+	}
+	return err
+}
+
+// Push appends the messages to the staged objects of the partitions and uploads
+// the objects reached the size or the age. Messages of the failed object
+// and of the following ones are retried. Messages with the invalid partition are dropped.
+func (s *S3Client) Push(l map[int64]LogMessage) error {
+	objects, rejected, err := s.objects(l)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Staging %d messages in %d S3 objects", len(l)-len(rejected), len(objects))
+	for i, object := range objects {
+		if err := s.stage(object); err != nil {
+			failed := make(map[int64]LogMessage)
+			for _, o := range objects[i:] {
+				for _, k := range o.keys {
+					failed[k] = l[k]
+				}
+			}
+			return &PushError{Failed: failed, Rejected: rejected, Err: err}
+		}
+	}
+
+	// Staged messages are kept on the failed upload
+	s.uploadStaged()
+	if len(rejected) > 0 {
+		return &PushError{Rejected: rejected, Err: fmt.Errorf("Can't render the S3 key of %d messages", len(rejected))}
+	}
+	return nil
+}
+
+// Flush uploads the staged objects reached the size or the age
+func (s *S3Client) Flush() error {
+	return s.uploadStaged()
+}
+
+// objects groups the messages into the NDJSON objects by the partition.
+// Returns the messages with the partition failed to render.
+func (s *S3Client) objects(l map[int64]LogMessage) ([]*s3Object, map[int64]LogMessage, error) {
+	index := make(map[string]*s3Object)
+	var objects []*s3Object
+	rejected := make(map[int64]LogMessage)
+	for _, key := range sortedKeys(l) {
+		m := l[key]
+		partition, err := s.key.render(m)
+		dir := s.conf.Prefix + strings.Trim(partition, "/")
+		if err == nil && !s3ValidDir(dir) {
+			err = errors.New("wrong object name " + dir)
+		}
+		if err != nil {
+			log.Errorf("Can't render the key of the %s/%s-%s: %s", m.Namespace, m.PodName, m.Container, err.Error())
+			rejected[key] = m
+			continue
+		}
+		data, err := json.Marshal(m)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		o, ok := index[dir]
+		if !ok {
+			o = &s3Object{dir: dir}
+			index[dir] = o
+			objects = append(objects, o)
+		}
+		o.keys = append(o.keys, key)
+		o.data.Write(data)
+		o.data.WriteByte('\n')
+	}
+	return objects, rejected, nil
+}
+
+// s3ValidDir returns false if the object name can't be the staging file path
+func s3ValidDir(dir string) bool {
+	for _, e := range strings.Split(dir, "/") {
+		if e == "" || e == "." || e == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// stage appends the object to the staged one of its partition.
+// The compressed data is appended as the gzip member.
+func (s *S3Client) stage(o *s3Object) error {
+	st, ok := s.current[o.dir]
+	if !ok {
+		name := o.dir + "/" + time.Now().UTC().Format("20060102T150405Z") + "-" + uuid.New().String() + ".ndjson"
+		if s.conf.Compression == GZIP_S3_COMPRESSION {
+			name += ".gz"
+		}
+		st = &s3Staged{name: name, created: time.Now()}
+	}
+
+	data := o.data.Bytes()
+	if s.conf.Compression == GZIP_S3_COMPRESSION {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		gz.Write(data)
+		if err := gz.Close(); err != nil {
+			return err
+		}
+		data = buf.Bytes()
+	}
+
+	path := s.stagingPath(st.name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(data); err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		// Drop the partial write, the messages are retried
+		file.Truncate(st.size)
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	st.size += int64(len(data))
+	s.current[o.dir] = st
+	s.staged[st.name] = st
+	return nil
+}
+
+// uploadStaged uploads the staged objects reached the size or the age in order of the names.
+// Failed objects are kept and uploaded on the next flush.
+func (s *S3Client) uploadStaged() error {
+	maxSize := int64(s.conf.ObjectSize) << 20
+	maxAge := time.Second * time.Duration(s.conf.ObjectAge)
+	var names []string
+	for name, st := range s.staged {
+		if st.size >= maxSize || time.Since(st.created) >= maxAge {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var err error
+	for _, name := range names {
+		if e := s.uploadStagedObject(s.staged[name]); e != nil {
+			log.Errorf("Can't upload the S3 object %s: %s", name, e.Error())
+			err = e
+		}
+	}
+	return err
+}
+
+// uploadStagedObject uploads the object and removes it from the staging directory
+func (s *S3Client) uploadStagedObject(st *s3Staged) error {
+	path := s.stagingPath(st.name)
+	// New messages of the partition go to the next object
+	dir := st.name[:strings.LastIndex(st.name, "/")]
+	if s.current[dir] == st {
+		delete(s.current, dir)
+	}
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := s.upload(st.name, body); err != nil {
+		return err
+	}
+
+	delete(s.staged, st.name)
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	// Remove the empty partition directories
+	for dir := filepath.Dir(path); dir != s.conf.StagingPath; dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+func (s *S3Client) stagingPath(name string) string {
+	return filepath.Join(s.conf.StagingPath, filepath.FromSlash(name))
+}
+
+// upload puts the object at once or with the multipart upload
+func (s *S3Client) upload(name string, body []byte) error {
+	contentType := "application/x-ndjson"
+	if strings.HasSuffix(name, ".gz") {
+		contentType = "application/gzip"
+	}
+
+	log.Infof("Uploading the S3 object %s of %d bytes", name, len(body))
+	partSize := s.conf.PartSize << 20
+	if len(body) <= partSize {
+		_, err := s.do(http.MethodPut, name, nil, contentType, body)
+		return err
+	}
+	return s.multipartUpload(name, contentType, body, partSize)
+}
+
+func (s *S3Client) multipartUpload(name, contentType string, body []byte, partSize int) error {
+	resp, err := s.do(http.MethodPost, name, url.Values{"uploads": {""}}, contentType, nil)
+	if err != nil {
+		return err
+	}
+	var initiate struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.Unmarshal(resp, &initiate); err != nil || initiate.UploadID == "" {
+		return fmt.Errorf("Can't initiate the multipart upload of %s: %v", name, err)
+	}
+
+	type part struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	}
+	complete := struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []part   `xml:"Part"`
+	}{}
+
+	for offset, number := 0, 1; offset < len(body); offset, number = offset+partSize, number+1 {
+		end := offset + partSize
+		if end > len(body) {
+			end = len(body)
+		}
+		query := url.Values{
+			"partNumber": {strconv.Itoa(number)},
+			"uploadId":   {initiate.UploadID},
+		}
+		etag, err := s.uploadPart(name, query, body[offset:end])
+		if err != nil {
+			s.abort(name, initiate.UploadID)
+			return err
+		}
+		complete.Parts = append(complete.Parts, part{PartNumber: number, ETag: etag})
+	}
+
+	data, err := xml.Marshal(complete)
+	if err != nil {
+		s.abort(name, initiate.UploadID)
+		return err
+	}
+	resp, err = s.do(http.MethodPost, name, url.Values{"uploadId": {initiate.UploadID}}, "application/xml", data)
+	if err == nil {
+		// Complete responds 200 with the error in the body
+		var e s3Error
+		if xml.Unmarshal(resp, &e) == nil && e.Code != "" {
+			err = fmt.Errorf("S3 error %s: %s", e.Code, e.Message)
+		}
+	}
+	if err != nil {
+		s.abort(name, initiate.UploadID)
+	}
+	return err
+}
+
+func (s *S3Client) uploadPart(name string, query url.Values, body []byte) (string, error) {
+	req, err := s.request(http.MethodPut, name, query, "", body)
+	if err != nil {
+		return "", err
+	}
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode != http.StatusOK {
+		return "", s3ResponseError(resp.StatusCode, data)
+	}
+	return resp.Header.Get("ETag"), nil
+}
+
+func (s *S3Client) abort(name, uploadID string) {
+	if _, err := s.do(http.MethodDelete, name, url.Values{"uploadId": {uploadID}}, "", nil); err != nil {
+		log.Error("Can't abort the multipart upload: ", err)
+	}
+}
+
+// do sends the signed request and returns the response body
+func (s *S3Client) do(method, name string, query url.Values, contentType string, body []byte) ([]byte, error) {
+	req, err := s.request(method, name, query, contentType, body)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, s3ResponseError(resp.StatusCode, data)
+	}
+	return data, nil
+}
+
+// request creates the request of the object signed with the AWS Signature Version 4
+func (s *S3Client) request(method, name string, query url.Values, contentType string, body []byte) (*http.Request, error) {
+	u := *s.endpoint
+	path := strings.TrimRight(u.Path, "/")
+	if s.conf.PathStyle {
+		path += "/" + s.conf.Bucket + "/" + name
+	} else {
+		u.Host = s.conf.Bucket + "." + u.Host
+		path += "/" + name
+	}
+	u.Path = path
+	u.RawPath = s3Escape(path, false)
+	u.RawQuery = s3Query(query)
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	// Storage class is set on the put or on the initiation of the multipart upload
+	if s.conf.StorageClass != "" && (query == nil || query["uploads"] != nil) {
+		req.Header.Set("X-Amz-Storage-Class", s.conf.StorageClass)
+	}
+	s.sign(req, body, time.Now().UTC())
+	return req, nil
+}
+
+func (s *S3Client) sign(req *http.Request, body []byte, now time.Time) {
+	payloadHash := sha256.Sum256(body)
+	amzDate := now.Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(req.Header.Get(name))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+
+	scope := date + "/" + s.conf.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSHA256(key, s.conf.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Escape encodes everything except the unreserved characters,
+// the slashes are kept in the path
+func s3Escape(v string, slash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(v); i++ {
+		c := v[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !slash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3Query returns the canonical query string sorted by the keys
+func s3Query(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, s3Escape(k, true)+"="+s3Escape(query.Get(k), true))
+	}
+	return strings.Join(pairs, "&")
+}
+
+func s3ResponseError(status int, data []byte) error {
+	var e s3Error
+	if xml.Unmarshal(data, &e) == nil && e.Code != "" {
+		return fmt.Errorf("S3 responded %d %s: %s", status, e.Code, e.Message)
+	}
+	return fmt.Errorf("S3 responded %d", status)
+}
@@ -3,8 +3,9 @@ package beater
 import (
 	"encoding/json"
 	"flag"
-	"fmt"
+	"math"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -19,25 +20,66 @@ import (
 const (
 	ELASTIC_ENV_USERNAME = "KUBEAT_ELASTIC_USERNAME"
 	ELASTIC_ENV_PASSWORD = "KUBEAT_ELASTIC_PASSWORD"
+	KAFKA_ENV_USERNAME   = "KUBEAT_KAFKA_USERNAME"
+	KAFKA_ENV_PASSWORD   = "KUBEAT_KAFKA_PASSWORD"
+	HTTP_ENV_TOKEN       = "KUBEAT_HTTP_TOKEN"
+	FORWARD_ENV_KEY      = "KUBEAT_FORWARD_SHARED_KEY"
+	S3_ENV_ACCESS_KEY    = "KUBEAT_S3_ACCESS_KEY"
+	S3_ENV_SECRET_KEY    = "KUBEAT_S3_SECRET_KEY"
 )
 
 type LogMessage struct {
-	PodName    string                 `json:"pod_name"`
-	Namespace  string                 `json:"namespace"`
-	Container  string                 `json:"container"`
-	Message    string                 `json:"message"`
-	SenderTime time.Time              `json:"sender_time"`
-	Meta       map[string]interface{} `json:"meta"`
+	PodName     string                 `json:"pod_name"`
+	Namespace   string                 `json:"namespace"`
+	Container   string                 `json:"container"`
+	ContainerID string                 `json:"container_id,omitempty"`
+	Message     string                 `json:"message"`
+	Level       string                 `json:"level,omitempty"`
+	Fields      map[string]interface{} `json:"fields,omitempty"`
+	Timestamp   time.Time              `json:"@timestamp"`
+	SenderTime  time.Time              `json:"sender_time"`
+	Meta        map[string]interface{} `json:"meta"`
+	// Terminated is set for the logs of the crashed container instance
+	Terminated *TerminatedState `json:"terminated,omitempty"`
+
+	// logTime is the Kubernetes timestamp kept for the checkpoints
+	logTime time.Time
+	// labels of the pod for the outputs routing
+	labels map[string]string
 }
 
+// TerminatedState describes the terminated container instance
+type TerminatedState struct {
+	ExitCode     int32     `json:"exit_code"`
+	Signal       int32     `json:"signal,omitempty"`
+	Reason       string    `json:"reason"`
+	RestartCount int32     `json:"restart_count"`
+	FinishedAt   time.Time `json:"finished_at"`
+}
+
+// Sender buffers and pushes the messages to the single output
 type Sender struct {
+	// rejected is the number of the messages dropped by the output,
+	// first for the 64-bit alignment of the atomic counter
+	rejected uint64
+
 	Client SenderClient
 	Config *SenderConfig
-	box    *box
-	mux    sync.Mutex
+	buffer *buffer
+	// flushMux serializes the pushes, so the batches are sent in order
+	flushMux sync.Mutex
+
+	checkpoints *Checkpoints
+	pipeline    Pipeline
+	spool       *spool
+	deadLetter  *deadLetter
+	// name of the output for the checkpoints
+	name string
 }
 
 type SenderConfig struct {
+	// Name of the output, required for the multiple outputs
+	Name     string   `json:"name"`
 	Type     string   `json:"type"`
 	Hosts    []string `json:"hosts"`
 	Username string   `json:"username"`
@@ -45,6 +87,36 @@ type SenderConfig struct {
 	Index    string   `json:"index"`
 	DocType  string   `json:"doc_type"`
 	Limit    int      `json:"limit"`
+
+	// BufferSize and BufferBytes limit the in-memory messages
+	BufferSize  int `json:"buffer_size"`
+	BufferBytes int `json:"buffer_bytes"`
+	// BatchBytes is the batch size limit in bytes
+	BatchBytes int `json:"batch_bytes"`
+	// FlushInterval in seconds
+	FlushInterval int `json:"flush_interval"`
+
+	Retry        RetryConfig        `json:"retry"`
+	Spool        SpoolConfig        `json:"spool"`
+	Backpressure BackpressureConfig `json:"backpressure"`
+
+	TCP     TCPConfig     `json:"tcp"`
+	UDP     UDPConfig     `json:"udp"`
+	Kafka   KafkaConfig   `json:"kafka"`
+	Loki    LokiConfig    `json:"loki"`
+	Syslog  SyslogConfig  `json:"syslog"`
+	HTTP    HTTPConfig    `json:"http"`
+	Forward ForwardConfig `json:"forward"`
+	OTLP    OTLPConfig    `json:"otlp"`
+	File    FileConfig    `json:"file"`
+	S3      S3Config      `json:"s3"`
+
+	// Outputs replace the single output described by the config
+	Outputs []SenderConfig `json:"outputs"`
+	// Route selects the messages of the output
+	Route *RouteConfig `json:"route"`
+
+	Processors []ProcessorConfig `json:"processors"`
 }
 
 func GetSenderConfigFromFlags() *SenderConfig {
@@ -63,6 +135,30 @@ func GetSenderConfigFromFlags() *SenderConfig {
 	return sc
 }
 
+// setBufferDefaults sets the defaults of the unset buffer limits
+func (sc *SenderConfig) setBufferDefaults() {
+	if sc.Limit <= 0 {
+		sc.Limit = DEFAULT_BATCH_LIMIT
+	}
+	if sc.BufferSize <= 0 {
+		sc.BufferSize = sc.Limit * 10
+	}
+	if sc.BatchBytes <= 0 {
+		sc.BatchBytes = DEFAULT_BATCH_BYTES
+	}
+	if sc.BufferBytes <= 0 {
+		sc.BufferBytes = DEFAULT_BUFFER_BYTES
+	}
+	if sc.BufferBytes < sc.BatchBytes {
+		sc.BufferBytes = sc.BatchBytes
+	}
+	if sc.FlushInterval <= 0 {
+		sc.FlushInterval = 60
+	}
+	sc.Retry.setDefaults()
+	sc.Backpressure.setDefaults()
+}
+
 func GetTickFromFlags() int {
 	tick := flag.Lookup("tick-time").Value.String()
 	if tick != "" {
@@ -75,142 +171,330 @@ func GetTickFromFlags() int {
 	return 0
 }
 
-func isWatcherEnabled() bool {
-	// watcher := flag.Lookup("enable-watcher").Value.String()
-	// if watcher == "true" {
-	// 	return true
-	// }
-	return false
-}
-
 type SenderClient interface {
 	Connect(*SenderConfig) error
 	Push(map[int64]LogMessage) error
 }
 
-func (p *PodLogs) NewSender() (err error) {
-	var sender Sender
+// clientFlusher is the client holding the pushed messages before the upload,
+// Flush is called on every flush interval
+type clientFlusher interface {
+	Flush() error
+}
+
+// NewSender creates the outputs router from the sender config
+func (p *PodLogs) NewSender() error {
+	processors, err := getPipelineConfig(p.sc)
+	if err != nil {
+		return err
+	}
+	p.router, err = NewRouter(p.sc, p.checkpoints, processors)
+	return err
+}
+
+// newSender creates the sender of the output
+func newSender(sc *SenderConfig, checkpoints *Checkpoints, processors []ProcessorConfig) (*Sender, error) {
 	var client SenderClient
-	switch p.sc.Type {
+	switch sc.Backpressure.Policy {
+	case "", BLOCK_POLICY, DROP_OLDEST_POLICY, DROP_NEWEST_POLICY:
+	default:
+		return nil, errors.New("Wrong backpressure policy")
+	}
+
+	switch sc.Type {
 	case "elasticsearch":
 		e := &ElasticClient{}
-		e.prefix = p.sc.Index
-		e.docType = p.sc.DocType
+		e.prefix = sc.Index
+		e.docType = sc.DocType
 
-		if p.sc.Username == "" || p.sc.Password == "" {
-			p.sc.Username, p.sc.Password = getESCredsFromEnv()
+		if sc.Username == "" || sc.Password == "" {
+			sc.Username, sc.Password = getESCredsFromEnv()
 		}
 
 		client = SenderClient(e)
 	case "tcp":
-		c := &TCPClient{}
-		c.conf = p.sc
-		client = SenderClient(c)
+		client = SenderClient(&TCPClient{})
+	case "unix":
+		client = SenderClient(&TCPClient{Network: "unix"})
+	case "udp":
+		client = SenderClient(&UDPClient{})
+	case "kafka":
+		client = SenderClient(&KafkaClient{})
+	case "loki":
+		client = SenderClient(&LokiClient{})
+	case "syslog":
+		client = SenderClient(&SyslogClient{})
+	case "http":
+		client = SenderClient(&HTTPClient{})
+	case "forward":
+		client = SenderClient(&ForwardClient{})
+	case "otlp":
+		client = SenderClient(&OTLPClient{})
+	case "stdout":
+		client = SenderClient(&FileClient{Stdout: true})
+	case "file":
+		client = SenderClient(&FileClient{})
+	case "s3":
+		client = SenderClient(&S3Client{})
 	default:
-		return errors.New("Wrong sender type")
+		return nil, errors.New("Wrong sender type")
 	}
 
-	if err := client.Connect(p.sc); err != nil {
-		return err
+	pipeline, err := NewPipeline(processors)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := client.Connect(sc); err != nil {
+		return nil, err
+	}
+
+	sender := &Sender{}
+	if sc.Spool.Path != "" {
+		if sender.spool, err = newSpool(sc.Spool); err != nil {
+			return nil, err
+		}
+	}
+	if sc.Retry.DeadLetter != "" {
+		if sender.deadLetter, err = newDeadLetter(sc.Retry.DeadLetter); err != nil {
+			return nil, err
+		}
 	}
 
+	sc.setBufferDefaults()
 	sender.Client = client
-	sender.box = newBox(p.sc)
-	p.sender = &sender
-	return
+	sender.Config = sc
+	sender.buffer = newBuffer(sc, sender.spool)
+	sender.checkpoints = checkpoints
+	sender.pipeline = pipeline
+	sender.name = sc.Name
+	return sender, nil
 }
 
-func (s *Sender) Send(ns, pod, message, con string) {
-	l := LogMessage{
-		Namespace:  ns,
-		PodName:    pod,
-		Message:    message,
-		Container:  con,
-		SenderTime: time.Now(),
+// SendMessage runs the message through the pipeline, adds it into the buffer
+// and pushes the full batches. It blocks while the buffer is full
+// and the spool is disabled.
+func (s *Sender) SendMessage(l LogMessage) {
+	// Lines read again after the restart for the other outputs
+	if s.checkpoints.Shipped(s.name, l) {
+		return
 	}
+	if !s.pipeline.Process(&l) {
+		return
+	}
+	s.buffer.Add(l)
 
-	s.add(l)
-
-	if s.box.len >= s.box.limit {
-		err := s.Client.Push(s.copyCon())
-		if err != nil {
+	// The spool is drained by the Ticker, do not wait for it here
+	if s.spool.Empty() && s.isBatchFull() {
+		if err := s.flush(false); err != nil {
 			log.Error(err)
-			return
 		}
-		s.clean()
 	}
 }
 
-func (s *Sender) copyCon() map[int64]LogMessage {
-	s.mux.Lock()
-	defer s.mux.Unlock()
-	newMap := make(map[int64]LogMessage)
-	for k, v := range s.box.con {
-		newMap[k] = v
+// isBatchFull returns true if the buffer holds the full batch
+func (s *Sender) isBatchFull() bool {
+	count, bytes := s.buffer.Len()
+	return count >= s.Config.Limit || bytes >= s.Config.BatchBytes
+}
+
+// Flush pushes all the buffered messages
+func (s *Sender) Flush() error {
+	if err := s.flush(true); err != nil {
+		return err
 	}
+	if f, ok := s.Client.(clientFlusher); ok {
+		s.flushMux.Lock()
+		defer s.flushMux.Unlock()
+		return f.Flush()
+	}
+	return nil
+}
 
-	return newMap
+// Wait blocks the reader while the buffer is above the high watermark
+func (s *Sender) Wait() {
+	s.buffer.Wait()
 }
 
-func (s *Sender) Ticker() {
-	ticker := time.NewTicker(time.Second * 60)
-	for tick := range ticker.C {
-		if s.len() > 0 {
-			err := s.Client.Push(s.box.con)
-			if err != nil {
-				log.Error(err, " On tick ", tick.Unix())
-			}
-			s.clean()
-		}
-	}
+// Pressured returns true if the readers must be paused
+func (s *Sender) Pressured() bool {
+	return s.buffer.Pressured()
 }
 
-func logSender(ns, pod, message, con string) error {
-	log := LogMessage{
-		Namespace:  ns,
-		PodName:    pod,
-		Message:    message,
-		Container:  con,
-		SenderTime: time.Now(),
+// Dropped returns the number of the messages dropped by the backpressure policy
+func (s *Sender) Dropped() uint64 {
+	return s.buffer.Dropped()
+}
+
+// Rejected returns the number of the messages dropped by the output
+// after the permanent errors or the exhausted retries
+func (s *Sender) Rejected() uint64 {
+	return atomic.LoadUint64(&s.rejected)
+}
+
+// Close spills the buffered messages into the spool if it is enabled
+// or pushes them
+func (s *Sender) Close() error {
+	if s.spool == nil {
+		return s.Flush()
 	}
-	data, err := json.Marshal(log)
-	if err != nil {
+
+	s.flushMux.Lock()
+	defer s.flushMux.Unlock()
+	if err := s.buffer.Spill(); err != nil {
 		return err
 	}
+	return s.spool.Close()
+}
+
+// flush pushes the batches from the buffer head in order, then drains the spool.
+// Messages are removed from the buffer only when they were pushed,
+// so the failed batch is pushed again on the next flush
+// or spilled into the spool if it is enabled.
+func (s *Sender) flush(all bool) error {
+	s.flushMux.Lock()
+	defer s.flushMux.Unlock()
+
+	for all || s.isBatchFull() {
+		batch := s.buffer.Peek(s.Config.Limit, s.Config.BatchBytes)
+		if len(batch) > 0 {
+			if err := s.push(batch, s.pushed); err != nil {
+				if err := s.buffer.Spill(); err != nil {
+					log.Error(err)
+				}
+				return err
+			}
+			continue
+		}
+		if !all {
+			return nil
+		}
 
-	fmt.Println(string(data))
+		batch, err := s.spool.Peek(s.Config.Limit, s.Config.BatchBytes)
+		if err != nil {
+			return err
+		}
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := s.push(batch, s.spoolPushed); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-type box struct {
-	con   map[int64]LogMessage
-	len   int
-	limit int
-	mux   sync.Mutex
+// push pushes the batch with the retries. Only the failed messages
+// are retried, done is called with the pushed and failed messages after every attempt.
+// Rejected messages and the messages failed after the retries are dropped,
+// unless the KeepExhausted is set.
+func (s *Sender) push(batch map[int64]LogMessage, done func(batch, failed map[int64]LogMessage)) error {
+	retry := s.Config.Retry
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		err := s.Client.Push(batch)
+		failed := failedMessages(batch, err)
+		rejected := rejectedMessages(batch, err)
+
+		exhausted := len(failed) > 0 &&
+			(attempt >= retry.MaxAttempts || time.Since(start) >= retry.maxElapsed())
+		if exhausted && !retry.KeepExhausted {
+			rejected = joinMessages(rejected, failed)
+			failed = nil
+		}
+		if len(rejected) > 0 {
+			s.reject(rejected, err)
+		}
+		done(batch, failed)
+
+		// The flush is stopped after the retries while the receiver is down
+		if exhausted {
+			return err
+		}
+		if len(failed) == 0 {
+			return nil
+		}
+		backoff := retry.backoff(attempt)
+		log.Warnf("Push failed, retrying %d messages in %s: %s", len(failed), backoff, err.Error())
+		time.Sleep(backoff)
+		batch = failed
+	}
+}
+
+// reject counts the dropped messages and writes them into the dead letter file
+func (s *Sender) reject(l map[int64]LogMessage, err error) {
+	atomic.AddUint64(&s.rejected, uint64(len(l)))
+	log.Errorf("Dropped %d messages: %s", len(l), err.Error())
+	if s.deadLetter == nil {
+		return
+	}
+	if err := s.deadLetter.Write(s.name, err, l); err != nil {
+		log.Error("Can't write the dead letter file: ", err)
+	}
 }
 
-func newBox(conf *SenderConfig) *box {
-	return &box{
-		con:   make(map[int64]LogMessage),
-		limit: conf.Limit,
+// pushed removes the pushed messages from the buffer. Checkpoints are moved
+// only to the messages sent before the first failed one, so nothing is skipped
+// on the restart.
+func (s *Sender) pushed(batch, failed map[int64]LogMessage) {
+	firstFailed := firstKey(failed)
+
+	var keys []int64
+	checkpoints := make(map[int64]LogMessage)
+	for k, v := range batch {
+		if _, ok := failed[k]; ok {
+			continue
+		}
+		keys = append(keys, k)
+		if k < firstFailed {
+			checkpoints[k] = v
+		}
 	}
+
+	s.buffer.Remove(keys)
+	s.checkpoints.Update(s.name, checkpoints)
 }
 
-func (s *Sender) len() int {
-	s.box.len = len(s.box.con)
-	return s.box.len
+// spoolPushed moves the spool read position after the last message
+// pushed before the first failed one. The rest is read again on the next flush.
+func (s *Sender) spoolPushed(batch, failed map[int64]LogMessage) {
+	firstFailed := firstKey(failed)
+
+	var last int64
+	checkpoints := make(map[int64]LogMessage)
+	for k, v := range batch {
+		if k >= firstFailed {
+			continue
+		}
+		if k > last {
+			last = k
+		}
+		checkpoints[k] = v
+	}
+
+	if last > 0 {
+		s.spool.Commit(last)
+	}
+	s.checkpoints.Update(s.name, checkpoints)
 }
 
-func (s *Sender) add(l LogMessage) {
-	s.box.mux.Lock()
-	defer s.box.mux.Unlock()
-	s.box.con[time.Now().UnixNano()] = l
-	s.box.len = len(s.box.con)
+// firstKey returns the lowest key of the batch or MaxInt64 if it is empty
+func firstKey(batch map[int64]LogMessage) int64 {
+	first := int64(math.MaxInt64)
+	for k := range batch {
+		if k < first {
+			first = k
+		}
+	}
+	return first
 }
 
-func (s *Sender) clean() {
-	s.box.mux.Lock()
-	defer s.box.mux.Unlock()
-	s.box.con = make(map[int64]LogMessage)
-	s.box.len = 0
+// Ticker pushes the buffered messages every flush interval
+func (s *Sender) Ticker() {
+	ticker := time.NewTicker(time.Second * time.Duration(s.Config.FlushInterval))
+	for tick := range ticker.C {
+		if err := s.Flush(); err != nil {
+			log.Error(err, " On tick ", tick.Unix())
+		}
+	}
 }
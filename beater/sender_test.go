@@ -0,0 +1,158 @@
+package beater
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// stubClient returns the errors of the push function
+type stubClient struct {
+	push   func(l map[int64]LogMessage) error
+	pushes int
+}
+
+func (c *stubClient) Connect(*SenderConfig) error { return nil }
+
+func (c *stubClient) Push(l map[int64]LogMessage) error {
+	c.pushes++
+	return c.push(l)
+}
+
+func newTestSender(client SenderClient, retry RetryConfig) *Sender {
+	sc := &SenderConfig{Retry: retry}
+	sc.Retry.InitialInterval = 0.001
+	sc.setBufferDefaults()
+	return &Sender{
+		Client: client,
+		Config: sc,
+		buffer: newBuffer(sc, nil),
+	}
+}
+
+func sendTestMessages(s *Sender, messages ...string) {
+	for _, m := range messages {
+		s.SendMessage(LogMessage{Namespace: "default", PodName: "app", Container: "app", Message: m})
+	}
+}
+
+func TestSenderDropsExhausted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dead", "letter.json")
+	client := &stubClient{push: func(map[int64]LogMessage) error { return errors.New("down") }}
+	s := newTestSender(client, RetryConfig{MaxAttempts: 3})
+	var err error
+	if s.deadLetter, err = newDeadLetter(path); err != nil {
+		t.Fatal(err)
+	}
+	s.name = "es"
+
+	sendTestMessages(s, "a", "b")
+	if err := s.Flush(); err == nil {
+		t.Fatal("Flush must return the error of the exhausted retries")
+	}
+	if client.pushes != 3 {
+		t.Errorf("pushes = %d, want 3", client.pushes)
+	}
+	if count, _ := s.buffer.Len(); count != 0 {
+		t.Errorf("buffer has %d messages, want 0", count)
+	}
+	if s.Rejected() != 2 {
+		t.Errorf("Rejected() = %d, want 2", s.Rejected())
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var records []deadLetterRecord
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var r deadLetterRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, r)
+	}
+	if len(records) != 2 {
+		t.Fatalf("dead letter has %d records, want 2", len(records))
+	}
+	for i, want := range []string{"a", "b"} {
+		r := records[i]
+		if r.Message.Message != want || r.Output != "es" || r.Error != "down" {
+			t.Errorf("record %d = %+v", i, r)
+		}
+	}
+}
+
+func TestSenderKeepsExhausted(t *testing.T) {
+	client := &stubClient{push: func(map[int64]LogMessage) error { return errors.New("down") }}
+	s := newTestSender(client, RetryConfig{MaxAttempts: 2, KeepExhausted: true})
+
+	sendTestMessages(s, "a", "b")
+	if err := s.Flush(); err == nil {
+		t.Fatal("Flush must return the error of the exhausted retries")
+	}
+	if count, _ := s.buffer.Len(); count != 2 {
+		t.Errorf("buffer has %d messages, want 2", count)
+	}
+	if s.Rejected() != 0 {
+		t.Errorf("Rejected() = %d, want 0", s.Rejected())
+	}
+}
+
+func TestSenderRejected(t *testing.T) {
+	client := &stubClient{}
+	client.push = func(l map[int64]LogMessage) error {
+		if client.pushes > 1 {
+			return nil
+		}
+		rejected := make(map[int64]LogMessage)
+		failed := make(map[int64]LogMessage)
+		for k, v := range l {
+			switch v.Message {
+			case "poison":
+				rejected[k] = v
+			case "retry":
+				failed[k] = v
+			}
+		}
+		return &PushError{Failed: failed, Rejected: rejected, Err: errors.New("rejected")}
+	}
+	s := newTestSender(client, RetryConfig{})
+
+	sendTestMessages(s, "ok", "poison", "retry")
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if client.pushes != 2 {
+		t.Errorf("pushes = %d, want 2", client.pushes)
+	}
+	if count, _ := s.buffer.Len(); count != 0 {
+		t.Errorf("buffer has %d messages, want 0", count)
+	}
+	if s.Rejected() != 1 {
+		t.Errorf("Rejected() = %d, want 1", s.Rejected())
+	}
+}
+
+func TestSenderPermanentError(t *testing.T) {
+	client := &stubClient{push: func(map[int64]LogMessage) error {
+		return &PermanentError{Err: errors.New("too large")}
+	}}
+	s := newTestSender(client, RetryConfig{})
+
+	sendTestMessages(s, "a", "b", "c")
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if client.pushes != 1 {
+		t.Errorf("pushes = %d, want 1", client.pushes)
+	}
+	if s.Rejected() != 3 {
+		t.Errorf("Rejected() = %d, want 3", s.Rejected())
+	}
+}
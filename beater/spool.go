@@ -0,0 +1,494 @@
+package beater
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	DEFAULT_SPOOL_SEGMENT_BYTES = 16 << 20
+	DEFAULT_SPOOL_MAX_BYTES     = 1 << 30
+
+	spoolSegmentExt = ".seg"
+	spoolHeadFile   = "head.json"
+	// spoolBaseIndex is the first segment index,
+	// segments are prepended with the lower indexes
+	spoolBaseIndex int64 = 1 << 32
+)
+
+// SpoolConfig is the on-disk queue of the messages
+// which can't be pushed or kept in the memory buffer.
+// Spool is disabled if the Path is empty.
+type SpoolConfig struct {
+	Path         string `json:"path"`
+	SegmentBytes int64  `json:"segment_bytes"`
+	MaxBytes     int64  `json:"max_bytes"`
+}
+
+// spoolRecord is the line of the segment file
+type spoolRecord struct {
+	Message LogMessage        `json:"message"`
+	LogTime time.Time         `json:"log_time"`
+	Labels  map[string]string `json:"labels,omitempty"`
+}
+
+type spoolSegment struct {
+	index int64
+	size  int64
+}
+
+// spoolHead is the read position persisted between the restarts
+type spoolHead struct {
+	Index  int64 `json:"index"`
+	Offset int64 `json:"offset"`
+}
+
+// spoolPosition is the end of the record read by the Peek
+type spoolPosition struct {
+	index  int64
+	offset int64
+}
+
+// spool is the write-ahead queue of the segment files with the JSON lines.
+// Messages are read from the head segment and appended to the tail one.
+// The oldest segments are evicted when the spool exceeds the MaxBytes.
+type spool struct {
+	dir          string
+	segmentBytes int64
+	maxBytes     int64
+
+	segments []*spoolSegment
+	head     spoolHead
+	tail     *os.File
+	// peeked are the positions of the records returned by the last Peek
+	peeked map[int64]spoolPosition
+	seq    int64
+	mux    sync.Mutex
+}
+
+// newSpool opens the spool directory and restores the segments and the read position
+func newSpool(conf SpoolConfig) (*spool, error) {
+	s := &spool{
+		dir:          conf.Path,
+		segmentBytes: conf.SegmentBytes,
+		maxBytes:     conf.MaxBytes,
+		peeked:       make(map[int64]spoolPosition),
+	}
+	if s.segmentBytes <= 0 {
+		s.segmentBytes = DEFAULT_SPOOL_SEGMENT_BYTES
+	}
+	if s.maxBytes <= 0 {
+		s.maxBytes = DEFAULT_SPOOL_MAX_BYTES
+	}
+	if s.maxBytes < s.segmentBytes {
+		s.maxBytes = s.segmentBytes
+	}
+
+	if err := os.MkdirAll(s.dir, 0750); err != nil {
+		return nil, err
+	}
+
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), spoolSegmentExt) {
+			continue
+		}
+		index, err := strconv.ParseInt(strings.TrimSuffix(f.Name(), spoolSegmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		s.segments = append(s.segments, &spoolSegment{index: index, size: f.Size()})
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i].index < s.segments[j].index })
+
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, spoolHeadFile))
+	if err == nil {
+		if err := json.Unmarshal(data, &s.head); err != nil {
+			log.Error("Wrong spool head, reading from the start: ", err)
+			s.head = spoolHead{}
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(s.segments) > 0 && s.head.Index != s.segments[0].index {
+		s.head = spoolHead{Index: s.segments[0].index}
+	}
+	s.removeConsumed()
+
+	log.Infof("Spool %s opened with %d segments, %d bytes", s.dir, len(s.segments), s.bytes())
+	return s, nil
+}
+
+func (s *spool) segmentPath(index int64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", index, spoolSegmentExt))
+}
+
+// bytes returns the size of the unread records
+func (s *spool) bytes() int64 {
+	var size int64
+	for _, seg := range s.segments {
+		size += seg.size
+	}
+	return size - s.head.Offset
+}
+
+// Empty returns true if there are no unread records
+func (s *spool) Empty() bool {
+	if s == nil {
+		return true
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return len(s.segments) == 0
+}
+
+// Write appends the messages to the tail segment
+func (s *spool) Write(msgs ...LogMessage) error {
+	data, err := marshalSpoolRecords(msgs)
+	if err != nil {
+		return err
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.write(data)
+}
+
+// write appends the data to the tail segment. The new segment is started
+// if the tail is full or was not opened since the start, so the records
+// are never appended to the line broken by the crash.
+func (s *spool) write(data []byte) error {
+	last := len(s.segments) - 1
+	if s.tail == nil || s.segments[last].size+int64(len(data)) > s.segmentBytes {
+		index := spoolBaseIndex
+		if last >= 0 {
+			index = s.segments[last].index + 1
+		}
+		if err := s.openTail(index); err != nil {
+			return err
+		}
+	}
+
+	if _, err := s.tail.Write(data); err != nil {
+		return err
+	}
+	s.segments[len(s.segments)-1].size += int64(len(data))
+	s.evict()
+	return nil
+}
+
+// openTail closes the current tail and creates the new segment
+func (s *spool) openTail(index int64) error {
+	if s.tail != nil {
+		s.tail.Sync()
+		s.tail.Close()
+		s.tail = nil
+	}
+
+	f, err := os.OpenFile(s.segmentPath(index), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	s.tail = f
+	s.segments = append(s.segments, &spoolSegment{index: index})
+	if len(s.segments) == 1 {
+		s.head = spoolHead{Index: index}
+	}
+	return nil
+}
+
+// Prepend writes the messages before the unread records.
+// The read part of the head segment is cut off first.
+func (s *spool) Prepend(msgs []LogMessage) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+	data, err := marshalSpoolRecords(msgs)
+	if err != nil {
+		return err
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if len(s.segments) == 0 {
+		return s.write(data)
+	}
+
+	if s.head.Offset > 0 {
+		if err := s.cutHead(); err != nil {
+			return err
+		}
+	}
+
+	index := s.segments[0].index - 1
+	if err := writeFileSync(s.segmentPath(index), data); err != nil {
+		return err
+	}
+	s.segments = append([]*spoolSegment{{index: index, size: int64(len(data))}}, s.segments...)
+	s.head = spoolHead{Index: index}
+	s.evict()
+	return s.saveHead()
+}
+
+// cutHead rewrites the head segment without the read records
+func (s *spool) cutHead() error {
+	seg := s.segments[0]
+	path := s.segmentPath(seg.index)
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(s.head.Offset, io.SeekStart); err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return err
+	}
+
+	isTail := len(s.segments) == 1 && s.tail != nil
+	if isTail {
+		s.tail.Close()
+		s.tail = nil
+	}
+	if err := writeFileSync(path, data); err != nil {
+		return err
+	}
+	seg.size = int64(len(data))
+	s.head.Offset = 0
+	if err := s.saveHead(); err != nil {
+		return err
+	}
+	if isTail {
+		return s.reopenTail()
+	}
+	return nil
+}
+
+func (s *spool) reopenTail() error {
+	f, err := os.OpenFile(s.segmentPath(s.segments[len(s.segments)-1].index), os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	s.tail = f
+	return nil
+}
+
+// Peek reads up to count records, not more than bytes in total, from the head segment.
+// The records are keyed by the increasing numbers to Commit them.
+func (s *spool) Peek(count int, bytes int) (map[int64]LogMessage, error) {
+	if s == nil {
+		return nil, nil
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	s.peeked = make(map[int64]spoolPosition)
+	for len(s.segments) > 0 {
+		batch, skipped, err := s.peek(count, bytes)
+		// The next segment is read if the rest of the head one was broken
+		if err != nil || len(batch) > 0 || !skipped {
+			return batch, err
+		}
+	}
+	return nil, nil
+}
+
+// peek reads the records from the head segment.
+// Returns true if the broken records were skipped.
+func (s *spool) peek(count int, bytes int) (map[int64]LogMessage, bool, error) {
+	index := s.segments[0].index
+	f, err := os.Open(s.segmentPath(index))
+	if err != nil {
+		return nil, false, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(s.head.Offset, io.SeekStart); err != nil {
+		return nil, false, err
+	}
+
+	batch := make(map[int64]LogMessage)
+	offset := s.head.Offset
+	var size int
+	r := bufio.NewReader(f)
+	for len(batch) < count && size < bytes {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			// Records are written by the whole lines,
+			// so the rest of the segment is broken by the crash
+			if len(line) > 0 {
+				log.Warnf("Skipping %d bytes of the broken spool record", len(line))
+				offset += int64(len(line))
+			}
+			break
+		} else if err != nil {
+			return nil, false, err
+		}
+		offset += int64(len(line))
+		size += len(line)
+
+		var record spoolRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			log.Error("Skipping broken spool record: ", err)
+			continue
+		}
+		record.Message.logTime = record.LogTime
+		record.Message.labels = record.Labels
+
+		s.seq++
+		batch[s.seq] = record.Message
+		s.peeked[s.seq] = spoolPosition{index: index, offset: offset}
+	}
+
+	// Skip the broken records
+	if len(batch) == 0 && offset > s.head.Offset {
+		s.commit(spoolPosition{index: index, offset: offset})
+		return nil, true, nil
+	}
+	return batch, false, nil
+}
+
+// Commit moves the read position after the record
+func (s *spool) Commit(key int64) {
+	if s == nil {
+		return
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if pos, ok := s.peeked[key]; ok {
+		s.commit(pos)
+	}
+}
+
+func (s *spool) commit(pos spoolPosition) {
+	if len(s.segments) == 0 || pos.index != s.head.Index || pos.offset <= s.head.Offset {
+		// The segment was evicted or prepended
+		return
+	}
+	s.head.Offset = pos.offset
+	s.removeConsumed()
+	if err := s.saveHead(); err != nil {
+		log.Error(err)
+	}
+}
+
+// removeConsumed deletes the read segments, the tail is deleted
+// only if it was completely read
+func (s *spool) removeConsumed() {
+	for len(s.segments) > 0 && s.head.Offset >= s.segments[0].size {
+		last := len(s.segments) == 1
+		if last && s.tail != nil {
+			s.tail.Close()
+			s.tail = nil
+		}
+		s.removeSegment(s.segments[0].index)
+		s.segments = s.segments[1:]
+		s.head = spoolHead{}
+		if len(s.segments) > 0 {
+			s.head.Index = s.segments[0].index
+		}
+	}
+}
+
+// evict deletes the oldest segments exceeding the MaxBytes
+func (s *spool) evict() {
+	for len(s.segments) > 1 && s.bytes() > s.maxBytes {
+		seg := s.segments[0]
+		log.Warnf("Spool is full, dropping %d bytes of the oldest messages", seg.size-s.head.Offset)
+		s.removeSegment(seg.index)
+		s.segments = s.segments[1:]
+		s.head = spoolHead{Index: s.segments[0].index}
+	}
+}
+
+func (s *spool) removeSegment(index int64) {
+	if err := os.Remove(s.segmentPath(index)); err != nil && !os.IsNotExist(err) {
+		log.Error(err)
+	}
+}
+
+func (s *spool) saveHead() error {
+	data, err := json.Marshal(s.head)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(s.dir, spoolHeadFile)
+	if err := ioutil.WriteFile(path+".tmp", data, 0640); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// Close syncs and closes the tail segment
+func (s *spool) Close() error {
+	if s == nil {
+		return nil
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if s.tail == nil {
+		return nil
+	}
+	if err := s.tail.Sync(); err != nil {
+		return err
+	}
+	err := s.tail.Close()
+	s.tail = nil
+	return err
+}
+
+func marshalSpoolRecords(msgs []LogMessage) ([]byte, error) {
+	var data []byte
+	for _, l := range msgs {
+		line, err := json.Marshal(spoolRecord{Message: l, LogTime: l.logTime, Labels: l.labels})
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, line...)
+		data = append(data, '\n')
+	}
+	return data, nil
+}
+
+// writeFileSync writes the file atomically and syncs it
+func writeFileSync(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".spool")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
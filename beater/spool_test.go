@@ -0,0 +1,222 @@
+package beater
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func newTestSpool(t *testing.T, conf SpoolConfig) *spool {
+	s, err := newSpool(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func spoolTempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "kubeat-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// spoolMessages creates the messages of the same record size
+func spoolMessages(names ...string) []LogMessage {
+	msgs := make([]LogMessage, 0, len(names))
+	for _, name := range names {
+		msgs = append(msgs, LogMessage{Message: name})
+	}
+	return msgs
+}
+
+// readSpool peeks and commits all the records
+func readSpool(t *testing.T, s *spool) []string {
+	var messages []string
+	for {
+		batch, err := s.Peek(2, DEFAULT_BATCH_BYTES)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(batch) == 0 {
+			return messages
+		}
+		for _, k := range sortedKeys(batch) {
+			messages = append(messages, batch[k].Message)
+			s.Commit(k)
+		}
+	}
+}
+
+func spoolSegmentFiles(t *testing.T, dir string) []string {
+	files, err := filepath.Glob(filepath.Join(dir, "*"+spoolSegmentExt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestSpoolSegments(t *testing.T) {
+	dir := spoolTempDir(t)
+	defer os.RemoveAll(dir)
+
+	record, _ := marshalSpoolRecords(spoolMessages("a"))
+	s := newTestSpool(t, SpoolConfig{Path: dir, SegmentBytes: int64(len(record)) * 2})
+	defer s.Close()
+	if err := s.Write(spoolMessages("a", "b", "c", "d", "e")...); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Write(spoolMessages("f")...); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.segments) != 2 {
+		t.Errorf("%d segments, want the new one after the full tail", len(s.segments))
+	}
+
+	if got := readSpool(t, s); !reflect.DeepEqual(got, []string{"a", "b", "c", "d", "e", "f"}) {
+		t.Errorf("read %v", got)
+	}
+	if !s.Empty() || len(spoolSegmentFiles(t, dir)) != 0 {
+		t.Errorf("Read segments are not removed: %v", spoolSegmentFiles(t, dir))
+	}
+}
+
+func TestSpoolPrepend(t *testing.T) {
+	dir := spoolTempDir(t)
+	defer os.RemoveAll(dir)
+	s := newTestSpool(t, SpoolConfig{Path: dir})
+	defer s.Close()
+
+	if err := s.Write(spoolMessages("c", "d", "e")...); err != nil {
+		t.Fatal(err)
+	}
+	batch, err := s.Peek(1, DEFAULT_BATCH_BYTES)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k := range batch {
+		s.Commit(k)
+	}
+
+	// The read part of the head is cut off, the prepended messages are read first
+	if err := s.Prepend(spoolMessages("a", "b")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Write(spoolMessages("f")...); err != nil {
+		t.Fatal(err)
+	}
+	if s.head.Index != spoolBaseIndex-1 || s.head.Offset != 0 {
+		t.Errorf("head = %+v", s.head)
+	}
+	if got := readSpool(t, s); !reflect.DeepEqual(got, []string{"a", "b", "d", "e", "f"}) {
+		t.Errorf("read %v", got)
+	}
+}
+
+func TestSpoolEvict(t *testing.T) {
+	dir := spoolTempDir(t)
+	defer os.RemoveAll(dir)
+
+	record, _ := marshalSpoolRecords(spoolMessages("a"))
+	size := int64(len(record))
+	s := newTestSpool(t, SpoolConfig{Path: dir, SegmentBytes: size * 2, MaxBytes: size * 4})
+	defer s.Close()
+
+	for _, m := range []string{"a", "b", "c", "d", "e", "f"} {
+		if err := s.Write(spoolMessages(m)...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := readSpool(t, s); !reflect.DeepEqual(got, []string{"c", "d", "e", "f"}) {
+		t.Errorf("read %v, want the oldest segment evicted", got)
+	}
+
+	// Prepended segment is evicted too
+	for _, m := range []string{"c", "d", "e", "f"} {
+		if err := s.Write(spoolMessages(m)...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Prepend(spoolMessages("a", "b")); err != nil {
+		t.Fatal(err)
+	}
+	if got := readSpool(t, s); !reflect.DeepEqual(got, []string{"c", "d", "e", "f"}) {
+		t.Errorf("read %v, want the prepended segment evicted", got)
+	}
+}
+
+func TestSpoolRecovery(t *testing.T) {
+	dir := spoolTempDir(t)
+	defer os.RemoveAll(dir)
+
+	s := newTestSpool(t, SpoolConfig{Path: dir})
+	if err := s.Write(spoolMessages("a", "b", "c")...); err != nil {
+		t.Fatal(err)
+	}
+	batch, err := s.Peek(1, DEFAULT_BATCH_BYTES)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k := range batch {
+		s.Commit(k)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The record broken by the crash is skipped
+	f, err := os.OpenFile(spoolSegmentFiles(t, dir)[0], os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"message":{"mess`)
+	f.Close()
+
+	// Reading is continued from the head.json position, new records go to the new segment
+	s = newTestSpool(t, SpoolConfig{Path: dir})
+	defer s.Close()
+	if err := s.Write(spoolMessages("d")...); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.segments) != 2 {
+		t.Errorf("%d segments, want the new tail", len(s.segments))
+	}
+	if got := readSpool(t, s); !reflect.DeepEqual(got, []string{"b", "c", "d"}) {
+		t.Errorf("read %v", got)
+	}
+}
+
+func TestSpoolBrokenHead(t *testing.T) {
+	dir := spoolTempDir(t)
+	defer os.RemoveAll(dir)
+
+	s := newTestSpool(t, SpoolConfig{Path: dir})
+	if err := s.Write(spoolMessages("a", "b")...); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	// Broken head is read from the start, the head of the removed segment too
+	for _, head := range []string{"{", `{"index":1,"offset":10}`} {
+		if err := ioutil.WriteFile(filepath.Join(dir, spoolHeadFile), []byte(head), 0640); err != nil {
+			t.Fatal(err)
+		}
+		s = newTestSpool(t, SpoolConfig{Path: dir})
+		batch, err := s.Peek(10, DEFAULT_BATCH_BYTES)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, k := range sortedKeys(batch) {
+			got = append(got, batch[k].Message)
+		}
+		if strings.Join(got, "") != "ab" {
+			t.Errorf("%s: read %v", head, got)
+		}
+		s.Close()
+	}
+}
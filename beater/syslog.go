@@ -0,0 +1,301 @@
+package beater
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	RFC5424_SYSLOG_FORMAT = "rfc5424"
+	RFC3164_SYSLOG_FORMAT = "rfc3164"
+
+	OCTET_COUNTING_FRAMING  = "octet_counting"
+	NON_TRANSPARENT_FRAMING = "non_transparent"
+
+	DEFAULT_SYSLOG_SD_ID    = "kubernetes@32473"
+	DEFAULT_SYSLOG_FACILITY = 1
+
+	// DEFAULT_SYSLOG_UDP_MAX_SIZE is the largest IPv4 UDP payload
+	DEFAULT_SYSLOG_UDP_MAX_SIZE = 65507
+)
+
+// SyslogConfig is the syslog output settings. Messages are sent to the first host.
+// AppName and Hostname are the templates like the kafka topic.
+type SyslogConfig struct {
+	// Protocol is `tcp', `udp' or `tls'
+	Protocol string `json:"protocol"`
+	// Format is `rfc5424' or `rfc3164'
+	Format string `json:"format"`
+	// Framing of the TCP messages is `octet_counting' or `non_transparent'
+	Framing string `json:"framing"`
+	// Facility is the user-level by default, 0 is the kern
+	Facility *int   `json:"facility"`
+	AppName  string `json:"app_name"`
+	Hostname string `json:"hostname"`
+	MsgID    string `json:"msg_id"`
+	// StructuredData adds the namespace, pod, container and container_id
+	// into the SDID element of the RFC 5424 message
+	StructuredData bool      `json:"structured_data"`
+	SDID           string    `json:"sd_id"`
+	Timeout        int       `json:"timeout"`
+	TLS            TLSConfig `json:"tls"`
+	// MaxSize of the UDP datagram in bytes, larger messages are dropped
+	MaxSize int `json:"max_size"`
+}
+
+type SyslogClient struct {
+	Client net.Conn
+	conf   *SyslogConfig
+	addr   string
+
+	appName  *messageTemplate
+	hostname *messageTemplate
+	tls      *tls.Config
+}
+
+func (s *SyslogClient) Connect(conf *SenderConfig) error {
+	if len(conf.Hosts) == 0 {
+		return errors.New("Syslog host is not set")
+	}
+	c := conf.Syslog
+	if c.Protocol == "" {
+		c.Protocol = "tcp"
+	}
+	if c.Format == "" {
+		c.Format = RFC5424_SYSLOG_FORMAT
+	}
+	if c.Framing == "" {
+		c.Framing = OCTET_COUNTING_FRAMING
+	}
+	if c.Facility == nil {
+		facility := DEFAULT_SYSLOG_FACILITY
+		c.Facility = &facility
+	}
+	if c.AppName == "" {
+		c.AppName = "{{ .Container }}"
+	}
+	if c.Hostname == "" {
+		c.Hostname = "{{ .PodName }}"
+	}
+	if c.SDID == "" {
+		c.SDID = DEFAULT_SYSLOG_SD_ID
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = 30
+	}
+	if c.MaxSize <= 0 || c.MaxSize > DEFAULT_SYSLOG_UDP_MAX_SIZE {
+		c.MaxSize = DEFAULT_SYSLOG_UDP_MAX_SIZE
+	}
+
+	switch c.Protocol {
+	case "tcp", "udp":
+	case "tls":
+		c.TLS.Enabled = true
+		tlsConfig, err := c.TLS.build()
+		if err != nil {
+			return err
+		}
+		s.tls = tlsConfig
+	default:
+		return errors.New("Wrong syslog protocol")
+	}
+	if *c.Facility < 0 || *c.Facility > 23 {
+		return errors.New("Wrong syslog facility")
+	}
+	switch c.Format {
+	case RFC5424_SYSLOG_FORMAT, RFC3164_SYSLOG_FORMAT:
+	default:
+		return errors.New("Wrong syslog format")
+	}
+	switch c.Framing {
+	case OCTET_COUNTING_FRAMING, NON_TRANSPARENT_FRAMING:
+	default:
+		return errors.New("Wrong syslog framing")
+	}
+
+	var err error
+	if s.appName, err = newMessageTemplate(c.AppName); err != nil {
+		return err
+	}
+	if s.hostname, err = newMessageTemplate(c.Hostname); err != nil {
+		return err
+	}
+	s.conf = &c
+	s.addr = conf.Hosts[0]
+
+	// The connection is dialed again on the push
+	if err := s.dial(); err != nil {
+		log.Error("Can't connect to the syslog: ", err)
+	}
+	return nil
+}
+
+func (s *SyslogClient) dial() error {
+	dialer := &net.Dialer{Timeout: time.Second * time.Duration(s.conf.Timeout)}
+
+	var conn net.Conn
+	var err error
+	switch s.conf.Protocol {
+	case "tls":
+		conn, err = tls.DialWithDialer(dialer, "tcp", s.addr, s.tls)
+	default:
+		conn, err = dialer.Dial(s.conf.Protocol, s.addr)
+	}
+	if err != nil {
+		return err
+	}
+	s.Client = conn
+	return nil
+}
+
+// Push writes the messages in order. The connection is closed on the error
+// and dialed again on the next push, the unsent messages are retried.
+// Messages exceeding the UDP max size are dropped.
+func (s *SyslogClient) Push(l map[int64]LogMessage) error {
+	if s.Client == nil {
+		if err := s.dial(); err != nil {
+			return err
+		}
+	}
+
+	log.Infof("Sending %d messages to the syslog", len(l))
+	keys := sortedKeys(l)
+	rejected := make(map[int64]LogMessage)
+	var err error
+	for i, k := range keys {
+		data := s.frame(s.format(l[k]))
+		if s.conf.Protocol == "udp" && len(data) > s.conf.MaxSize {
+			rejected[k] = l[k]
+			err = fmt.Errorf("%d bytes exceed the UDP max size", len(data))
+			continue
+		}
+
+		s.Client.SetWriteDeadline(time.Now().Add(time.Second * time.Duration(s.conf.Timeout)))
+		if _, err := s.Client.Write(data); err != nil {
+			s.Client.Close()
+			s.Client = nil
+
+			return &PushError{Failed: messagesOf(l, keys[i:]), Rejected: rejected, Err: err}
+		}
+	}
+	if len(rejected) > 0 {
+		return &PushError{Rejected: rejected, Err: err}
+	}
+	return nil
+}
+
+// frame adds the TCP framing to the message
+func (s *SyslogClient) frame(msg string) []byte {
+	if s.conf.Protocol == "udp" {
+		return []byte(msg)
+	}
+	if s.conf.Framing == NON_TRANSPARENT_FRAMING {
+		return []byte(strings.Replace(msg, "\n", " ", -1) + "\n")
+	}
+	return []byte(strconv.Itoa(len(msg)) + " " + msg)
+}
+
+// format formats the message as RFC 5424 or RFC 3164
+func (s *SyslogClient) format(l LogMessage) string {
+	pri := *s.conf.Facility*8 + syslogSeverity(l.Level)
+	hostname := s.render(s.hostname, l, 255)
+	appName := s.render(s.appName, l, 48)
+
+	if s.conf.Format == RFC3164_SYSLOG_FORMAT {
+		return fmt.Sprintf("<%d>%s %s %s: %s",
+			pri, l.Timestamp.Local().Format(time.Stamp), hostname, truncate(appName, 32), l.Message)
+	}
+
+	msgID := syslogHeaderValue(s.conf.MsgID, 32)
+	sd := "-"
+	if s.conf.StructuredData {
+		sd = s.structuredData(l)
+	}
+	// PROCID of the kubeat says nothing about the container process
+	return fmt.Sprintf("<%d>1 %s %s %s - %s %s %s",
+		pri, l.Timestamp.UTC().Format("2006-01-02T15:04:05.000000Z07:00"),
+		hostname, appName, msgID, sd, l.Message)
+}
+
+func (s *SyslogClient) render(t *messageTemplate, l LogMessage, max int) string {
+	v, err := t.render(l)
+	if err != nil {
+		log.Error(err)
+	}
+	return syslogHeaderValue(v, max)
+}
+
+// structuredData returns the SD element with the pod params
+func (s *SyslogClient) structuredData(l LogMessage) string {
+	params := []struct{ name, value string }{
+		{"namespace", l.Namespace},
+		{"pod", l.PodName},
+		{"container", l.Container},
+		{"container_id", l.ContainerID},
+	}
+
+	var b strings.Builder
+	b.WriteString("[" + syslogHeaderValue(s.conf.SDID, 32))
+	for _, p := range params {
+		if p.value == "" {
+			continue
+		}
+		b.WriteString(" " + p.name + `="` + escapeSDParam(p.value) + `"`)
+	}
+	b.WriteString("]")
+	return b.String()
+}
+
+// syslogSeverity maps the message level to the syslog severity
+func syslogSeverity(level string) int {
+	switch strings.ToLower(level) {
+	case "emerg", "panic":
+		return 0
+	case "alert":
+		return 1
+	case "crit", "critical", "fatal":
+		return 2
+	case "err", "error":
+		return 3
+	case "warn", "warning":
+		return 4
+	case "notice":
+		return 5
+	case "debug", "trace":
+		return 7
+	}
+	return 6
+}
+
+// syslogHeaderValue replaces the spaces and not printable characters,
+// returns the NILVALUE if the value is empty
+func syslogHeaderValue(v string, max int) string {
+	if v == "" {
+		return "-"
+	}
+	v = strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' {
+			return '_'
+		}
+		return r
+	}, v)
+	return truncate(v, max)
+}
+
+func escapeSDParam(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(v)
+}
+
+func truncate(v string, max int) string {
+	if len(v) > max {
+		return v[:max]
+	}
+	return v
+}
@@ -0,0 +1,159 @@
+package beater
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+var syslogTestMessage = LogMessage{
+	Namespace:   "default",
+	PodName:     "web-1",
+	Container:   "nginx",
+	ContainerID: "docker://abc",
+	Message:     "GET / 200",
+	Level:       "warning",
+	Timestamp:   time.Date(2020, 1, 2, 3, 4, 5, 6000, time.UTC),
+}
+
+func syslogFacility(f int) *int {
+	return &f
+}
+
+// newTestSyslog returns the client of the conf with the defaults.
+// The connection error of the closed host is ignored by the Connect.
+func newTestSyslog(t *testing.T, host string, conf SyslogConfig) *SyslogClient {
+	s := &SyslogClient{}
+	if err := s.Connect(&SenderConfig{Hosts: []string{host}, Syslog: conf}); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestSyslogFormat(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		conf SyslogConfig
+		want string
+	}{
+		{
+			name: "rfc5424",
+			conf: SyslogConfig{Format: RFC5424_SYSLOG_FORMAT},
+			want: "<12>1 2020-01-02T03:04:05.000006Z web-1 nginx - - - GET / 200",
+		},
+		{
+			name: "rfc5424 structured data",
+			conf: SyslogConfig{Facility: syslogFacility(16), MsgID: "access log", StructuredData: true, AppName: "{{ .Namespace }}.{{ .Container }}"},
+			want: `<132>1 2020-01-02T03:04:05.000006Z web-1 default.nginx - access_log ` +
+				`[kubernetes@32473 namespace="default" pod="web-1" container="nginx" container_id="docker://abc"] GET / 200`,
+		},
+		{
+			name: "rfc3164",
+			conf: SyslogConfig{Format: RFC3164_SYSLOG_FORMAT, Hostname: "node a"},
+			want: "<12>" + syslogTestMessage.Timestamp.Local().Format(time.Stamp) + " node_a nginx: GET / 200",
+		},
+		{
+			name: "kern facility",
+			conf: SyslogConfig{Facility: syslogFacility(0)},
+			want: "<4>1 2020-01-02T03:04:05.000006Z web-1 nginx - - - GET / 200",
+		},
+	} {
+		s := newTestSyslog(t, "127.0.0.1:1", test.conf)
+		if got := s.format(syslogTestMessage); got != test.want {
+			t.Errorf("%s: format() = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSyslogWrongFacility(t *testing.T) {
+	for _, f := range []int{-1, 24} {
+		conf := &SenderConfig{Hosts: []string{"127.0.0.1:1"}, Syslog: SyslogConfig{Facility: syslogFacility(f)}}
+		if err := (&SyslogClient{}).Connect(conf); err == nil {
+			t.Errorf("Connect() with the facility %d must fail", f)
+		}
+	}
+}
+
+func TestSyslogFormatEmptyHeader(t *testing.T) {
+	s := newTestSyslog(t, "127.0.0.1:1", SyslogConfig{StructuredData: true})
+	got := s.format(LogMessage{Message: "x", Timestamp: syslogTestMessage.Timestamp})
+	want := "<14>1 2020-01-02T03:04:05.000006Z - - - - [kubernetes@32473] x"
+	if got != want {
+		t.Errorf("format() = %q, want %q", got, want)
+	}
+}
+
+func TestSyslogFrame(t *testing.T) {
+	for _, test := range []struct {
+		conf SyslogConfig
+		want string
+	}{
+		{SyslogConfig{Framing: OCTET_COUNTING_FRAMING}, "8 a\nb c\r\nd"},
+		{SyslogConfig{Framing: NON_TRANSPARENT_FRAMING}, "a b c\r d\n"},
+		{SyslogConfig{Protocol: "udp", Framing: NON_TRANSPARENT_FRAMING}, "a\nb c\r\nd"},
+	} {
+		s := newTestSyslog(t, "127.0.0.1:1", test.conf)
+		if got := string(s.frame("a\nb c\r\nd")); got != test.want {
+			t.Errorf("frame() of %s %s = %q, want %q", s.conf.Protocol, test.conf.Framing, got, test.want)
+		}
+	}
+}
+
+func TestSyslogSeverity(t *testing.T) {
+	for level, want := range map[string]int{
+		"panic":    0,
+		"alert":    1,
+		"FATAL":    2,
+		"error":    3,
+		"Warning":  4,
+		"notice":   5,
+		"info":     6,
+		"":         6,
+		"unknown":  6,
+		"trace":    7,
+		"debug":    7,
+		"critical": 2,
+	} {
+		if got := syslogSeverity(level); got != want {
+			t.Errorf("syslogSeverity(%q) = %d, want %d", level, got, want)
+		}
+	}
+}
+
+func TestSyslogRender(t *testing.T) {
+	tmpl, err := newMessageTemplate("{{ .Namespace }} {{ .PodName }}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &SyslogClient{}
+	if got := s.render(tmpl, syslogTestMessage, 255); got != "default_web-1" {
+		t.Errorf("render() = %q, want %q", got, "default_web-1")
+	}
+	if got := s.render(tmpl, syslogTestMessage, 4); got != "defa" {
+		t.Errorf("render() = %q, want the truncated value", got)
+	}
+	if got := s.render(tmpl, LogMessage{}, 255); got != "_" {
+		t.Errorf("render() of the empty message = %q, want %q", got, "_")
+	}
+}
+
+func TestSyslogUDPMaxSize(t *testing.T) {
+	conn, received := listenUDP(t)
+	defer conn.Close()
+
+	s := newTestSyslog(t, conn.LocalAddr().String(), SyslogConfig{Protocol: "udp", MaxSize: 512})
+	l := map[int64]LogMessage{
+		1: {Message: "small"},
+		2: {Message: strings.Repeat("x", 1024)},
+		3: {Message: "after"},
+	}
+	perr, ok := s.Push(l).(*PushError)
+	if !ok || len(perr.Failed) != 0 || len(perr.Rejected) != 1 || perr.Rejected[2].Message == "" {
+		t.Fatalf("Push() = %v, want the large message rejected", perr)
+	}
+	for _, want := range []string{"small", "after"} {
+		if got := string(receiveUDP(t, received)); !strings.HasSuffix(got, " "+want) {
+			t.Errorf("received %q, want the message %q", got, want)
+		}
+	}
+}
@@ -1,36 +1,222 @@
 package beater
 
 import (
+	"crypto/tls"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"net"
-	"strings"
+	"strconv"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
+const (
+	NEWLINE_FRAMING         = "newline"
+	LENGTH_PREFIXED_FRAMING = "length_prefixed"
+
+	FAILOVER_BALANCE    = "failover"
+	ROUND_ROBIN_BALANCE = "round_robin"
+)
+
+// TCPConfig is the tcp and unix outputs settings. Hosts are the `host:port'
+// of the receivers or the paths of the unix sockets.
+type TCPConfig struct {
+	// Framing of the JSON messages is `newline', `length_prefixed'
+	// with the 4 bytes big endian length or `octet_counting'
+	Framing string `json:"framing"`
+	// Balance is `failover' to send to the first available host
+	// or `round_robin' to send the batches to the hosts in turn
+	Balance string    `json:"balance"`
+	Timeout int       `json:"timeout"`
+	TLS     TLSConfig `json:"tls"`
+}
+
+// TCPClient sends the messages over the stream connections,
+// Network is `tcp' by default or `unix'
 type TCPClient struct {
-	Client net.Conn
-	conf   *SenderConfig
+	Network string
+
+	conf  *TCPConfig
+	retry RetryConfig
+	tls   *tls.Config
+	hosts []*tcpHost
+	next  int
 }
 
-func (t *TCPClient) Connect(conf *SenderConfig) (err error) {
-	conn, err := net.Dial("tcp", strings.Join(conf.Hosts, ""))
-	t.Client = conn
-	return
+// tcpHost is the connection to the host. The host is dialed again
+// after the backoff of the failures.
+type tcpHost struct {
+	addr     string
+	conn     net.Conn
+	failures int
+	retryAt  time.Time
 }
 
-func (t *TCPClient) Push(l map[int64]LogMessage) error {
-	log.Infof("Tying send %d logs", len(l))
-	for _, v := range l {
-		data, err := json.Marshal(v)
-		if err != nil {
-			return err
+func (t *TCPClient) Connect(conf *SenderConfig) error {
+	if len(conf.Hosts) == 0 {
+		return errors.New("TCP hosts are not set")
+	}
+	if t.Network == "" {
+		t.Network = "tcp"
+	}
+	c := conf.TCP
+	if c.Framing == "" {
+		c.Framing = NEWLINE_FRAMING
+	}
+	if c.Balance == "" {
+		c.Balance = FAILOVER_BALANCE
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = 30
+	}
+	switch c.Framing {
+	case NEWLINE_FRAMING, LENGTH_PREFIXED_FRAMING, OCTET_COUNTING_FRAMING:
+	default:
+		return errors.New("Wrong tcp framing")
+	}
+	switch c.Balance {
+	case FAILOVER_BALANCE, ROUND_ROBIN_BALANCE:
+	default:
+		return errors.New("Wrong tcp balance")
+	}
+
+	var err error
+	if t.tls, err = c.TLS.build(); err != nil {
+		return err
+	}
+	t.conf = &c
+	t.retry = conf.Retry
+	t.retry.setDefaults()
+	t.hosts = make([]*tcpHost, 0, len(conf.Hosts))
+	for _, addr := range conf.Hosts {
+		t.hosts = append(t.hosts, &tcpHost{addr: addr})
+	}
+
+	// Hosts are dialed again on the push
+	if _, err := t.conn(); err != nil {
+		log.Error("Can't connect to the TCP hosts: ", err)
+	}
+	return nil
+}
+
+// conn returns the connected host. Failover starts from the first host,
+// round robin from the host next to the previous one.
+func (t *TCPClient) conn() (*tcpHost, error) {
+	start := 0
+	if t.conf.Balance == ROUND_ROBIN_BALANCE {
+		start = t.next
+		t.next = (t.next + 1) % len(t.hosts)
+	}
+
+	err := errors.New("All TCP hosts are in the backoff")
+	for i := range t.hosts {
+		h := t.hosts[(start+i)%len(t.hosts)]
+		if h.conn != nil {
+			return h, nil
+		}
+		if time.Now().Before(h.retryAt) {
+			continue
+		}
+		if err = t.dial(h); err == nil {
+			return h, nil
 		}
+		log.Error(err)
+	}
+	return nil, err
+}
 
-		d := string(data) + "\n"
-		if _, err := t.Client.Write([]byte(d)); err != nil {
-			panic(err)
+func (t *TCPClient) dial(h *tcpHost) error {
+	dialer := &net.Dialer{Timeout: time.Second * time.Duration(t.conf.Timeout)}
+
+	var conn net.Conn
+	var err error
+	if t.tls != nil {
+		conn, err = tls.DialWithDialer(dialer, t.Network, h.addr, t.tls)
+	} else {
+		conn, err = dialer.Dial(t.Network, h.addr)
+	}
+	if err != nil {
+		t.fail(h)
+		return err
+	}
+	h.conn = conn
+	h.failures = 0
+	return nil
+}
+
+// fail closes the connection and delays the next dial of the host
+func (t *TCPClient) fail(h *tcpHost) {
+	if h.conn != nil {
+		h.conn.Close()
+		h.conn = nil
+	}
+	h.failures++
+	h.retryAt = time.Now().Add(t.retry.backoff(h.failures))
+}
+
+// Push writes the messages in order. The connection is closed on the error,
+// the unsent messages are retried.
+func (t *TCPClient) Push(l map[int64]LogMessage) error {
+	h, err := t.conn()
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Sending %d messages to the %s", len(l), h.addr)
+	keys, lines, rejected, err := encodeJSON(l)
+	for i, data := range lines {
+		h.conn.SetWriteDeadline(time.Now().Add(time.Second * time.Duration(t.conf.Timeout)))
+		if _, err := h.conn.Write(t.frame(data)); err != nil {
+			t.fail(h)
+			return &PushError{Failed: messagesOf(l, keys[i:]), Rejected: rejected, Err: err}
 		}
 	}
+	if len(rejected) > 0 {
+		return &PushError{Rejected: rejected, Err: err}
+	}
 	return nil
 }
+
+// encodeJSON marshals the messages in order. Returns the keys and the lines
+// of the encoded messages, the messages failed to marshal are rejected.
+func encodeJSON(l map[int64]LogMessage) ([]int64, [][]byte, map[int64]LogMessage, error) {
+	keys := make([]int64, 0, len(l))
+	lines := make([][]byte, 0, len(l))
+	rejected := make(map[int64]LogMessage)
+	var err error
+	for _, k := range sortedKeys(l) {
+		data, e := json.Marshal(l[k])
+		if e != nil {
+			rejected[k] = l[k]
+			err = e
+			continue
+		}
+		keys = append(keys, k)
+		lines = append(lines, data)
+	}
+	return keys, lines, rejected, err
+}
+
+// messagesOf returns the messages of the keys
+func messagesOf(l map[int64]LogMessage, keys []int64) map[int64]LogMessage {
+	m := make(map[int64]LogMessage, len(keys))
+	for _, k := range keys {
+		m[k] = l[k]
+	}
+	return m
+}
+
+// frame adds the framing to the message
+func (t *TCPClient) frame(data []byte) []byte {
+	switch t.conf.Framing {
+	case LENGTH_PREFIXED_FRAMING:
+		b := make([]byte, 4, 4+len(data))
+		binary.BigEndian.PutUint32(b, uint32(len(data)))
+		return append(b, data...)
+	case OCTET_COUNTING_FRAMING:
+		return append([]byte(strconv.Itoa(len(data))+" "), data...)
+	}
+	return append(data, '\n')
+}
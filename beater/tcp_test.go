@@ -0,0 +1,222 @@
+package beater
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// listenTCP returns the listener and the channel of the received newline framed messages
+func listenTCP(t *testing.T, network, addr string) (net.Listener, chan string) {
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan string, 100)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					var l LogMessage
+					if err := json.Unmarshal(scanner.Bytes(), &l); err != nil {
+						received <- "wrong message: " + err.Error()
+						continue
+					}
+					received <- l.Message
+				}
+			}()
+		}
+	}()
+	return ln, received
+}
+
+func receiveTCP(t *testing.T, received chan string, want string) {
+	select {
+	case got := <-received:
+		if got != want {
+			t.Errorf("received %q, want %q", got, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Message %q is not received", want)
+	}
+}
+
+// closedTCPAddr returns the address refusing the connections
+func closedTCPAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+func TestTCPFrame(t *testing.T) {
+	for _, c := range []struct {
+		framing string
+		want    string
+	}{
+		{NEWLINE_FRAMING, "{\"a\":1}\n"},
+		{LENGTH_PREFIXED_FRAMING, "\x00\x00\x00\x07{\"a\":1}"},
+		{OCTET_COUNTING_FRAMING, "7 {\"a\":1}"},
+	} {
+		tc := &TCPClient{conf: &TCPConfig{Framing: c.framing}}
+		if got := string(tc.frame([]byte(`{"a":1}`))); got != c.want {
+			t.Errorf("%s: frame() = %q, want %q", c.framing, got, c.want)
+		}
+	}
+}
+
+func TestTCPConnectErrors(t *testing.T) {
+	for _, conf := range []*SenderConfig{
+		{},
+		{Hosts: []string{"127.0.0.1:1"}, TCP: TCPConfig{Framing: "xml"}},
+		{Hosts: []string{"127.0.0.1:1"}, TCP: TCPConfig{Balance: "random"}},
+	} {
+		if err := (&TCPClient{}).Connect(conf); err == nil {
+			t.Errorf("Connect(%+v) must fail", conf.TCP)
+		}
+	}
+}
+
+func TestTCPRoundRobin(t *testing.T) {
+	a, receivedA := listenTCP(t, "tcp", "127.0.0.1:0")
+	defer a.Close()
+	b, receivedB := listenTCP(t, "tcp", "127.0.0.1:0")
+	defer b.Close()
+
+	tc := &TCPClient{}
+	conf := &SenderConfig{
+		Hosts: []string{a.Addr().String(), b.Addr().String()},
+		TCP:   TCPConfig{Balance: ROUND_ROBIN_BALANCE},
+	}
+	if err := tc.Connect(conf); err != nil {
+		t.Fatal(err)
+	}
+	for _, message := range []string{"1", "2", "3"} {
+		if err := tc.Push(map[int64]LogMessage{1: {Message: message}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Batches go to the hosts in turn
+	hosts := make(map[string]string)
+	for range []string{"1", "2", "3"} {
+		select {
+		case m := <-receivedA:
+			hosts[m] = "a"
+		case m := <-receivedB:
+			hosts[m] = "b"
+		case <-time.After(time.Second):
+			t.Fatalf("Messages are not received, got %v", hosts)
+		}
+	}
+	if hosts["1"] == hosts["2"] || hosts["1"] != hosts["3"] {
+		t.Errorf("Messages are sent to the hosts %v, want in turn", hosts)
+	}
+}
+
+func TestTCPFailover(t *testing.T) {
+	b, received := listenTCP(t, "tcp", "127.0.0.1:0")
+	defer b.Close()
+
+	// The first host is in the backoff after the failed dial
+	tc := &TCPClient{}
+	if err := tc.Connect(&SenderConfig{Hosts: []string{closedTCPAddr(t), b.Addr().String()}}); err != nil {
+		t.Fatal(err)
+	}
+	if tc.hosts[0].failures != 1 || !tc.hosts[0].retryAt.After(time.Now()) {
+		t.Errorf("Failed host %+v is not in the backoff", tc.hosts[0])
+	}
+	batch := map[int64]LogMessage{2: {Message: "b"}, 1: {Message: "a"}}
+	if err := tc.Push(batch); err != nil {
+		t.Fatal(err)
+	}
+	// Messages are written in order
+	receiveTCP(t, received, "a")
+	receiveTCP(t, received, "b")
+}
+
+func TestTCPReconnect(t *testing.T) {
+	addr := closedTCPAddr(t)
+
+	// Hosts failed to dial don't fail the start
+	tc := &TCPClient{}
+	conf := &SenderConfig{Hosts: []string{addr}, Retry: RetryConfig{InitialInterval: 0.01, MaxInterval: 0.01}}
+	if err := tc.Connect(conf); err != nil {
+		t.Fatalf("Connect() = %v, want the hosts dialed on the push", err)
+	}
+	batch := map[int64]LogMessage{1: {Message: "a"}}
+	if err := tc.Push(batch); err == nil {
+		t.Fatal("Push() to the closed host must fail")
+	}
+
+	// The receiver resets the connection after the first message
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	received := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		received <- line
+		conn.(*net.TCPConn).SetLinger(0)
+		conn.Close()
+	}()
+	time.Sleep(20 * time.Millisecond)
+	if err := tc.Push(batch); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-received:
+	case <-time.After(time.Second):
+		t.Fatal("Message is not received after the reconnect")
+	}
+
+	// The reset is reported on the next writes
+	for i := 0; i < 50 && err == nil; i++ {
+		err = tc.Push(batch)
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(failedMessages(batch, err)) != 1 || tc.hosts[0].conn != nil {
+		t.Fatalf("Push() = %v, want the batch failed and the connection closed", err)
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kubeat-unix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "kubeat.sock")
+	ln, received := listenTCP(t, "unix", path)
+	defer ln.Close()
+
+	tc := &TCPClient{Network: "unix"}
+	if err := tc.Connect(&SenderConfig{Hosts: []string{path}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.Push(map[int64]LogMessage{1: {Message: "a"}}); err != nil {
+		t.Fatal(err)
+	}
+	receiveTCP(t, received, "a")
+}
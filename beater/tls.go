@@ -0,0 +1,70 @@
+package beater
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// TLSConfig is the TLS settings of the output connection
+type TLSConfig struct {
+	Enabled    bool   `json:"enabled"`
+	CAFile     string `json:"ca_file"`
+	CertFile   string `json:"cert_file"`
+	KeyFile    string `json:"key_file"`
+	ServerName string `json:"server_name"`
+	SkipVerify bool   `json:"skip_verify"`
+}
+
+// build returns the crypto/tls config or nil if the TLS is disabled
+func (c *TLSConfig) build() (*tls.Config, error) {
+	if c == nil || !c.Enabled {
+		return nil, nil
+	}
+
+	conf := &tls.Config{
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.SkipVerify,
+	}
+	if c.CAFile != "" {
+		data, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, errors.New("No certificates found in " + c.CAFile)
+		}
+		conf.RootCAs = pool
+	}
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	return conf, nil
+}
+
+// newHTTPClient creates the HTTP client with the TLS settings.
+// Timeout is in seconds, 30 by default.
+func newHTTPClient(c *TLSConfig, timeout int) (*http.Client, error) {
+	tlsConfig, err := c.build()
+	if err != nil {
+		return nil, err
+	}
+	if timeout <= 0 {
+		timeout = 30
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{
+		Transport: transport,
+		Timeout:   time.Second * time.Duration(timeout),
+	}, nil
+}
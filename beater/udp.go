@@ -0,0 +1,187 @@
+package beater
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	NONE_CHUNKING = "none"
+	GELF_CHUNKING = "gelf"
+
+	DEFAULT_UDP_MAX_SIZE = 8192
+
+	// GELF chunk is prefixed with the magic bytes, the message ID,
+	// the sequence number and the sequence count
+	gelfChunkHeaderSize = 12
+	gelfMaxChunks       = 128
+)
+
+// UDPConfig is the udp output settings. Hosts are the `host:port' of the receivers.
+type UDPConfig struct {
+	// MaxSize of the datagram in bytes
+	MaxSize int `json:"max_size"`
+	// Chunking of the larger messages is `none' to drop them or `gelf'
+	Chunking string `json:"chunking"`
+	// Balance is `failover' to send to the next host after the error
+	// or `round_robin' to send the batches to the hosts in turn
+	Balance string `json:"balance"`
+	Timeout int    `json:"timeout"`
+}
+
+type UDPClient struct {
+	conf  *UDPConfig
+	hosts []string
+	conns []net.Conn
+	// current is the host of the next push
+	current int
+}
+
+func (u *UDPClient) Connect(conf *SenderConfig) error {
+	if len(conf.Hosts) == 0 {
+		return errors.New("UDP host is not set")
+	}
+	c := conf.UDP
+	if c.MaxSize <= 0 {
+		c.MaxSize = DEFAULT_UDP_MAX_SIZE
+	}
+	if c.Chunking == "" {
+		c.Chunking = NONE_CHUNKING
+	}
+	if c.Balance == "" {
+		c.Balance = FAILOVER_BALANCE
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = 30
+	}
+	switch c.Chunking {
+	case NONE_CHUNKING:
+	case GELF_CHUNKING:
+		if c.MaxSize <= gelfChunkHeaderSize {
+			return errors.New("UDP max size is less than the GELF chunk header")
+		}
+	default:
+		return errors.New("Wrong udp chunking")
+	}
+	switch c.Balance {
+	case FAILOVER_BALANCE, ROUND_ROBIN_BALANCE:
+	default:
+		return errors.New("Wrong udp balance")
+	}
+	u.conf = &c
+	u.hosts = conf.Hosts
+	u.conns = make([]net.Conn, len(conf.Hosts))
+
+	// Hosts failed to dial are dialed again on the push
+	for n, host := range u.hosts {
+		conn, err := net.Dial("udp", host)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		u.conns[n] = conn
+	}
+	return nil
+}
+
+// conn returns the index of the dialed host. Failover keeps the host until the error,
+// round robin moves to the next host on every push.
+func (u *UDPClient) conn() (int, error) {
+	start := u.current
+	if u.conf.Balance == ROUND_ROBIN_BALANCE {
+		u.current = (u.current + 1) % len(u.hosts)
+	}
+
+	var err error
+	for i := range u.hosts {
+		n := (start + i) % len(u.hosts)
+		if u.conns[n] == nil {
+			if u.conns[n], err = net.Dial("udp", u.hosts[n]); err != nil {
+				log.Error(err)
+				continue
+			}
+		}
+		if u.conf.Balance == FAILOVER_BALANCE {
+			u.current = n
+		}
+		return n, nil
+	}
+	return 0, err
+}
+
+// Push sends the message per datagram. The socket is closed on the error
+// and the next host is used by the failover, the unsent messages are retried.
+// Messages exceeding the max size are dropped.
+func (u *UDPClient) Push(l map[int64]LogMessage) error {
+	n, err := u.conn()
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Sending %d messages to the %s", len(l), u.hosts[n])
+	keys, lines, rejected, err := encodeJSON(l)
+	for i, data := range lines {
+		datagrams := u.datagrams(data)
+		if datagrams == nil {
+			rejected[keys[i]] = l[keys[i]]
+			err = fmt.Errorf("%d bytes exceed the UDP max size", len(data))
+			continue
+		}
+		for _, d := range datagrams {
+			u.conns[n].SetWriteDeadline(time.Now().Add(time.Second * time.Duration(u.conf.Timeout)))
+			if _, err := u.conns[n].Write(d); err != nil {
+				u.conns[n].Close()
+				u.conns[n] = nil
+				if u.conf.Balance == FAILOVER_BALANCE {
+					u.current = (n + 1) % len(u.hosts)
+				}
+				return &PushError{Failed: messagesOf(l, keys[i:]), Rejected: rejected, Err: err}
+			}
+		}
+	}
+	if len(rejected) > 0 {
+		return &PushError{Rejected: rejected, Err: err}
+	}
+	return nil
+}
+
+// datagrams splits the message into the GELF chunks if it exceeds the max size.
+// Returns nil if the message can't be sent.
+func (u *UDPClient) datagrams(data []byte) [][]byte {
+	if len(data) <= u.conf.MaxSize {
+		return [][]byte{data}
+	}
+	if u.conf.Chunking != GELF_CHUNKING {
+		return nil
+	}
+
+	size := u.conf.MaxSize - gelfChunkHeaderSize
+	count := (len(data) + size - 1) / size
+	if count > gelfMaxChunks {
+		return nil
+	}
+
+	id := make([]byte, 8)
+	binary.BigEndian.PutUint64(id, uint64(rand.Int63()))
+
+	chunks := make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		end := (i + 1) * size
+		if end > len(data) {
+			end = len(data)
+		}
+		chunk := make([]byte, 0, gelfChunkHeaderSize+end-i*size)
+		chunk = append(chunk, 0x1e, 0x0f)
+		chunk = append(chunk, id...)
+		chunk = append(chunk, byte(i), byte(count))
+		chunk = append(chunk, data[i*size:end]...)
+		chunks = append(chunks, chunk)
+	}
+	return chunks
+}
@@ -0,0 +1,174 @@
+package beater
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// listenUDP returns the listener and the channel of the received datagrams
+func listenUDP(t *testing.T) (net.PacketConn, chan []byte) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan []byte, 100)
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			received <- append([]byte(nil), buf[:n]...)
+		}
+	}()
+	return conn, received
+}
+
+func receiveUDP(t *testing.T, received chan []byte) []byte {
+	select {
+	case d := <-received:
+		return d
+	case <-time.After(time.Second):
+		t.Fatal("Datagram is not received")
+	}
+	return nil
+}
+
+func TestUDPRoundRobin(t *testing.T) {
+	a, receivedA := listenUDP(t)
+	defer a.Close()
+	b, receivedB := listenUDP(t)
+	defer b.Close()
+
+	u := &UDPClient{}
+	conf := &SenderConfig{
+		Hosts: []string{a.LocalAddr().String(), b.LocalAddr().String()},
+		UDP:   UDPConfig{Balance: ROUND_ROBIN_BALANCE},
+	}
+	if err := u.Connect(conf); err != nil {
+		t.Fatal(err)
+	}
+	for _, message := range []string{"1", "2", "3"} {
+		if err := u.Push(map[int64]LogMessage{1: {Message: message}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, want := range []struct {
+		received chan []byte
+		message  string
+	}{{receivedA, "1"}, {receivedB, "2"}, {receivedA, "3"}} {
+		var l LogMessage
+		if err := json.Unmarshal(receiveUDP(t, want.received), &l); err != nil || l.Message != want.message {
+			t.Errorf("received %q, %v, want %q", l.Message, err, want.message)
+		}
+	}
+}
+
+func TestUDPFailover(t *testing.T) {
+	// The closed port refuses the datagrams
+	closed, _ := listenUDP(t)
+	closedAddr := closed.LocalAddr().String()
+	closed.Close()
+	b, received := listenUDP(t)
+	defer b.Close()
+
+	u := &UDPClient{}
+	if err := u.Connect(&SenderConfig{Hosts: []string{closedAddr, b.LocalAddr().String()}}); err != nil {
+		t.Fatal(err)
+	}
+	batch := map[int64]LogMessage{1: {Message: "a"}}
+
+	// The refusal is reported on the next write
+	var err error
+	for i := 0; i < 50 && err == nil; i++ {
+		err = u.Push(batch)
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(failedMessages(batch, err)) != 1 {
+		t.Fatalf("Push() = %v, want the batch failed", err)
+	}
+	if err := u.Push(batch); err != nil {
+		t.Fatal(err)
+	}
+	receiveUDP(t, received)
+}
+
+func TestUDPConnectRedial(t *testing.T) {
+	// Hosts failed to dial don't fail the start
+	u := &UDPClient{}
+	if err := u.Connect(&SenderConfig{Hosts: []string{"missing-port"}}); err != nil {
+		t.Fatalf("Connect() = %v, want the host dialed on the push", err)
+	}
+	if err := u.Push(map[int64]LogMessage{1: {Message: "a"}}); err == nil {
+		t.Error("Push() to the host failed to dial must fail")
+	}
+
+	conn, received := listenUDP(t)
+	defer conn.Close()
+	u.hosts[0] = conn.LocalAddr().String()
+	if err := u.Push(map[int64]LogMessage{1: {Message: "a"}}); err != nil {
+		t.Fatal(err)
+	}
+	receiveUDP(t, received)
+}
+
+func TestUDPMaxSize(t *testing.T) {
+	conn, received := listenUDP(t)
+	defer conn.Close()
+
+	u := &UDPClient{}
+	if err := u.Connect(&SenderConfig{Hosts: []string{conn.LocalAddr().String()}, UDP: UDPConfig{MaxSize: 512}}); err != nil {
+		t.Fatal(err)
+	}
+	l := map[int64]LogMessage{
+		1: {Message: "small"},
+		2: {Message: strings.Repeat("x", 1024)},
+	}
+	perr, ok := u.Push(l).(*PushError)
+	if !ok || len(perr.Failed) != 0 || len(perr.Rejected) != 1 || perr.Rejected[2].Message == "" {
+		t.Fatalf("Push() = %v, want the large message rejected", perr)
+	}
+	receiveUDP(t, received)
+
+	// GELF chunks share the message ID and are numbered
+	u.conf.Chunking = GELF_CHUNKING
+	if err := u.Push(map[int64]LogMessage{2: l[2]}); err != nil {
+		t.Fatal(err)
+	}
+	var chunks [][]byte
+	for i := 0; i < 3; i++ {
+		chunks = append(chunks, receiveUDP(t, received))
+	}
+	var data []byte
+	for i, chunk := range chunks {
+		if len(chunk) > 512 || chunk[0] != 0x1e || chunk[1] != 0x0f || chunk[10] != byte(i) || chunk[11] != 3 ||
+			!bytes.Equal(chunk[2:10], chunks[0][2:10]) {
+			t.Errorf("Wrong chunk %d header % x", i, chunk[:12])
+		}
+		data = append(data, chunk[12:]...)
+	}
+	var got LogMessage
+	if err := json.Unmarshal(data, &got); err != nil || got.Message != l[2].Message {
+		t.Errorf("Joined chunks are not the message: %v", err)
+	}
+}
+
+func TestEncodeJSON(t *testing.T) {
+	keys, lines, rejected, err := encodeJSON(map[int64]LogMessage{
+		2: {Message: "b"},
+		1: {Message: "a"},
+		3: {Fields: map[string]interface{}{"f": func() {}}},
+	})
+	if err == nil || len(rejected) != 1 || rejected[3].Fields == nil {
+		t.Errorf("rejected %v, %v", rejected, err)
+	}
+	if len(keys) != 2 || keys[0] != 1 || keys[1] != 2 || !bytes.Contains(lines[0], []byte(`"message":"a"`)) {
+		t.Errorf("keys %v, lines %q", keys, lines)
+	}
+}
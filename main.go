@@ -6,6 +6,9 @@ import (
 	"runtime"
 
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
 	"io/ioutil"
 
@@ -43,17 +46,36 @@ func main() {
 	podLogs.SkipVerify = kubeSkipTLSVerify
 	podLogs.Ignored = ignorePod
 
-	go podLogs.PodTicker()
+	go podLogs.Start()
+	go handleSignals(podLogs)
 
 	ticker := time.NewTicker(time.Duration(tickTime) * time.Second)
 
 	for t := range ticker.C {
 		log.Info(t.Unix(), " Num of logwatchers: ", podLogs.Len())
+		for ns, n := range podLogs.NamespacesLen() {
+			log.Info(t.Unix(), " Num of logwatchers in the namespace ", ns, ": ", n)
+		}
+		log.Info(t.Unix(), " Num of dropped lines: ", podLogs.Dropped())
+		log.Info(t.Unix(), " Num of rejected lines: ", podLogs.Rejected())
 		log.Info(t.Unix(), " Num of CGOCalls: ", runtime.NumCgoCall())
 		log.Info(t.Unix(), " Num of goroutines ", runtime.NumGoroutine())
 	}
 }
 
+// handleSignals flushes the checkpoints before exit
+func handleSignals(podLogs *beater.PodLogs) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+
+	sig := <-sigs
+	log.Warn("Received ", sig, ". Exiting.")
+	if err := podLogs.Close(); err != nil {
+		log.Error(err)
+	}
+	os.Exit(0)
+}
+
 func handleError(err error) {
 	if err != nil {
 		panic(err)
@@ -67,13 +89,16 @@ func isInK8S() bool {
 	return false
 }
 
+// getNamespace returns the namespace of the service account
+// or the namespace flag outside the cluster
 func getNamespace() string {
-	f, err := os.Open(namespacePath)
-	if os.IsExist(err) {
-		data, err := ioutil.ReadAll(f)
-		handleError(err)
-		return string(data)
+	data, err := ioutil.ReadFile(namespacePath)
+	if err == nil {
+		if ns := strings.TrimSpace(string(data)); ns != "" {
+			return ns
+		}
+	} else if !os.IsNotExist(err) {
+		log.Error(err)
 	}
-	f.Close()
 	return namespace
 }